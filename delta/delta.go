@@ -0,0 +1,116 @@
+package delta
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// blockSize is the length of the base blocks matches are searched from.
+// Matches shorter than two blocks may be missed.
+const blockSize = 16
+
+const (
+	opCopy   byte = 0
+	opInsert byte = 1
+)
+
+var ErrCorrupt = errors.New("delta: corrupt delta")
+
+// Encode returns a delta that rebuilds target from base. The delta is a
+// sequence of copy operations, referencing ranges of base, and insert
+// operations carrying new bytes.
+func Encode(base []byte, target []byte) []byte {
+	index := make(map[string]int, len(base)/blockSize)
+	for i := 0; i+blockSize <= len(base); i += blockSize {
+		key := string(base[i : i+blockSize])
+		if _, ok := index[key]; !ok {
+			index[key] = i
+		}
+	}
+
+	var out bytes.Buffer
+	writeUvarint(&out, uint64(len(target)))
+
+	pending := 0
+	for i := 0; i+blockSize <= len(target); {
+		offset, ok := index[string(target[i:i+blockSize])]
+		if !ok {
+			i++
+			continue
+		}
+
+		// Grow the match backwards into the pending insert and forwards
+		start := i
+		for start > pending && offset > 0 && target[start-1] == base[offset-1] {
+			start--
+			offset--
+		}
+		length := i - start + blockSize
+		for start+length < len(target) && offset+length < len(base) && target[start+length] == base[offset+length] {
+			length++
+		}
+
+		writeInsert(&out, target[pending:start])
+		out.WriteByte(opCopy)
+		writeUvarint(&out, uint64(offset))
+		writeUvarint(&out, uint64(length))
+		i = start + length
+		pending = i
+	}
+	writeInsert(&out, target[pending:])
+	return out.Bytes()
+}
+
+// Apply rebuilds the target from base and a delta produced by Encode
+func Apply(base []byte, delta []byte) ([]byte, error) {
+	r := bytes.NewReader(delta)
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, ErrCorrupt
+	}
+	target := make([]byte, 0, size)
+	for r.Len() > 0 {
+		op, _ := r.ReadByte()
+		switch op {
+		case opCopy:
+			offset, err := binary.ReadUvarint(r)
+			if err != nil {
+				return nil, ErrCorrupt
+			}
+			length, err := binary.ReadUvarint(r)
+			if err != nil || offset+length > uint64(len(base)) {
+				return nil, ErrCorrupt
+			}
+			target = append(target, base[offset:offset+length]...)
+		case opInsert:
+			length, err := binary.ReadUvarint(r)
+			if err != nil || length > uint64(r.Len()) {
+				return nil, ErrCorrupt
+			}
+			data := make([]byte, length)
+			r.Read(data)
+			target = append(target, data...)
+		default:
+			return nil, ErrCorrupt
+		}
+	}
+	if uint64(len(target)) != size {
+		return nil, ErrCorrupt
+	}
+	return target, nil
+}
+
+func writeInsert(out *bytes.Buffer, data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	out.WriteByte(opInsert)
+	writeUvarint(out, uint64(len(data)))
+	out.Write(data)
+}
+
+func writeUvarint(out *bytes.Buffer, value uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	out.Write(buf[:binary.PutUvarint(buf[:], value)])
+}
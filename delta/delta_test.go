@@ -0,0 +1,73 @@
+package delta
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	text := strings.Repeat("The quick brown fox jumps over the lazy dog. ", 20)
+	tests := []struct {
+		name   string
+		base   string
+		target string
+	}{
+		{"both empty", "", ""},
+		{"empty base", "", text},
+		{"empty target", text, ""},
+		{"identical", text, text},
+		{"fully replaced", strings.Repeat("a", 500), strings.Repeat("b", 700)},
+		{"shorter than a block", "abc", "abd"},
+		{"insert in the middle", text, text[:300] + "NEW TEXT" + text[300:]},
+		{"delete from the middle", text, text[:200] + text[400:]},
+		{"prepend and append", text, "start " + text + " end"},
+		{"reordered", text[:450] + text[450:], text[450:] + text[:450]},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			delta := Encode([]byte(tt.base), []byte(tt.target))
+			got, err := Apply([]byte(tt.base), delta)
+			if err != nil {
+				t.Fatalf("Apply() error = %v", err)
+			}
+			if !bytes.Equal(got, []byte(tt.target)) {
+				t.Errorf("Apply() = %q, want %q", got, tt.target)
+			}
+		})
+	}
+}
+
+func TestIdenticalIsSmall(t *testing.T) {
+	text := []byte(strings.Repeat("0123456789abcdef", 100))
+	if delta := Encode(text, text); len(delta) > 16 {
+		t.Errorf("delta of identical input is %d bytes, want a single copy", len(delta))
+	}
+}
+
+func TestApplyCorrupt(t *testing.T) {
+	base := []byte(strings.Repeat("0123456789abcdef", 4))
+	valid := Encode(base, append([]byte("prefix"), base...))
+
+	tests := []struct {
+		name  string
+		delta []byte
+	}{
+		{"empty", nil},
+		{"truncated", valid[:len(valid)-1]},
+		{"unknown operation", []byte{1, 7}},
+		{"copy past base", []byte{4, opCopy, 60, 10}},
+		{"insert past delta", []byte{4, opInsert, 4, 'a'}},
+		{"wrong size", []byte{5, opInsert, 1, 'a'}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Apply(base, tt.delta); !errors.Is(err, ErrCorrupt) {
+				t.Errorf("Apply() error = %v, want ErrCorrupt", err)
+			}
+		})
+	}
+}
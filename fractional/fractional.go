@@ -0,0 +1,89 @@
+// Package fractional generates lexicographically ordered keys for manual
+// ordering. A new key can always be generated between two existing keys, so
+// moving an item only rewrites that item's key.
+package fractional
+
+import (
+	"errors"
+	"strings"
+)
+
+// digits are ordered the same way by byte comparison, which is how keys must
+// be compared (COLLATE "C" in Postgres)
+const digits = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+var ErrInvalidKey = errors.New("fractional: invalid key")
+
+// Valid reports whether key is made of key digits and does not end in the
+// zero digit, which would leave no room for keys before it
+func Valid(key string) bool {
+	if key == "" || key[len(key)-1] == digits[0] {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if strings.IndexByte(digits, key[i]) < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// KeyBetween returns a key that sorts after a and before b. An empty a means
+// no lower bound and an empty b means no upper bound.
+func KeyBetween(a string, b string) (string, error) {
+	if (a != "" && !Valid(a)) || (b != "" && !Valid(b)) {
+		return "", ErrInvalidKey
+	}
+	if a != "" && b != "" && a >= b {
+		return "", errors.New("fractional: keys out of order")
+	}
+	return midpoint(a, b), nil
+}
+
+// midpoint returns a key strictly between a and b, treating a as padded with
+// zero digits and an empty b as above every key
+func midpoint(a string, b string) string {
+	if b != "" {
+		// Skip the common prefix
+		n := 0
+		for n < len(b) && digitAt(a, n) == b[n] {
+			n++
+		}
+		if n > 0 {
+			rest := ""
+			if n < len(a) {
+				rest = a[n:]
+			}
+			return b[:n] + midpoint(rest, b[n:])
+		}
+	}
+
+	low := 0
+	if a != "" {
+		low = strings.IndexByte(digits, a[0])
+	}
+	high := len(digits)
+	if b != "" {
+		high = strings.IndexByte(digits, b[0])
+	}
+	if high-low > 1 {
+		return string(digits[(low+high)/2])
+	}
+
+	// The first digits are adjacent
+	if len(b) > 1 {
+		return b[:1]
+	}
+	rest := ""
+	if len(a) > 1 {
+		rest = a[1:]
+	}
+	return string(digits[low]) + midpoint(rest, "")
+}
+
+func digitAt(key string, i int) byte {
+	if i < len(key) {
+		return key[i]
+	}
+	return digits[0]
+}
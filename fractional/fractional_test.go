@@ -0,0 +1,117 @@
+package fractional
+
+import (
+	"errors"
+	"testing"
+)
+
+// checkBetween fails unless key is valid and sorts strictly between a and b,
+// empty bounds being open
+func checkBetween(t *testing.T, a string, b string, key string) {
+	t.Helper()
+	if !Valid(key) {
+		t.Fatalf("KeyBetween(%q, %q) = %q, not a valid key", a, b, key)
+	}
+	if (a != "" && key <= a) || (b != "" && key >= b) {
+		t.Fatalf("KeyBetween(%q, %q) = %q, not between them", a, b, key)
+	}
+}
+
+func TestKeyBetween(t *testing.T) {
+	tests := []struct {
+		name string
+		a    string
+		b    string
+	}{
+		{name: "first key", a: "", b: ""},
+		{name: "append", a: "V", b: ""},
+		{name: "append after the last digit", a: "z", b: ""},
+		{name: "prepend", a: "", b: "V"},
+		{name: "prepend before the first digit", a: "", b: "1"},
+		{name: "gap between", a: "A", b: "Z"},
+		{name: "adjacent digits", a: "A", b: "B"},
+		{name: "prefix of the upper key", a: "A", b: "A1"},
+		{name: "longer lower key", a: "AzzY", b: "B"},
+		{name: "common prefix", a: "Vab", b: "Vac"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := KeyBetween(tt.a, tt.b)
+			if err != nil {
+				t.Fatalf("KeyBetween(%q, %q): %v", tt.a, tt.b, err)
+			}
+			checkBetween(t, tt.a, tt.b, key)
+		})
+	}
+}
+
+func TestKeyBetweenRepeated(t *testing.T) {
+	// Inserting again and again right after the same key, as when items are
+	// added one by one below the same item
+	low, high := "A", "B"
+	for i := 0; i < 200; i++ {
+		key, err := KeyBetween(low, high)
+		if err != nil {
+			t.Fatalf("insert %d: %v", i, err)
+		}
+		checkBetween(t, low, high, key)
+		high = key
+	}
+
+	// And right before the same key
+	low, high = "A", "B"
+	for i := 0; i < 200; i++ {
+		key, err := KeyBetween(low, high)
+		if err != nil {
+			t.Fatalf("insert %d: %v", i, err)
+		}
+		checkBetween(t, low, high, key)
+		low = key
+	}
+
+	// Appending and prepending keep working past the ends of the alphabet
+	first, last := "V", "V"
+	for i := 0; i < 200; i++ {
+		key, err := KeyBetween(last, "")
+		if err != nil {
+			t.Fatalf("append %d: %v", i, err)
+		}
+		checkBetween(t, last, "", key)
+		last = key
+
+		key, err = KeyBetween("", first)
+		if err != nil {
+			t.Fatalf("prepend %d: %v", i, err)
+		}
+		checkBetween(t, "", first, key)
+		first = key
+	}
+}
+
+func TestKeyBetweenErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		a       string
+		b       string
+		invalid bool
+	}{
+		{name: "equal keys", a: "V", b: "V"},
+		{name: "keys out of order", a: "W", b: "V"},
+		{name: "longer key out of order", a: "V1", b: "V"},
+		{name: "trailing zero digit", a: "V0", b: "", invalid: true},
+		{name: "character outside the digits", a: "", b: "V-", invalid: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := KeyBetween(tt.a, tt.b)
+			if err == nil {
+				t.Fatalf("KeyBetween(%q, %q) = %q, want an error", tt.a, tt.b, key)
+			}
+			if errors.Is(err, ErrInvalidKey) != tt.invalid {
+				t.Errorf("KeyBetween(%q, %q) error = %v, invalid key %v", tt.a, tt.b, err, tt.invalid)
+			}
+		})
+	}
+}
@@ -0,0 +1,44 @@
+-- Migration 05: Add full-text search over note titles and markdown text
+-- This script is idempotent and safe to run multiple times
+
+-- Add markdown column holding the plain markdown rendering of the Lexical body
+DO $$
+BEGIN
+    IF NOT EXISTS (
+        SELECT 1 FROM information_schema.columns 
+        WHERE table_schema = 'public' 
+        AND table_name = 'notes' 
+        AND column_name = 'markdown'
+    ) THEN
+        ALTER TABLE public.notes ADD COLUMN markdown text;
+    END IF;
+END $$;
+
+-- Add generated tsvector column weighting titles above body text
+DO $$
+BEGIN
+    IF NOT EXISTS (
+        SELECT 1 FROM information_schema.columns 
+        WHERE table_schema = 'public' 
+        AND table_name = 'notes' 
+        AND column_name = 'search_vector'
+    ) THEN
+        ALTER TABLE public.notes ADD COLUMN search_vector tsvector
+        GENERATED ALWAYS AS (
+            setweight(to_tsvector('english', coalesce(title, '')), 'A') ||
+            setweight(to_tsvector('english', coalesce(markdown, '')), 'B')
+        ) STORED;
+    END IF;
+END $$;
+
+-- Backfill markdown for existing notes from the text nodes of the Lexical body.
+-- Notes are re-rendered properly by the server on their next save.
+UPDATE public.notes
+SET markdown = (
+    SELECT string_agg(t #>> '{}', ' ')
+    FROM jsonb_path_query(body::jsonb, 'strict $.**.text') t
+)
+WHERE markdown IS NULL AND body LIKE '{%';
+
+-- Create GIN index for full-text search if it doesn't exist
+CREATE INDEX IF NOT EXISTS idx_notes_search_vector ON public.notes USING GIN (search_vector);
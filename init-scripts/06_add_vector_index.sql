@@ -0,0 +1,41 @@
+-- Migration 06: Type the embedding column and add an approximate nearest neighbour index
+-- This script is idempotent and safe to run multiple times
+
+-- ANN indexes need a fixed number of dimensions. Embeddings come from
+-- text-embedding-ada-002, which produces 1536 dimensional vectors.
+DO $$
+BEGIN
+    IF (
+        SELECT atttypmod FROM pg_attribute
+        WHERE attrelid = 'public.notes'::regclass
+        AND attname = 'embedding'
+    ) = -1 THEN
+        IF EXISTS (
+            SELECT 1 FROM public.notes
+            WHERE embedding IS NOT NULL AND vector_dims(embedding) <> 1536
+        ) THEN
+            RAISE NOTICE 'notes.embedding has vectors that are not 1536 dimensional, leaving it untyped';
+        ELSE
+            ALTER TABLE public.notes ALTER COLUMN embedding TYPE vector(1536);
+        END IF;
+    END IF;
+END $$;
+
+-- Create HNSW index for the default l2 metric if it doesn't exist. An
+-- untyped column cannot be indexed, so the index is skipped until the
+-- embeddings of other sizes are removed and this script is run again.
+-- The server creates the index for other metrics at startup, see VECTOR_DISTANCE_METRIC.
+DO $$
+BEGIN
+    IF (
+        SELECT atttypmod FROM pg_attribute
+        WHERE attrelid = 'public.notes'::regclass
+        AND attname = 'embedding'
+    ) = -1 THEN
+        RAISE NOTICE 'notes.embedding is untyped, skipping the vector index';
+    ELSE
+        CREATE INDEX IF NOT EXISTS idx_notes_embedding_hnsw_l2
+            ON public.notes USING hnsw (embedding vector_l2_ops)
+            WITH (m = 16, ef_construction = 64);
+    END IF;
+END $$;
@@ -0,0 +1,32 @@
+-- Migration 07: Add compressed revision storage and named revisions
+-- This script is idempotent and safe to run multiple times
+
+-- encoding is 'plain' when the body column holds the revision, 'keyframe' when
+-- data holds the gzipped body, and 'delta' when data holds a gzipped delta
+-- against the keyframe revision in keyframe_id
+ALTER TABLE public.revisions ADD COLUMN IF NOT EXISTS name text NULL;
+ALTER TABLE public.revisions ADD COLUMN IF NOT EXISTS encoding text NOT NULL DEFAULT 'plain';
+ALTER TABLE public.revisions ADD COLUMN IF NOT EXISTS data bytea NULL;
+ALTER TABLE public.revisions ADD COLUMN IF NOT EXISTS keyframe_id uuid NULL;
+ALTER TABLE public.revisions ADD COLUMN IF NOT EXISTS size integer NULL;
+
+-- Add foreign key for keyframes (only if not exists)
+DO $$
+BEGIN
+    IF NOT EXISTS (
+        SELECT 1 FROM information_schema.table_constraints 
+        WHERE constraint_name = 'revisions_keyframe_id_fkey' 
+        AND table_name = 'revisions'
+    ) THEN
+        ALTER TABLE public.revisions 
+        ADD CONSTRAINT revisions_keyframe_id_fkey 
+        FOREIGN KEY (keyframe_id) REFERENCES public.revisions(id);
+    END IF;
+END $$;
+
+-- Backfill the uncompressed size of existing revisions
+UPDATE public.revisions SET size = COALESCE(octet_length(body), 0) WHERE size IS NULL;
+
+-- Create indexes (if not exists)
+CREATE INDEX IF NOT EXISTS idx_revisions_note_created ON public.revisions(note_id, created_at);
+CREATE INDEX IF NOT EXISTS idx_revisions_keyframe ON public.revisions(keyframe_id);
@@ -0,0 +1,39 @@
+-- Migration 08: Add draft branches of notes
+-- This script is idempotent and safe to run multiple times
+
+-- A branch is an alternate title and body of a note. base_title and base_body
+-- hold the note as it was when the branch was created or last merged, the
+-- common ancestor for three-way merges.
+CREATE TABLE IF NOT EXISTS public.note_branches (
+    id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    note_id uuid NOT NULL REFERENCES public.notes(id) ON DELETE CASCADE,
+    user_id uuid NOT NULL,
+    name text NOT NULL,
+    title text NULL,
+    body text NULL,
+    base_title text NULL,
+    base_body text NULL,
+    created_at timestamp without time zone DEFAULT now(),
+    updated_at timestamp without time zone DEFAULT now(),
+    UNIQUE (note_id, name)
+);
+
+-- Revisions saved on a branch reference it, main body revisions do not
+ALTER TABLE public.revisions ADD COLUMN IF NOT EXISTS branch_id uuid NULL;
+
+DO $$
+BEGIN
+    IF NOT EXISTS (
+        SELECT 1 FROM information_schema.table_constraints 
+        WHERE constraint_name = 'revisions_branch_id_fkey' 
+        AND table_name = 'revisions'
+    ) THEN
+        ALTER TABLE public.revisions 
+        ADD CONSTRAINT revisions_branch_id_fkey 
+        FOREIGN KEY (branch_id) REFERENCES public.note_branches(id);
+    END IF;
+END $$;
+
+-- Create indexes (if not exists)
+CREATE INDEX IF NOT EXISTS idx_revisions_branch ON public.revisions(branch_id);
+CREATE INDEX IF NOT EXISTS idx_revisions_named ON public.revisions(note_id, created_at) WHERE name IS NOT NULL;
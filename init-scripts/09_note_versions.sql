@@ -0,0 +1,6 @@
+-- Migration 09: Add note versions for optimistic concurrency control
+-- This script is idempotent and safe to run multiple times
+
+-- version increases on every change to a note. Saves carrying the version
+-- they were based on are rejected when the note has changed since.
+ALTER TABLE public.notes ADD COLUMN IF NOT EXISTS version bigint NOT NULL DEFAULT 1;
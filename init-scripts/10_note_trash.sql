@@ -0,0 +1,22 @@
+-- Migration 10: Add a trash for deleted notes
+-- This script is idempotent and safe to run multiple times
+
+-- deleted_at is set on the root of a deleted subtree only. Its descendants
+-- are in the trash because an ancestor is.
+ALTER TABLE public.notes ADD COLUMN IF NOT EXISTS deleted_at timestamp without time zone NULL;
+
+CREATE INDEX IF NOT EXISTS idx_notes_deleted_at ON public.notes(user_id, deleted_at) WHERE deleted_at IS NOT NULL;
+
+-- Every note of a user that is in the trash, directly or through an ancestor
+CREATE OR REPLACE FUNCTION public.trashed_note_ids(owner uuid)
+RETURNS SETOF uuid
+LANGUAGE sql STABLE
+AS $$
+    WITH RECURSIVE trashed AS (
+        SELECT id FROM public.notes WHERE user_id = owner AND deleted_at IS NOT NULL
+        UNION
+        SELECT n.id FROM public.notes n
+        INNER JOIN trashed t ON n.parent = t.id
+    )
+    SELECT id FROM trashed
+$$;
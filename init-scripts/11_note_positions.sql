@@ -0,0 +1,22 @@
+-- Migration 11: Add manual ordering of sibling notes
+-- This script is idempotent and safe to run multiple times
+
+-- position is a fractional key ordering a note among its siblings. Keys are
+-- compared bytewise, so the column uses the C collation.
+ALTER TABLE public.notes ADD COLUMN IF NOT EXISTS position text COLLATE "C" NULL;
+
+-- Give existing notes positions in their current order, most recently
+-- updated first. Keys are zero padded so they sort numerically and end in a
+-- non-zero digit so new keys can be placed before them.
+UPDATE public.notes n
+SET position = ordered.position
+FROM (
+    SELECT id, lpad((ROW_NUMBER() OVER (
+        PARTITION BY user_id, parent ORDER BY updated_at DESC, id
+    ))::text, 8, '0') || 'V' AS position
+    FROM public.notes
+) ordered
+WHERE n.id = ordered.id AND n.position IS NULL;
+
+-- Create indexes (if not exists)
+CREATE INDEX IF NOT EXISTS idx_notes_parent_position ON public.notes(user_id, parent, position);
@@ -0,0 +1,7 @@
+-- Migration 12: Add note templates
+-- This script is idempotent and safe to run multiple times
+
+-- A template note is instantiated together with its subtree
+ALTER TABLE public.notes ADD COLUMN IF NOT EXISTS is_template boolean NOT NULL DEFAULT false;
+
+CREATE INDEX IF NOT EXISTS idx_notes_templates ON public.notes(user_id) WHERE is_template;
@@ -0,0 +1,12 @@
+-- Migration 13: Add links between notes
+-- This script is idempotent and safe to run multiple times
+
+-- Links found in note bodies, rebuilt whenever a body is saved. Targets have
+-- no foreign key so a link can be saved before the note it points to.
+CREATE TABLE IF NOT EXISTS public.note_links (
+    source_id uuid NOT NULL REFERENCES public.notes(id) ON DELETE CASCADE,
+    target_id uuid NOT NULL,
+    PRIMARY KEY (source_id, target_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_note_links_target ON public.note_links(target_id);
@@ -0,0 +1,93 @@
+-- Migration 14: Add a change feed for notes
+-- This script is idempotent and safe to run multiple times
+
+-- One row per change to a note. Changes are read in (txid, seq) order and
+-- only once every older transaction has finished, so a reader never skips a
+-- change committed late. note_id has no foreign key so tombstones outlive
+-- purged notes.
+CREATE TABLE IF NOT EXISTS public.note_changes (
+    seq bigserial PRIMARY KEY,
+    txid xid8 NOT NULL DEFAULT pg_current_xact_id(),
+    note_id uuid NOT NULL,
+    user_id uuid NOT NULL,
+    kind text NOT NULL CHECK (kind IN ('created', 'updated', 'moved', 'deleted')),
+    version bigint NULL,
+    changed_at timestamp without time zone NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_note_changes_user_position ON public.note_changes(user_id, txid, seq);
+CREATE INDEX IF NOT EXISTS idx_note_changes_changed_at ON public.note_changes(changed_at);
+
+-- The newest change pruned, cursors before it have expired
+CREATE TABLE IF NOT EXISTS public.note_change_horizon (
+    id boolean PRIMARY KEY DEFAULT true CHECK (id),
+    txid xid8 NOT NULL,
+    seq bigint NOT NULL
+);
+
+-- Moving a subtree to or from the trash is recorded for every note in it, so
+-- clients need not know which notes were below it. Changes to notes inside
+-- the trash are not recorded.
+CREATE OR REPLACE FUNCTION public.record_note_change()
+RETURNS trigger
+LANGUAGE plpgsql
+AS $$
+BEGIN
+    IF TG_OP = 'INSERT' THEN
+        INSERT INTO public.note_changes (note_id, user_id, kind, version)
+        VALUES (NEW.id, NEW.user_id, 'created', NEW.version);
+    ELSIF TG_OP = 'DELETE' THEN
+        -- Trashed notes were recorded as deleted when they were trashed.
+        -- Purged descendants may be recorded twice, which is harmless.
+        IF OLD.deleted_at IS NULL THEN
+            INSERT INTO public.note_changes (note_id, user_id, kind, version)
+            VALUES (OLD.id, OLD.user_id, 'deleted', OLD.version);
+        END IF;
+    ELSIF OLD.deleted_at IS NULL AND NEW.deleted_at IS NOT NULL THEN
+        INSERT INTO public.note_changes (note_id, user_id, kind, version)
+        WITH RECURSIVE subtree AS (
+            SELECT NEW.id AS id
+            UNION ALL
+            SELECT n.id FROM public.notes n
+            INNER JOIN subtree s ON n.parent = s.id
+            WHERE n.deleted_at IS NULL
+        )
+        SELECT n.id, NEW.user_id, 'deleted', n.version
+        FROM subtree s INNER JOIN public.notes n ON n.id = s.id;
+    ELSIF OLD.deleted_at IS NOT NULL AND NEW.deleted_at IS NULL THEN
+        INSERT INTO public.note_changes (note_id, user_id, kind, version)
+        WITH RECURSIVE subtree AS (
+            SELECT NEW.id AS id
+            UNION ALL
+            SELECT n.id FROM public.notes n
+            INNER JOIN subtree s ON n.parent = s.id
+            WHERE n.deleted_at IS NULL
+        )
+        SELECT n.id, NEW.user_id, 'created', n.version
+        FROM subtree s INNER JOIN public.notes n ON n.id = s.id;
+    ELSIF NEW.deleted_at IS NOT NULL OR NEW.id IN (SELECT public.trashed_note_ids(NEW.user_id)) THEN
+        NULL;
+    ELSIF NEW.parent IS DISTINCT FROM OLD.parent OR NEW.position IS DISTINCT FROM OLD.position THEN
+        INSERT INTO public.note_changes (note_id, user_id, kind, version)
+        VALUES (NEW.id, NEW.user_id, 'moved', NEW.version);
+    ELSE
+        INSERT INTO public.note_changes (note_id, user_id, kind, version)
+        VALUES (NEW.id, NEW.user_id, 'updated', NEW.version);
+    END IF;
+    RETURN NULL;
+END;
+$$;
+
+DROP TRIGGER IF EXISTS notes_record_change ON public.notes;
+CREATE TRIGGER notes_record_change
+AFTER INSERT OR DELETE ON public.notes
+FOR EACH ROW
+EXECUTE FUNCTION public.record_note_change();
+
+-- Updates that change nothing are not recorded
+DROP TRIGGER IF EXISTS notes_record_update ON public.notes;
+CREATE TRIGGER notes_record_update
+AFTER UPDATE ON public.notes
+FOR EACH ROW
+WHEN (OLD.* IS DISTINCT FROM NEW.*)
+EXECUTE FUNCTION public.record_note_change();
@@ -0,0 +1,27 @@
+-- Migration 15: Add devices and mutation receipts for note sync
+-- This script is idempotent and safe to run multiple times
+
+CREATE TABLE IF NOT EXISTS public.sync_devices (
+    id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id uuid NOT NULL,
+    name text NOT NULL,
+    platform text NOT NULL DEFAULT '',
+    -- The last change feed cursor the device acknowledged
+    cursor text NOT NULL DEFAULT '',
+    created_at timestamp without time zone NOT NULL DEFAULT now(),
+    last_seen_at timestamp without time zone NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_sync_devices_user ON public.sync_devices(user_id);
+
+-- The result of every mutation a device pushed, so a push retried after a
+-- lost response is not applied twice
+CREATE TABLE IF NOT EXISTS public.sync_mutations (
+    device_id uuid NOT NULL REFERENCES public.sync_devices(id) ON DELETE CASCADE,
+    mutation_id text NOT NULL,
+    result jsonb NOT NULL,
+    created_at timestamp without time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (device_id, mutation_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_sync_mutations_created_at ON public.sync_mutations(created_at);
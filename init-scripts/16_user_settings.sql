@@ -0,0 +1,46 @@
+-- Migration 16: Add versioned user settings with history
+-- This script is idempotent and safe to run multiple times
+
+-- One row per setting, version increases on every change to it
+CREATE TABLE IF NOT EXISTS public.user_settings (
+    user_id uuid NOT NULL,
+    key text NOT NULL,
+    value jsonb NOT NULL,
+    version bigint NOT NULL DEFAULT 1,
+    updated_at timestamp without time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (user_id, key)
+);
+
+-- Every value a setting has had, a NULL value marks its removal
+CREATE TABLE IF NOT EXISTS public.user_settings_history (
+    id bigserial PRIMARY KEY,
+    user_id uuid NOT NULL,
+    key text NOT NULL,
+    value jsonb,
+    version bigint NOT NULL,
+    changed_at timestamp without time zone NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_user_settings_history_key ON public.user_settings_history(user_id, key, id);
+
+-- Copy the top-level keys of the old sync state into settings. The state may
+-- be wrapped in the client's persisted {"state": ..., "version": ...} form.
+DO $$
+BEGIN
+    IF EXISTS (
+        SELECT 1 FROM information_schema.columns
+        WHERE table_schema = 'public' AND table_name = 'sync' AND column_name = 'state' AND data_type = 'jsonb'
+    ) THEN
+        WITH imported AS (
+            INSERT INTO public.user_settings (user_id, key, value)
+            SELECT s.user_id, e.key, e.value
+            FROM public.sync s,
+                jsonb_each(CASE WHEN jsonb_typeof(s.state->'state') = 'object' THEN s.state->'state' ELSE s.state END) AS e(key, value)
+            WHERE s.user_id IS NOT NULL AND jsonb_typeof(s.state) = 'object'
+            ON CONFLICT (user_id, key) DO NOTHING
+            RETURNING user_id, key, value, version
+        )
+        INSERT INTO public.user_settings_history (user_id, key, value, version)
+        SELECT user_id, key, value, version FROM imported;
+    END IF;
+END $$;
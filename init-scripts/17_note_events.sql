@@ -0,0 +1,27 @@
+-- Migration 17: Publish note changes for real-time events
+-- This script is idempotent and safe to run multiple times
+
+-- Every recorded change is sent on the note_events channel when its
+-- transaction commits, so every server replica can pass it on to the
+-- user's open event streams
+CREATE OR REPLACE FUNCTION public.notify_note_change()
+RETURNS trigger
+LANGUAGE plpgsql
+AS $$
+BEGIN
+    PERFORM pg_notify('note_events', json_build_object(
+        'user_id', NEW.user_id,
+        'note_id', NEW.note_id,
+        'kind', NEW.kind,
+        'version', NEW.version,
+        'seq', NEW.seq
+    )::text);
+    RETURN NULL;
+END;
+$$;
+
+DROP TRIGGER IF EXISTS note_changes_notify ON public.note_changes;
+CREATE TRIGGER note_changes_notify
+AFTER INSERT ON public.note_changes
+FOR EACH ROW
+EXECUTE FUNCTION public.notify_note_change();
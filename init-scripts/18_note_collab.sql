@@ -0,0 +1,22 @@
+-- Migration 18: Add shared editing state for collaborative editing
+-- This script is idempotent and safe to run multiple times
+
+-- The Yjs updates of a note being edited together, in the order received.
+-- Replaying them rebuilds the shared document. Saving a snapshot replaces
+-- the updates it was checked against with its full state.
+CREATE TABLE IF NOT EXISTS public.note_collab_updates (
+    id bigserial PRIMARY KEY,
+    note_id uuid NOT NULL REFERENCES public.notes(id) ON DELETE CASCADE,
+    data bytea NOT NULL,
+    created_at timestamp without time zone NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_note_collab_updates_note ON public.note_collab_updates(note_id, id);
+
+-- The note version the shared document was last saved as. A note saved
+-- another way since has a newer version, and its updates are discarded so
+-- editing starts again from the saved body.
+CREATE TABLE IF NOT EXISTS public.note_collab_state (
+    note_id uuid PRIMARY KEY REFERENCES public.notes(id) ON DELETE CASCADE,
+    version bigint NOT NULL
+);
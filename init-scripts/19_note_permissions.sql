@@ -0,0 +1,42 @@
+-- Migration 19: Add per-user note permissions
+-- This script is idempotent and safe to run multiple times
+
+-- A role on a note granted to a user. A grant also covers the note's subtree.
+-- Grants name an existing account, never an unverified email address.
+CREATE TABLE IF NOT EXISTS public.note_permissions (
+    id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    note_id uuid NOT NULL REFERENCES public.notes(id) ON DELETE CASCADE,
+    user_id uuid NOT NULL REFERENCES public.users(id) ON DELETE CASCADE,
+    role text NOT NULL CHECK (role IN ('viewer', 'commenter', 'editor')),
+    granted_by uuid NOT NULL,
+    created_at timestamp without time zone NOT NULL DEFAULT now()
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_note_permissions_user ON public.note_permissions(note_id, user_id);
+CREATE INDEX IF NOT EXISTS idx_note_permissions_member ON public.note_permissions(user_id);
+
+-- The role of a user on a note: owner for its owner, otherwise the highest
+-- role granted to them on the note or an ancestor, or NULL without access
+CREATE OR REPLACE FUNCTION public.note_role(note uuid, member uuid)
+RETURNS text
+LANGUAGE sql
+STABLE
+AS $$
+    WITH RECURSIVE ancestors AS (
+        SELECT id, parent, user_id, 1 AS depth FROM public.notes WHERE id = note
+        UNION ALL
+        SELECT n.id, n.parent, n.user_id, a.depth + 1 FROM public.notes n
+        INNER JOIN ancestors a ON n.id = a.parent
+        WHERE a.depth < 1000
+    )
+    SELECT CASE
+        WHEN EXISTS (SELECT 1 FROM ancestors WHERE depth = 1 AND user_id = member) THEN 'owner'
+        ELSE (
+            SELECT p.role FROM public.note_permissions p
+            INNER JOIN ancestors a ON a.id = p.note_id
+            WHERE p.user_id = member
+            ORDER BY CASE p.role WHEN 'editor' THEN 3 WHEN 'commenter' THEN 2 ELSE 1 END DESC
+            LIMIT 1
+        )
+    END
+$$;
@@ -0,0 +1,35 @@
+-- Migration 20: Add revocable share links
+-- This script is idempotent and safe to run multiple times
+
+-- A link that lets anyone with its token read a note, and optionally its
+-- subtree, at /s/:token. Links end when revoked, past expires_at or once
+-- max_views readers have been counted. Wrong passwords are counted in
+-- password_attempts and lock the link until locked_until.
+CREATE TABLE IF NOT EXISTS public.share_links (
+    id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    token text NOT NULL UNIQUE,
+    note_id uuid NOT NULL REFERENCES public.notes(id) ON DELETE CASCADE,
+    user_id uuid NOT NULL,
+    password_hash text,
+    expires_at timestamp with time zone,
+    max_views integer CHECK (max_views > 0),
+    views integer NOT NULL DEFAULT 0,
+    include_descendants boolean NOT NULL DEFAULT false,
+    password_attempts integer NOT NULL DEFAULT 0,
+    locked_until timestamp with time zone,
+    created_at timestamp without time zone NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_share_links_note ON public.share_links(note_id);
+
+-- Readers whose view of a link was counted, after they gave its password
+-- when it has one. Each reader keeps its own random token in a cookie and
+-- only the token's hash is stored.
+CREATE TABLE IF NOT EXISTS public.share_link_readers (
+    token_hash text PRIMARY KEY,
+    link_id uuid NOT NULL REFERENCES public.share_links(id) ON DELETE CASCADE,
+    expires_at timestamp with time zone NOT NULL,
+    created_at timestamp with time zone NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_share_link_readers_link ON public.share_link_readers(link_id);
@@ -1,12 +1,15 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"net/http"
 	"os"
+	"strings"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
@@ -184,6 +187,28 @@ const documentTemplate = `
             background-color: #f8f9fa;
             font-weight: 600;
         }
+        .password-form input {
+            padding: 0.5rem;
+            border: 1px solid #e1e5e9;
+            border-radius: 4px;
+            font-size: 1rem;
+        }
+        .password-form button {
+            padding: 0.5rem 1rem;
+            background: #007bff;
+            color: white;
+            border: none;
+            border-radius: 4px;
+            font-size: 1rem;
+            cursor: pointer;
+        }
+        .password-error {
+            color: #c0392b;
+        }
+        .child-pages {
+            border-top: 1px solid #e1e5e9;
+            margin-top: 2rem;
+        }
         @media (max-width: 768px) {
             body {
                 padding: 1rem;
@@ -205,12 +230,14 @@ const documentTemplate = `
         <div class="header">
             <a href="/" class="back-button">← Back to ModelPad</a>
             <h1 class="document-title">{{.Title}}</h1>
+            {{if .CreatedAt}}
             <div class="document-meta">
                 Created: {{.CreatedAt.Format "January 2, 2006 at 3:04 PM"}}
                 {{if ne .CreatedAt .UpdatedAt}}
                 • Updated: {{.UpdatedAt.Format "January 2, 2006 at 3:04 PM"}}
                 {{end}}
             </div>
+            {{end}}
         </div>
         <div class="document-content">
             {{.Content}}
@@ -237,7 +264,7 @@ func ViewDocument(c *gin.Context) {
 	db := c.MustGet("db").(*pgxpool.Pool)
 	var note notes.Note
 	var tagsJSON []byte
-	err = db.QueryRow(context.Background(), "SELECT id, title, body, user_id, parent, created_at, updated_at, COALESCE(tags, '[]'::jsonb) as tags FROM notes WHERE id = $1 AND is_shared = true", noteUUID).Scan(&note.ID, &note.Title, &note.Body, &note.UserId, &note.Parent, &note.CreatedAt, &note.UpdatedAt, &tagsJSON)
+	err = db.QueryRow(context.Background(), "SELECT id, title, body, user_id, parent, created_at, updated_at, COALESCE(tags, '[]'::jsonb) as tags FROM notes WHERE id = $1 AND is_shared = true AND id NOT IN (SELECT trashed_note_ids(user_id))", noteUUID).Scan(&note.ID, &note.Title, &note.Body, &note.UserId, &note.Parent, &note.CreatedAt, &note.UpdatedAt, &tagsJSON)
 	if err != nil {
 		c.HTML(http.StatusNotFound, "", gin.H{
 			"error": "Document not found",
@@ -253,8 +280,16 @@ func ViewDocument(c *gin.Context) {
 		return
 	}
 
-	// Convert JSON body to markdown
-	markdownContent, err := markdown.ConvertJSONToMarkdown(note.Body)
+	// Links to other shared documents stay links, others become plain text
+	noteURLs, err := notes.SharedNoteURLs(db, note.Body)
+	if err != nil {
+		c.HTML(http.StatusInternalServerError, "", gin.H{
+			"error": "Error resolving links",
+		})
+		return
+	}
+
+	content, err := documentHTML(note.Body, noteURLs)
 	if err != nil {
 		c.HTML(http.StatusInternalServerError, "", gin.H{
 			"error": "Error converting document",
@@ -262,9 +297,31 @@ func ViewDocument(c *gin.Context) {
 		return
 	}
 
+	renderDocument(c, http.StatusOK, gin.H{
+		"Title":     note.Title,
+		"Content":   content,
+		"CreatedAt": note.CreatedAt,
+		"UpdatedAt": note.UpdatedAt,
+	})
+}
+
+// documentHTML converts a note body to HTML. Links to notes with a URL in
+// noteURLs stay links, others become plain text.
+func documentHTML(body string, noteURLs map[string]string) (template.HTML, error) {
+	// Convert JSON body to markdown
+	markdownContent, err := markdown.ConvertJSONToMarkdownWithLinks(body, func(noteID string) string {
+		return noteURLs[noteID]
+	})
+	if err != nil {
+		return "", err
+	}
+
 	// Convert markdown to HTML
-	htmlContent := blackfriday.Run([]byte(markdownContent))
+	return template.HTML(blackfriday.Run([]byte(markdownContent))), nil
+}
 
+// renderDocument renders a page through the document template
+func renderDocument(c *gin.Context, status int, page gin.H) {
 	// Parse and execute template
 	tmpl, err := template.New("document").Parse(documentTemplate)
 	if err != nil {
@@ -276,12 +333,8 @@ func ViewDocument(c *gin.Context) {
 
 	// Render the template
 	c.Header("Content-Type", "text/html; charset=utf-8")
-	err = tmpl.Execute(c.Writer, gin.H{
-		"Title":     note.Title,
-		"Content":   template.HTML(htmlContent),
-		"CreatedAt": note.CreatedAt,
-		"UpdatedAt": note.UpdatedAt,
-	})
+	c.Status(status)
+	err = tmpl.Execute(c.Writer, page)
 	if err != nil {
 		c.HTML(http.StatusInternalServerError, "", gin.H{
 			"error": "Error rendering document",
@@ -289,61 +342,149 @@ func ViewDocument(c *gin.Context) {
 	}
 }
 
-// ShareNote toggles the is_shared status of a note
-func ShareNote(c *gin.Context) {
-	userID := c.GetString("user_id")
-	noteID := c.Param("id")
+// passwordTemplate asks for the password of a share link, rendered as the
+// content of a document page
+var passwordTemplate = template.Must(template.New("password").Parse(`
+<form method="post" class="password-form">
+    <p>This document is protected by a password.</p>
+    {{with .Error}}<p class="password-error">{{.}}</p>{{end}}
+    <input type="password" name="password" placeholder="Password" autofocus required>
+    <button type="submit">View document</button>
+</form>
+`))
+
+// shareLinkError responds to an error of opening or viewing a share link
+func shareLinkError(c *gin.Context, err error) {
+	status, message := http.StatusInternalServerError, "Error loading document"
+	switch {
+	case errors.Is(err, notes.ErrShareLinkNotFound):
+		status, message = http.StatusNotFound, err.Error()
+	case errors.Is(err, notes.ErrShareLinkExpired):
+		status, message = http.StatusGone, err.Error()
+	}
+	c.HTML(status, "", gin.H{
+		"error": message,
+	})
+}
 
-	// Parse the note ID
-	noteUUID, err := uuid.FromString(noteID)
+// shareReaderCookie keeps the token of a counted share link reader, scoped
+// to the link's path
+const shareReaderCookie = "share_reader"
+
+// ViewShareLink renders the note of a share link, or with the note parameter
+// one of its descendants when the link includes them. Links with a password
+// ask for it first. Each reader counts as one view, when they first open the
+// link or give its password, and is then remembered by a cookie.
+func ViewShareLink(c *gin.Context) {
+	db := c.MustGet("db").(*pgxpool.Pool)
+
+	link, note, err := notes.OpenShareLink(db, c.Param("token"), c.Param("note"))
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error": "Invalid document ID",
-		})
+		shareLinkError(c, err)
 		return
 	}
 
-	// Get the request body to see what sharing status to set
-	var requestBody struct {
-		IsShared bool `json:"is_shared"`
-	}
-	if err := c.ShouldBindJSON(&requestBody); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error": "Invalid request body",
-		})
+	reader, _ := c.Cookie(shareReaderCookie)
+	counted, err := notes.IsShareReader(db, link, reader)
+	if err != nil {
+		shareLinkError(c, err)
 		return
 	}
+	if !counted {
+		if !link.Active {
+			shareLinkError(c, notes.ErrShareLinkExpired)
+			return
+		}
 
-	// Update the note's sharing status - only if it belongs to the user
-	db := c.MustGet("db").(*pgxpool.Pool)
-	result, err := db.Exec(context.Background(),
-		"UPDATE notes SET is_shared = $1, updated_at = now() WHERE id = $2 AND user_id = $3",
-		requestBody.IsShared, noteUUID, userID)
+		if link.HasPassword {
+			posted := c.Request.Method == http.MethodPost
+			var err error
+			if posted {
+				err = notes.UnlockShareLink(db, link, c.PostForm("password"))
+			}
+			if !posted || err != nil {
+				status, message := http.StatusUnauthorized, ""
+				switch {
+				case errors.Is(err, notes.ErrSharePassword):
+					message = err.Error()
+				case errors.Is(err, notes.ErrShareLinkLocked):
+					status, message = http.StatusTooManyRequests, err.Error()
+				case err != nil:
+					shareLinkError(c, err)
+					return
+				}
+
+				var form bytes.Buffer
+				if err := passwordTemplate.Execute(&form, gin.H{"Error": message}); err != nil {
+					c.HTML(http.StatusInternalServerError, "", gin.H{
+						"error": "Template error",
+					})
+					return
+				}
+				renderDocument(c, status, gin.H{
+					"Title":   "Password required",
+					"Content": template.HTML(form.String()),
+				})
+				return
+			}
+		}
 
+		token, err := notes.AddShareReader(db, link)
+		if err != nil {
+			shareLinkError(c, err)
+			return
+		}
+		secure := os.Getenv("ENV") == "production"
+		c.SetCookie(shareReaderCookie, token, 24*60*60, link.URL, "", secure, true)
+	}
+
+	noteURLs, err := notes.ShareLinkURLs(db, link, note.Body)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "Failed to update note sharing status",
+		c.HTML(http.StatusInternalServerError, "", gin.H{
+			"error": "Error resolving links",
 		})
 		return
 	}
 
-	// Check if any rows were affected (i.e., note exists and belongs to user)
-	if result.RowsAffected() == 0 {
-		c.JSON(http.StatusNotFound, gin.H{
-			"error": "Note not found or you don't have permission to share it",
+	content, err := documentHTML(note.Body, noteURLs)
+	if err != nil {
+		c.HTML(http.StatusInternalServerError, "", gin.H{
+			"error": "Error converting document",
 		})
 		return
 	}
 
-	// Return success response
-	c.JSON(http.StatusOK, gin.H{
-		"message":   "Note sharing status updated successfully",
-		"is_shared": requestBody.IsShared,
+	// The pages below the note can be read through the link too
+	if link.IncludeDescendants {
+		children, err := notes.ShareLinkChildren(db, link, note.ID)
+		if err != nil {
+			c.HTML(http.StatusInternalServerError, "", gin.H{
+				"error": "Error loading pages",
+			})
+			return
+		}
+		if len(children) > 0 {
+			var list strings.Builder
+			list.WriteString(`<nav class="child-pages"><h2>Pages</h2><ul>`)
+			for _, child := range children {
+				fmt.Fprintf(&list, `<li><a href="%s/%s">%s</a></li>`,
+					template.HTMLEscapeString(link.URL), child.ID, template.HTMLEscapeString(child.Title))
+			}
+			list.WriteString("</ul></nav>")
+			content += template.HTML(list.String())
+		}
+	}
+
+	renderDocument(c, http.StatusOK, gin.H{
+		"Title":     note.Title,
+		"Content":   content,
+		"CreatedAt": note.CreatedAt,
+		"UpdatedAt": note.UpdatedAt,
 	})
 }
 
-// UpdateNoteParent updates the parent relationship of a note
-func UpdateNoteParent(c *gin.Context) {
+// ShareNote toggles the is_shared status of a note
+func ShareNote(c *gin.Context) {
 	userID := c.GetString("user_id")
 	noteID := c.Param("id")
 
@@ -351,14 +492,14 @@ func UpdateNoteParent(c *gin.Context) {
 	noteUUID, err := uuid.FromString(noteID)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
-			"error": "Invalid note ID",
+			"error": "Invalid document ID",
 		})
 		return
 	}
 
-	// Get the request body to see what parent to set
+	// Get the request body to see what sharing status to set
 	var requestBody struct {
-		Parent *string `json:"parent"`
+		IsShared bool `json:"is_shared"`
 	}
 	if err := c.ShouldBindJSON(&requestBody); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
@@ -367,71 +508,18 @@ func UpdateNoteParent(c *gin.Context) {
 		return
 	}
 
+	// Update the note's sharing status - only if it belongs to the user
 	db := c.MustGet("db").(*pgxpool.Pool)
-
-	// Parse parent UUID if provided
-	var parentUUID *uuid.UUID
-	if requestBody.Parent != nil && *requestBody.Parent != "" {
-		parsedParent, err := uuid.FromString(*requestBody.Parent)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"error": "Invalid parent ID",
-			})
-			return
-		}
-		parentUUID = &parsedParent
-
-		// Verify parent note exists and belongs to the same user
-		var parentExists bool
-		err = db.QueryRow(context.Background(),
-			"SELECT EXISTS(SELECT 1 FROM notes WHERE id = $1 AND user_id = $2)",
-			parentUUID, userID).Scan(&parentExists)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"error": "Failed to verify parent note",
-			})
-			return
-		}
-		if !parentExists {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"error": "Parent note not found or you don't have permission to access it",
-			})
-			return
-		}
-
-		// Check for circular reference (prevent setting parent to a descendant)
-		var wouldCreateCycle bool
-		err = db.QueryRow(context.Background(), `
-			WITH RECURSIVE note_hierarchy AS (
-				SELECT id, parent FROM notes WHERE id = $1
-				UNION ALL
-				SELECT n.id, n.parent FROM notes n
-				INNER JOIN note_hierarchy nh ON n.parent = nh.id
-			)
-			SELECT EXISTS(SELECT 1 FROM note_hierarchy WHERE id = $2)
-		`, noteUUID, parentUUID).Scan(&wouldCreateCycle)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"error": "Failed to check for circular reference",
-			})
-			return
-		}
-		if wouldCreateCycle {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"error": "Cannot set parent: would create circular reference",
-			})
-			return
-		}
+	if _, ok := notes.AuthorizeNote(c, db, noteID, notes.RoleOwner); !ok {
+		return
 	}
-
-	// Update the note's parent - only if it belongs to the user
 	result, err := db.Exec(context.Background(),
-		"UPDATE notes SET parent = $1, updated_at = now() WHERE id = $2 AND user_id = $3",
-		parentUUID, noteUUID, userID)
+		"UPDATE notes SET is_shared = $1, updated_at = now(), version = version + 1 WHERE id = $2 AND user_id = $3",
+		requestBody.IsShared, noteUUID, userID)
 
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "Failed to update note parent",
+			"error": "Failed to update note sharing status",
 		})
 		return
 	}
@@ -439,15 +527,15 @@ func UpdateNoteParent(c *gin.Context) {
 	// Check if any rows were affected (i.e., note exists and belongs to user)
 	if result.RowsAffected() == 0 {
 		c.JSON(http.StatusNotFound, gin.H{
-			"error": "Note not found or you don't have permission to modify it",
+			"error": "Note not found or you don't have permission to share it",
 		})
 		return
 	}
 
 	// Return success response
 	c.JSON(http.StatusOK, gin.H{
-		"message": "Note parent updated successfully",
-		"parent":  requestBody.Parent,
+		"message":   "Note sharing status updated successfully",
+		"is_shared": requestBody.IsShared,
 	})
 }
 
@@ -463,6 +551,30 @@ func main() {
 	}
 	defer dbpool.Close()
 
+	if err := notes.LoadDistanceMetric(); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid VECTOR_DISTANCE_METRIC: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Build the vector index for the configured distance metric in the background
+	go func() {
+		if err := notes.EnsureVectorIndex(context.Background(), dbpool); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to create vector index: %v\n", err)
+		}
+	}()
+
+	// Thin out and compress old revisions according to the retention policy
+	go notes.StartRevisionCompactor(context.Background(), dbpool)
+
+	// Permanently delete notes that have been in the trash too long
+	go notes.StartTrashPurger(context.Background(), dbpool)
+
+	// Forget note changes that clients have had time to sync
+	go notes.StartChangePruner(context.Background(), dbpool)
+
+	// Pass note changes from every replica on to open event streams
+	go notes.StartEventListener(context.Background(), dbpool)
+
 	//Adding postgres connection to the context
 	r.Use(func(c *gin.Context) {
 		c.Set("db", dbpool)
@@ -470,10 +582,12 @@ func main() {
 	})
 
 	// Adding the CORS middleware
+	allowedOrigins := []string{"https://modelpad.app", "http://localhost:5173", "http://localhost:5174"}
 	r.Use(cors.New(cors.Config{
-		AllowOrigins:     []string{"https://modelpad.app", "http://localhost:5173", "http://localhost:5174"},
+		AllowOrigins:     allowedOrigins,
 		AllowMethods:     []string{"GET", "POST", "DELETE", "PUT", "PATCH", "OPTIONS"},
-		AllowHeaders:     []string{"content-type"},
+		AllowHeaders:     []string{"content-type", "if-match", "if-none-match"},
+		ExposeHeaders:    []string{"etag"},
 		AllowCredentials: true,
 	}))
 
@@ -497,17 +611,82 @@ func main() {
 	r.GET("/api/notes", auth.AuthRequired(), notes.ListNotes)
 	r.PUT("/api/notes/:id", auth.AuthRequired(), notes.UpsertNote)
 	r.DELETE("/api/notes/:id", auth.AuthRequired(), notes.DeleteNote)
+	r.GET("/api/notes/tree", auth.AuthRequired(), notes.GetNoteTree)
+	r.GET("/api/notes/changes", auth.AuthRequired(), notes.GetChanges)
+	r.GET("/api/notes/shared", auth.AuthRequired(), notes.ListSharedNotes)
+	r.GET("/api/events", auth.AuthRequired(), notes.StreamEvents)
+	r.POST("/api/notes/batch", auth.AuthRequired(), notes.BatchNotes)
+	r.POST("/api/notes/from-template/:id", auth.AuthRequired(), notes.InstantiateTemplate)
 	r.GET("/api/notes/:id", auth.AuthRequired(), notes.GetNote)
+	r.GET("/api/notes/:id/ancestors", auth.AuthRequired(), notes.GetNoteAncestors)
+	r.POST("/api/notes/:id/duplicate", auth.AuthRequired(), notes.DuplicateNote)
 	r.GET("/api/notes/:id/children", auth.AuthRequired(), notes.GetNoteChildren)
+	r.GET("/api/notes/:id/related", auth.AuthRequired(), notes.GetRelatedNotes)
+	r.GET("/api/notes/:id/backlinks", auth.AuthRequired(), notes.GetBacklinks)
+	r.GET("/api/notes/:id/mentions", auth.AuthRequired(), notes.GetUnlinkedMentions)
+	r.GET("/api/notes/:id/collab", auth.AuthRequired(), notes.CollaborateNote(allowedOrigins))
+	r.GET("/api/notes/:id/presence", auth.AuthRequired(), notes.GetPresence)
+	r.GET("/api/notes/:id/revisions", auth.AuthRequired(), notes.ListRevisions)
+	r.GET("/api/notes/:id/revisions/:rev", auth.AuthRequired(), notes.GetRevision)
+	r.GET("/api/notes/:id/revisions/:rev/diff", auth.AuthRequired(), notes.DiffRevision)
+	r.POST("/api/notes/:id/revisions/:rev/restore", auth.AuthRequired(), notes.RestoreRevision)
+	r.GET("/api/notes/:id/snapshots", auth.AuthRequired(), notes.ListSnapshots)
+	r.POST("/api/notes/:id/snapshots", auth.AuthRequired(), notes.CreateSnapshot)
+	r.DELETE("/api/notes/:id/snapshots/:rev", auth.AuthRequired(), notes.DeleteSnapshot)
+	r.GET("/api/notes/:id/branches", auth.AuthRequired(), notes.ListBranches)
+	r.POST("/api/notes/:id/branches", auth.AuthRequired(), notes.CreateBranch)
+	r.DELETE("/api/notes/:id/branches/:branch", auth.AuthRequired(), notes.DeleteBranch)
+	r.GET("/api/notes/:id/branches/:branch/compare", auth.AuthRequired(), notes.CompareBranch)
+	r.POST("/api/notes/:id/branches/:branch/merge", auth.AuthRequired(), notes.MergeBranch)
 	r.PATCH("/api/notes/:id/share", auth.AuthRequired(), ShareNote)
-	r.PATCH("/api/notes/:id/parent", auth.AuthRequired(), UpdateNoteParent)
+	r.GET("/api/notes/:id/permissions", auth.AuthRequired(), notes.ListPermissions)
+	r.POST("/api/notes/:id/permissions", auth.AuthRequired(), notes.GrantPermission)
+	r.DELETE("/api/notes/:id/permissions/:permission", auth.AuthRequired(), notes.RevokePermission)
+	r.GET("/api/notes/:id/share-links", auth.AuthRequired(), notes.ListShareLinks)
+	r.POST("/api/notes/:id/share-links", auth.AuthRequired(), notes.CreateShareLink)
+	r.DELETE("/api/notes/:id/share-links/:link", auth.AuthRequired(), notes.RevokeShareLink)
+	r.PATCH("/api/notes/:id/template", auth.AuthRequired(), notes.SetTemplate)
+	r.POST("/api/notes/:id/move", auth.AuthRequired(), notes.MoveNote)
+	// Parent-only moves, kept for compatibility
+	r.PATCH("/api/notes/:id/parent", auth.AuthRequired(), notes.MoveNote)
+
+	// Trash Endpoints
+	r.GET("/api/trash", auth.AuthRequired(), notes.ListTrash)
+	r.DELETE("/api/trash", auth.AuthRequired(), notes.EmptyTrash)
+	r.POST("/api/trash/:id/restore", auth.AuthRequired(), notes.RestoreNote)
+	r.DELETE("/api/trash/:id", auth.AuthRequired(), notes.PurgeNote)
+
+	// Graph Endpoint
+	r.GET("/api/graph", auth.AuthRequired(), notes.GetGraph)
+
+	// Tag Endpoints
+	r.GET("/api/tags/tree", auth.AuthRequired(), notes.GetTagTree)
+	r.POST("/api/tags/rename", auth.AuthRequired(), notes.RenameTag)
+	r.POST("/api/tags/merge", auth.AuthRequired(), notes.MergeTag)
 
 	// Document viewing endpoint (public, no authentication required)
 	r.GET("/doc/:id", ViewDocument)
+	r.GET("/s/:token", ViewShareLink)
+	r.POST("/s/:token", ViewShareLink)
+	r.GET("/s/:token/:note", ViewShareLink)
+	r.POST("/s/:token/:note", ViewShareLink)
 
 	// Sync Endpoints
 	r.GET("/api/sync/get", auth.AuthRequired(), usersync.GetSync)
 	r.POST("/api/sync/set", auth.AuthRequired(), usersync.SetSync)
+	r.DELETE("/api/sync/delete", auth.AuthRequired(), usersync.DeleteSync)
+	r.GET("/api/sync/devices", auth.AuthRequired(), notes.ListDevices)
+	r.POST("/api/sync/devices", auth.AuthRequired(), notes.RegisterDevice)
+	r.DELETE("/api/sync/devices/:id", auth.AuthRequired(), notes.DeleteDevice)
+	r.POST("/api/sync/push", auth.AuthRequired(), notes.PushMutations)
+	r.GET("/api/sync/pull", auth.AuthRequired(), notes.PullChanges)
+
+	// Settings Endpoints
+	r.GET("/api/settings", auth.AuthRequired(), usersync.GetSettings)
+	r.PATCH("/api/settings", auth.AuthRequired(), usersync.PatchSettings)
+	r.GET("/api/settings/schema", usersync.GetSettingsSchema)
+	r.GET("/api/settings/history", auth.AuthRequired(), usersync.GetSettingsHistory)
+	r.POST("/api/settings/rollback", auth.AuthRequired(), usersync.RollbackSettings)
 
 	// These endpoints match the ollama API
 	r.GET("/api/tags", models.ListModels)
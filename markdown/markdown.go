@@ -17,6 +17,7 @@ type Node struct {
 	TagId    string   `json:"tagId,omitempty"`
 	TagName  string   `json:"tagName,omitempty"`
 	TagPath  []string `json:"tagPath,omitempty"`
+	NoteId   string   `json:"noteId,omitempty"`
 }
 
 type Root struct {
@@ -24,6 +25,13 @@ type Root struct {
 }
 
 func ConvertJSONToMarkdown(jsonInput string) (string, error) {
+	return ConvertJSONToMarkdownWithLinks(jsonInput, nil)
+}
+
+// ConvertJSONToMarkdownWithLinks converts like ConvertJSONToMarkdown, turning
+// note links into markdown links to the URL noteURL returns for the linked
+// note id. Links for which it returns "" are rendered as plain text.
+func ConvertJSONToMarkdownWithLinks(jsonInput string, noteURL func(noteID string) string) (string, error) {
 	var root Root
 	err := json.Unmarshal([]byte(jsonInput), &root)
 	if err != nil {
@@ -32,28 +40,51 @@ func ConvertJSONToMarkdown(jsonInput string) (string, error) {
 	}
 
 	var markdown strings.Builder
-	processNode(&markdown, root.Root, 0)
+	processNode(&markdown, root.Root, 0, noteURL)
 	result := markdown.String()
 	return result, nil
 }
 
-func processNode(sb *strings.Builder, node Node, depth int) {
+// NoteLinks returns the ids of the notes linked from a document, each once
+func NoteLinks(jsonInput string) ([]string, error) {
+	var root Root
+	if err := json.Unmarshal([]byte(jsonInput), &root); err != nil {
+		return nil, err
+	}
+
+	var links []string
+	seen := make(map[string]bool)
+	var walk func(node Node)
+	walk = func(node Node) {
+		if node.Type == "note-link" && node.NoteId != "" && !seen[node.NoteId] {
+			seen[node.NoteId] = true
+			links = append(links, node.NoteId)
+		}
+		for _, child := range node.Children {
+			walk(child)
+		}
+	}
+	walk(root.Root)
+	return links, nil
+}
+
+func processNode(sb *strings.Builder, node Node, depth int, noteURL func(string) string) {
 	switch node.Type {
 	case "root":
-		processChildren(sb, node.Children, depth)
+		processChildren(sb, node.Children, depth, noteURL)
 	case "heading":
 		sb.WriteString(strings.Repeat("#", getHeadingLevel(node.Tag)) + " ")
-		processChildren(sb, node.Children, depth)
+		processChildren(sb, node.Children, depth, noteURL)
 		sb.WriteString("\n\n")
 	case "paragraph":
-		processChildren(sb, node.Children, depth)
+		processChildren(sb, node.Children, depth, noteURL)
 		sb.WriteString("\n\n")
 	case "text":
 		sb.WriteString(node.Text)
 	case "linebreak":
 		sb.WriteString("\n")
 	case "list":
-		processListItems(sb, node, depth)
+		processListItems(sb, node, depth, noteURL)
 		sb.WriteString("\n")
 	case "code":
 		sb.WriteString("```")
@@ -61,11 +92,11 @@ func processNode(sb *strings.Builder, node Node, depth int) {
 			sb.WriteString(node.Language)
 		}
 		sb.WriteString("\n")
-		processChildren(sb, node.Children, depth)
+		processChildren(sb, node.Children, depth, noteURL)
 		sb.WriteString("\n```\n\n")
 	case "quote":
 		sb.WriteString("> ")
-		processChildren(sb, node.Children, depth)
+		processChildren(sb, node.Children, depth, noteURL)
 		sb.WriteString("\n\n")
 	case "tab":
 		sb.WriteString("\t")
@@ -80,26 +111,44 @@ func processNode(sb *strings.Builder, node Node, depth int) {
 		} else {
 			sb.WriteString("@tag")
 		}
+	case "note-link":
+		// Wiki-style links to other notes show their text, linked when the
+		// note has a URL
+		var text strings.Builder
+		if node.Text != "" {
+			text.WriteString(node.Text)
+		} else {
+			processChildren(&text, node.Children, depth, nil)
+		}
+		url := ""
+		if noteURL != nil && node.NoteId != "" {
+			url = noteURL(node.NoteId)
+		}
+		if url != "" {
+			sb.WriteString("[" + text.String() + "](" + url + ")")
+		} else {
+			sb.WriteString(text.String())
+		}
 	default:
 		// Handle unknown node types or log a warning
 		fmt.Printf("Unknown node type: %s\n", node.Type)
 	}
 }
 
-func processChildren(sb *strings.Builder, children []Node, depth int) {
+func processChildren(sb *strings.Builder, children []Node, depth int, noteURL func(string) string) {
 	for _, child := range children {
-		processNode(sb, child, depth+1)
+		processNode(sb, child, depth+1, noteURL)
 	}
 }
 
-func processListItems(sb *strings.Builder, node Node, depth int) {
+func processListItems(sb *strings.Builder, node Node, depth int, noteURL func(string) string) {
 	for i, child := range node.Children {
 		if node.ListType == "bullet" {
 			sb.WriteString("- ")
 		} else if node.ListType == "number" {
 			sb.WriteString(fmt.Sprintf("%d. ", i+1))
 		}
-		processChildren(sb, child.Children, depth+1)
+		processChildren(sb, child.Children, depth+1, noteURL)
 		sb.WriteString("\n")
 	}
 }
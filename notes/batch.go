@@ -0,0 +1,314 @@
+package notes
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/pgvector/pgvector-go"
+	uuid "github.com/satori/go.uuid"
+)
+
+// maxBatchOperations is the largest number of operations in one batch
+const maxBatchOperations = 500
+
+// BatchOperation is one change in a batch. Op is move, delete, add_tag,
+// remove_tag, share, unshare or set_title; the other fields apply to the ops
+// that need them.
+type BatchOperation struct {
+	Op     string   `json:"op"`
+	ID     string   `json:"id"`
+	Parent *string  `json:"parent,omitempty"`
+	After  *string  `json:"after,omitempty"`
+	Before *string  `json:"before,omitempty"`
+	Tag    []string `json:"tag,omitempty"`
+	Title  *string  `json:"title,omitempty"`
+}
+
+// Batch operation result statuses. Operations before a failed one are rolled
+// back and operations after it are skipped.
+const (
+	batchOK         = "ok"
+	batchFailed     = "failed"
+	batchRolledBack = "rolled_back"
+	batchSkipped    = "skipped"
+)
+
+// BatchResult reports the outcome of one operation
+type BatchResult struct {
+	Index        int    `json:"index"`
+	Op           string `json:"op"`
+	ID           string `json:"id"`
+	Status       string `json:"status"`
+	Error        string `json:"error,omitempty"`
+	Position     string `json:"position,omitempty"`
+	DeletedCount int    `json:"deleted_count,omitempty"`
+}
+
+// errInvalidOperation marks a malformed operation
+var errInvalidOperation = errors.New("invalid operation")
+
+// BatchNotes applies a list of operations in one transaction. Either every
+// operation is applied or, when one fails, none is.
+func BatchNotes(c *gin.Context) {
+	userID := c.GetString("user_id")
+
+	var requestBody struct {
+		Operations []BatchOperation `json:"operations"`
+	}
+	if err := c.ShouldBindJSON(&requestBody); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request body"})
+		return
+	}
+	operations := requestBody.Operations
+	if len(operations) == 0 || len(operations) > maxBatchOperations {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("Expected 1 to %d operations", maxBatchOperations)})
+		return
+	}
+
+	db := c.MustGet("db").(*pgxpool.Pool)
+
+	embedded, err := embedTitles(db, userID, operations)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback(context.Background())
+
+	results := make([]BatchResult, len(operations))
+	for i, operation := range operations {
+		results[i] = BatchResult{Index: i, Op: operation.Op, ID: operation.ID, Status: batchSkipped}
+	}
+
+	for i, operation := range operations {
+		err := applyOperation(tx, userID, operation, embedded[i], &results[i])
+		if err == nil {
+			results[i].Status = batchOK
+			continue
+		}
+
+		for j := 0; j < i; j++ {
+			results[j].Status = batchRolledBack
+			results[j].Position, results[j].DeletedCount = "", 0
+		}
+		results[i].Status = batchFailed
+		results[i].Error = err.Error()
+
+		status := operationStatus(err)
+		if errors.Is(err, errInvalidOperation) {
+			status = 400
+		} else if errors.Is(err, errNoteChanged) {
+			status = 409
+		}
+		c.JSON(status, gin.H{
+			"error":   fmt.Sprintf("Operation %d failed, no changes were made", i),
+			"results": results,
+		})
+		return
+	}
+
+	err = tx.Commit(context.Background())
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(200, gin.H{"results": results})
+}
+
+// titleEmbedding is the embedding of a note under a new title, made from the
+// note's markdown
+type titleEmbedding struct {
+	markdown  string
+	embedding *pgvector.Vector
+}
+
+// embedTitles embeds the notes renamed by set_title operations ahead of the
+// batch transaction, keyed by operation index. Operations the user may not
+// apply are left out and fail in the transaction.
+func embedTitles(db dbtx, userID string, operations []BatchOperation) (map[int]titleEmbedding, error) {
+	embedded := make(map[int]titleEmbedding)
+	for i, operation := range operations {
+		if operation.Op != "set_title" || operation.Title == nil {
+			continue
+		}
+		_, err := Authorize(db, operation.ID, userID, RoleEditor)
+		if errors.Is(err, errNoteNotFound) || errors.Is(err, errForbidden) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var markdown string
+		err = db.QueryRow(context.Background(),
+			"SELECT COALESCE(markdown, '') FROM notes WHERE id = $1", operation.ID).Scan(&markdown)
+		if errors.Is(err, pgx.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		embedded[i] = titleEmbedding{markdown: markdown, embedding: embedNote(*operation.Title, markdown)}
+	}
+	return embedded, nil
+}
+
+// applyOperation applies one batch operation within tx. Tags and titles need
+// the editor role, sharing needs the owner.
+func applyOperation(tx pgx.Tx, userID string, operation BatchOperation, embedded titleEmbedding, result *BatchResult) error {
+	noteID, err := uuid.FromString(operation.ID)
+	if err != nil {
+		return fmt.Errorf("%w: invalid note ID", errInvalidOperation)
+	}
+
+	switch operation.Op {
+	case "move":
+		if operation.After != nil && operation.Before != nil {
+			return fmt.Errorf("%w: give either after or before, not both", errInvalidOperation)
+		}
+		parent, err := parseOptionalUUID(operation.Parent)
+		if err != nil {
+			return fmt.Errorf("%w: invalid parent ID", errInvalidOperation)
+		}
+		after, err := parseOptionalUUID(operation.After)
+		if err != nil {
+			return fmt.Errorf("%w: invalid after ID", errInvalidOperation)
+		}
+		before, err := parseOptionalUUID(operation.Before)
+		if err != nil {
+			return fmt.Errorf("%w: invalid before ID", errInvalidOperation)
+		}
+		result.Position, err = moveNote(tx, userID, noteID, parent, after, before)
+		return err
+
+	case "delete":
+		result.DeletedCount, err = trashNote(tx, userID, operation.ID)
+		return err
+
+	case "add_tag", "remove_tag":
+		if len(operation.Tag) == 0 {
+			return fmt.Errorf("%w: tag path is required", errInvalidOperation)
+		}
+		access, err := Authorize(tx, operation.ID, userID, RoleEditor)
+		if err != nil {
+			return err
+		}
+		return updateTags(tx, access.OwnerID, noteID, operation.Tag, operation.Op == "add_tag")
+
+	case "share", "unshare":
+		access, err := Authorize(tx, operation.ID, userID, RoleOwner)
+		if err != nil {
+			return err
+		}
+		return updateNote(tx, access.OwnerID, noteID, "is_shared = $3", operation.Op == "share")
+
+	case "set_title":
+		if operation.Title == nil {
+			return fmt.Errorf("%w: title is required", errInvalidOperation)
+		}
+		access, err := Authorize(tx, operation.ID, userID, RoleEditor)
+		if err != nil {
+			return err
+		}
+		return setTitle(tx, access.OwnerID, noteID, *operation.Title, embedded)
+	}
+	return fmt.Errorf("%w: unknown op %q", errInvalidOperation, operation.Op)
+}
+
+// updateNote applies assignments to a note of ownerID that is not in the
+// trash. Arguments after the note and owner ids start at $3.
+func updateNote(tx pgx.Tx, ownerID string, noteID uuid.UUID, assignments string, args ...interface{}) error {
+	result, err := tx.Exec(context.Background(),
+		"UPDATE notes n SET "+assignments+", updated_at = now(), version = version + 1 WHERE n.id = $1 AND n.user_id = $2 AND "+notTrashed("n", "$2"),
+		append([]interface{}{noteID, ownerID}, args...)...)
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		return errNoteNotFound
+	}
+	return nil
+}
+
+// updateTags adds a tag with the given path to a note of ownerID, or removes
+// tags with that path from it
+func updateTags(tx pgx.Tx, ownerID string, noteID uuid.UUID, path []string, add bool) error {
+	var tagsJSON []byte
+	err := tx.QueryRow(context.Background(),
+		"SELECT COALESCE(n.tags, '[]'::jsonb) FROM notes n WHERE n.id = $1 AND n.user_id = $2 AND "+notTrashed("n", "$2")+" FOR UPDATE",
+		noteID, ownerID).Scan(&tagsJSON)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return errNoteNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	var tags []NoteTag
+	if err := json.Unmarshal(tagsJSON, &tags); err != nil {
+		return err
+	}
+
+	kept := []NoteTag{}
+	found := false
+	for _, tag := range tags {
+		if !equalPath(tag.Path, path) {
+			kept = append(kept, tag)
+		} else if add {
+			kept = append(kept, tag)
+			found = true
+		}
+	}
+	if add && !found {
+		kept = append(kept, NoteTag{ID: uuid.NewV4().String(), Path: path})
+	}
+
+	tagsJSON, err = json.Marshal(kept)
+	if err != nil {
+		return err
+	}
+	return updateNote(tx, ownerID, noteID, "tags = $3", tagsJSON)
+}
+
+func equalPath(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// setTitle renames a note of ownerID with the embedding made for it by
+// embedTitles. It fails with errNoteChanged when the note's markdown changed
+// since.
+func setTitle(tx pgx.Tx, ownerID string, noteID uuid.UUID, title string, embedded titleEmbedding) error {
+	var markdown string
+	err := tx.QueryRow(context.Background(),
+		"SELECT COALESCE(n.markdown, '') FROM notes n WHERE n.id = $1 AND n.user_id = $2 AND "+notTrashed("n", "$2")+" FOR UPDATE",
+		noteID, ownerID).Scan(&markdown)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return errNoteNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if markdown != embedded.markdown {
+		return errNoteChanged
+	}
+	return updateNote(tx, ownerID, noteID, "title = $3, embedding = $4", title, embedded.embedding)
+}
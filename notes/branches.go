@@ -0,0 +1,581 @@
+package notes
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	uuid "github.com/satori/go.uuid"
+	"github.com/stevecastle/modelpad/markdown"
+	"github.com/stevecastle/modelpad/textdiff"
+)
+
+// Branch is an alternate title and body of a note. The note's own body is
+// the main branch.
+type Branch struct {
+	ID        uuid.UUID `json:"id"`
+	NoteID    uuid.UUID `json:"note_id"`
+	Name      string    `json:"name"`
+	Title     string    `json:"title"`
+	Body      string    `json:"body,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	// The note when the branch was created or last merged
+	baseTitle string
+	baseBody  string
+}
+
+// MergeConflict is a part of a note changed differently on the main body and
+// a branch since they diverged. Bodies are shown as markdown.
+type MergeConflict struct {
+	Field  string `json:"field"`
+	Base   string `json:"base"`
+	Main   string `json:"main"`
+	Branch string `json:"branch"`
+}
+
+// Merge preferences for conflicting changes
+const (
+	preferMain   = "main"
+	preferBranch = "branch"
+)
+
+// getBranch loads a branch of a note owned by the user
+func getBranch(db dbtx, noteID string, name string, userID string) (Branch, error) {
+	var branch Branch
+	err := db.QueryRow(context.Background(), `
+		SELECT id, note_id, name, COALESCE(title, ''), COALESCE(body, ''),
+			COALESCE(base_title, ''), COALESCE(base_body, ''), created_at, updated_at
+		FROM note_branches
+		WHERE note_id = $1 AND name = $2 AND user_id = $3`,
+		noteID, name, userID).Scan(&branch.ID, &branch.NoteID, &branch.Name, &branch.Title, &branch.Body,
+		&branch.baseTitle, &branch.baseBody, &branch.CreatedAt, &branch.UpdatedAt)
+	return branch, err
+}
+
+// ListBranches returns the branches of a note without their bodies
+func ListBranches(c *gin.Context) {
+	noteID := c.Param("id")
+	db := c.MustGet("db").(*pgxpool.Pool)
+
+	access, ok := AuthorizeNote(c, db, noteID, RoleViewer)
+	if !ok {
+		return
+	}
+	owner := access.OwnerID
+
+	rows, err := db.Query(context.Background(), `
+		SELECT id, note_id, name, COALESCE(title, ''), created_at, updated_at
+		FROM note_branches
+		WHERE note_id = $1 AND user_id = $2
+		ORDER BY name`, noteID, owner)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	branches := []Branch{}
+	for rows.Next() {
+		var branch Branch
+		if err := rows.Scan(&branch.ID, &branch.NoteID, &branch.Name, &branch.Title, &branch.CreatedAt, &branch.UpdatedAt); err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		branches = append(branches, branch)
+	}
+
+	c.JSON(200, gin.H{"branches": branches})
+}
+
+// CreateBranch starts a branch from the note's current title and body, or
+// from one of its revisions when from_revision is given
+func CreateBranch(c *gin.Context) {
+	noteID := c.Param("id")
+
+	var requestBody struct {
+		Name         string `json:"name"`
+		FromRevision string `json:"from_revision"`
+	}
+	if err := c.ShouldBindJSON(&requestBody); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request body"})
+		return
+	}
+	name, ok := validName(requestBody.Name)
+	if !ok || name == preferMain {
+		c.JSON(400, gin.H{"error": "Branch name must be 1 to 200 characters and not main"})
+		return
+	}
+
+	db := c.MustGet("db").(*pgxpool.Pool)
+
+	access, ok := AuthorizeNote(c, db, noteID, RoleEditor)
+	if !ok {
+		return
+	}
+	owner := access.OwnerID
+
+	var source Revision
+	var err error
+	if requestBody.FromRevision != "" {
+		source, err = getRevision(db, noteID, requestBody.FromRevision, owner)
+		if errors.Is(err, pgx.ErrNoRows) {
+			c.JSON(404, gin.H{"error": "Revision not found"})
+			return
+		}
+	} else {
+		err = db.QueryRow(context.Background(),
+			"SELECT COALESCE(title, ''), COALESCE(body, '') FROM notes WHERE id = $1 AND user_id = $2",
+			noteID, owner).Scan(&source.Title, &source.Body)
+		if errors.Is(err, pgx.ErrNoRows) {
+			c.JSON(404, gin.H{"error": "Note not found or you don't have permission to access it"})
+			return
+		}
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	branch := Branch{Name: name, Title: source.Title}
+	err = db.QueryRow(context.Background(), `
+		INSERT INTO note_branches (note_id, user_id, name, title, body, base_title, base_body)
+		VALUES ($1, $2, $3, $4, $5, $4, $5)
+		ON CONFLICT (note_id, name) DO NOTHING
+		RETURNING id, note_id, created_at, updated_at`,
+		noteID, owner, name, source.Title, source.Body).Scan(&branch.ID, &branch.NoteID, &branch.CreatedAt, &branch.UpdatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.JSON(409, gin.H{"error": "A branch with this name already exists"})
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(201, gin.H{"branch": branch})
+}
+
+// saveBranch stores a note save on a branch instead of the main body. The
+// save is recorded as a revision of the branch.
+func saveBranch(c *gin.Context, db *pgxpool.Pool, note Note, name string) {
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback(context.Background())
+
+	var branchID uuid.UUID
+	err = tx.QueryRow(context.Background(), `
+		UPDATE note_branches SET title = $1, body = $2, updated_at = now()
+		WHERE note_id = $3 AND name = $4 AND user_id = $5
+		RETURNING id`,
+		note.Title, note.Body, note.ID, name, note.UserId).Scan(&branchID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.JSON(404, gin.H{"error": "Branch not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	_, err = tx.Exec(context.Background(),
+		"INSERT INTO revisions (note_id, title, body, user_id, size, branch_id) VALUES ($1, $2, $3, $4, $5, $6)",
+		note.ID, note.Title, note.Body, note.UserId, len(note.Body), branchID)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	err = tx.Commit(context.Background())
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	note.Branch = name
+	c.JSON(200, gin.H{"note": note})
+}
+
+// deleteBranch removes a branch and its revisions
+func deleteBranch(tx pgx.Tx, branchID uuid.UUID) error {
+	_, err := tx.Exec(context.Background(), "DELETE FROM revisions WHERE branch_id = $1", branchID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(context.Background(), "DELETE FROM note_branches WHERE id = $1", branchID)
+	return err
+}
+
+// DeleteBranch removes a branch and its revisions
+func DeleteBranch(c *gin.Context) {
+	db := c.MustGet("db").(*pgxpool.Pool)
+
+	access, ok := AuthorizeNote(c, db, c.Param("id"), RoleEditor)
+	if !ok {
+		return
+	}
+	owner := access.OwnerID
+
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback(context.Background())
+
+	branch, err := getBranch(tx, c.Param("id"), c.Param("branch"), owner)
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.JSON(404, gin.H{"error": "Branch not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := deleteBranch(tx, branch.ID); err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	err = tx.Commit(context.Background())
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(200, gin.H{"message": "Branch deleted"})
+}
+
+// CompareBranch diffs the main body with a branch as markdown and reports
+// which sides changed since they diverged and how many conflicts a merge
+// would have
+func CompareBranch(c *gin.Context) {
+	noteID := c.Param("id")
+	db := c.MustGet("db").(*pgxpool.Pool)
+
+	access, ok := AuthorizeNote(c, db, noteID, RoleViewer)
+	if !ok {
+		return
+	}
+	owner := access.OwnerID
+
+	branch, err := getBranch(db, noteID, c.Param("branch"), owner)
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.JSON(404, gin.H{"error": "Branch not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	var main Revision
+	err = db.QueryRow(context.Background(),
+		"SELECT COALESCE(title, ''), COALESCE(body, '') FROM notes WHERE id = $1 AND user_id = $2",
+		noteID, owner).Scan(&main.Title, &main.Body)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	mainText, err := revisionMarkdown(main)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Error converting note: " + err.Error()})
+		return
+	}
+	branchText, err := revisionMarkdown(Revision{Title: branch.Title, Body: branch.Body})
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Error converting branch: " + err.Error()})
+		return
+	}
+
+	_, _, conflicts, err := mergeNote(branch, main.Title, main.Body, "")
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	edits := textdiff.Lines(textdiff.SplitLines(mainText), textdiff.SplitLines(branchText))
+	added, removed := textdiff.Stats(edits)
+	branch.Body = ""
+
+	c.JSON(200, gin.H{
+		"branch":         branch,
+		"diff":           textdiff.Unified(preferMain, branch.Name, edits, diffContext),
+		"added":          added,
+		"removed":        removed,
+		"main_changed":   main.Title != branch.baseTitle || main.Body != branch.baseBody,
+		"branch_changed": branch.Title != branch.baseTitle || branch.Body != branch.baseBody,
+		"conflicts":      len(conflicts),
+	})
+}
+
+// MergeBranch merges a branch into the note's main body. Changes made on only
+// one side since the branch was created or last merged are combined block by
+// block. Conflicting changes are returned with 409 Conflict unless prefer
+// names the side to take them from, main or branch. The branch is kept for
+// further work unless delete_branch is set.
+func MergeBranch(c *gin.Context) {
+	noteID := c.Param("id")
+
+	var requestBody struct {
+		Prefer       string `json:"prefer"`
+		DeleteBranch bool   `json:"delete_branch"`
+	}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&requestBody); err != nil {
+			c.JSON(400, gin.H{"error": "Invalid request body"})
+			return
+		}
+	}
+	if requestBody.Prefer != "" && requestBody.Prefer != preferMain && requestBody.Prefer != preferBranch {
+		c.JSON(400, gin.H{"error": "Invalid prefer, expected main or branch"})
+		return
+	}
+
+	db := c.MustGet("db").(*pgxpool.Pool)
+
+	access, ok := AuthorizeNote(c, db, noteID, RoleEditor)
+	if !ok {
+		return
+	}
+	owner := access.OwnerID
+
+	branch, err := getBranch(db, noteID, c.Param("branch"), owner)
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.JSON(404, gin.H{"error": "Branch not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	var mainTitle, mainBody string
+	err = db.QueryRow(context.Background(),
+		"SELECT COALESCE(title, ''), COALESCE(body, '') FROM notes WHERE id = $1 AND user_id = $2",
+		noteID, owner).Scan(&mainTitle, &mainBody)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	title, body, conflicts, err := mergeNote(branch, mainTitle, mainBody, requestBody.Prefer)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Error merging branch: " + err.Error()})
+		return
+	}
+	if len(conflicts) > 0 && requestBody.Prefer == "" {
+		c.JSON(409, gin.H{
+			"error":     "Branch conflicts with changes to the note",
+			"conflicts": conflicts,
+		})
+		return
+	}
+
+	bodyMarkdown, newVector, err := renderNote(title, body)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback(context.Background())
+
+	// Only apply the merge if neither side was saved while it was computed
+	result, err := tx.Exec(context.Background(), `
+		UPDATE notes SET title = $1, body = $2, markdown = $3, embedding = $4, updated_at = now(), version = version + 1
+		WHERE id = $5 AND user_id = $6 AND COALESCE(title, '') = $7 AND COALESCE(body, '') = $8
+		AND EXISTS (SELECT 1 FROM note_branches WHERE id = $9 AND updated_at = $10)`,
+		title, body, bodyMarkdown, newVector, noteID, owner, mainTitle, mainBody, branch.ID, branch.UpdatedAt)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	if result.RowsAffected() == 0 {
+		c.JSON(409, gin.H{"error": "The note or branch changed during the merge, try again"})
+		return
+	}
+
+	_, err = tx.Exec(context.Background(),
+		"INSERT INTO revisions (note_id, title, body, user_id, size) VALUES ($1, $2, $3, $4, $5)",
+		noteID, title, body, owner, len(body))
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := saveLinks(tx, branch.NoteID, body); err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	if requestBody.DeleteBranch {
+		err = deleteBranch(tx, branch.ID)
+	} else {
+		// The branch as merged is the common ancestor of the next merge
+		_, err = tx.Exec(context.Background(),
+			"UPDATE note_branches SET base_title = title, base_body = body WHERE id = $1", branch.ID)
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	err = tx.Commit(context.Background())
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"message":   "Branch merged",
+		"title":     title,
+		"body":      body,
+		"conflicts": conflicts,
+	})
+}
+
+// mergeNote three-way merges a branch with the main title and body, using
+// the branch's base as the common ancestor. Conflicts are resolved towards
+// prefer and also returned.
+func mergeNote(branch Branch, mainTitle string, mainBody string, prefer string) (string, string, []MergeConflict, error) {
+	var conflicts []MergeConflict
+
+	title := mainTitle
+	switch {
+	case branch.Title == branch.baseTitle || branch.Title == mainTitle:
+	case mainTitle == branch.baseTitle:
+		title = branch.Title
+	default:
+		conflicts = append(conflicts, MergeConflict{Field: "title", Base: branch.baseTitle, Main: mainTitle, Branch: branch.Title})
+		if prefer == preferBranch {
+			title = branch.Title
+		}
+	}
+
+	baseRoot, baseBlocks, err := lexicalBlocks(branch.baseBody)
+	if err != nil {
+		return "", "", nil, err
+	}
+	mainRoot, mainBlocks, err := lexicalBlocks(mainBody)
+	if err != nil {
+		return "", "", nil, err
+	}
+	branchRoot, branchBlocks, err := lexicalBlocks(branch.Body)
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	chunks := textdiff.Merge3(baseBlocks, mainBlocks, branchBlocks)
+	for _, chunk := range chunks {
+		if chunk.Conflict {
+			conflicts = append(conflicts, MergeConflict{
+				Field:  "body",
+				Base:   blocksMarkdown(chunk.Base),
+				Main:   blocksMarkdown(chunk.Ours),
+				Branch: blocksMarkdown(chunk.Theirs),
+			})
+		}
+	}
+
+	root := mainRoot
+	if root == nil {
+		root = branchRoot
+	}
+	if root == nil {
+		root = baseRoot
+	}
+	body, err := joinLexicalBlocks(root, textdiff.Resolve(chunks, prefer != preferBranch))
+	if err != nil {
+		return "", "", nil, err
+	}
+	return title, body, conflicts, nil
+}
+
+// lexicalBlocks splits a Lexical editor state into its root node and the
+// canonical JSON of each top-level block, the units merged by mergeNote
+func lexicalBlocks(body string) (map[string]json.RawMessage, []string, error) {
+	if strings.TrimSpace(body) == "" {
+		return nil, nil, nil
+	}
+
+	var state struct {
+		Root map[string]json.RawMessage `json:"root"`
+	}
+	if err := json.Unmarshal([]byte(body), &state); err != nil {
+		return nil, nil, err
+	}
+	var children []interface{}
+	if raw, ok := state.Root["children"]; ok {
+		if err := json.Unmarshal(raw, &children); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// Marshalling decoded values sorts object keys, so equal blocks compare
+	// equal however they were formatted
+	blocks := make([]string, len(children))
+	for i, child := range children {
+		block, err := json.Marshal(child)
+		if err != nil {
+			return nil, nil, err
+		}
+		blocks[i] = string(block)
+	}
+	return state.Root, blocks, nil
+}
+
+// joinLexicalBlocks rebuilds a Lexical editor state from a root node and
+// top-level blocks
+func joinLexicalBlocks(root map[string]json.RawMessage, blocks []string) (string, error) {
+	if root == nil {
+		if len(blocks) == 0 {
+			return "", nil
+		}
+		root = map[string]json.RawMessage{"type": json.RawMessage(`"root"`)}
+	}
+
+	children := make([]json.RawMessage, len(blocks))
+	for i, block := range blocks {
+		children[i] = json.RawMessage(block)
+	}
+	merged := make(map[string]json.RawMessage, len(root))
+	for key, value := range root {
+		merged[key] = value
+	}
+	raw, err := json.Marshal(children)
+	if err != nil {
+		return "", err
+	}
+	merged["children"] = raw
+
+	state, err := json.Marshal(map[string]interface{}{"root": merged})
+	return string(state), err
+}
+
+// blocksMarkdown renders top-level Lexical blocks as markdown
+func blocksMarkdown(blocks []string) string {
+	if len(blocks) == 0 {
+		return ""
+	}
+	text, err := markdown.ConvertJSONToMarkdown(`{"root":{"type":"root","children":[` + strings.Join(blocks, ",") + `]}}`)
+	if err != nil {
+		return strings.Join(blocks, "\n")
+	}
+	return strings.TrimSpace(text)
+}
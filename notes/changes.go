@@ -0,0 +1,286 @@
+package notes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	uuid "github.com/satori/go.uuid"
+)
+
+// defaultChangeRetention is how long changes are kept when CHANGE_RETENTION
+// is not set. Clients that have not synced for longer must download their
+// notes again.
+const defaultChangeRetention = 90 * 24 * time.Hour
+
+// changeDeleted is the kind of change recorded for notes deleted or moved to
+// the trash. The others are created, updated and moved.
+const changeDeleted = "deleted"
+
+// NoteChange is the latest change to a note. Note holds the note as it is
+// now, unless it was deleted.
+type NoteChange struct {
+	Seq       int64     `json:"seq"`
+	NoteID    uuid.UUID `json:"note_id"`
+	Kind      string    `json:"kind"`
+	Version   *int64    `json:"version"`
+	ChangedAt time.Time `json:"changed_at"`
+	Note      *Note     `json:"note,omitempty"`
+}
+
+// changeCursor is a position in the change feed, after the change seq of
+// transaction txid. The zero cursor is the start of the feed.
+type changeCursor struct {
+	txid int64
+	seq  int64
+}
+
+// String encodes the cursor for clients, who treat it as opaque
+func (cursor changeCursor) String() string {
+	if cursor == (changeCursor{}) {
+		return ""
+	}
+	return strconv.FormatInt(cursor.txid, 10) + "-" + strconv.FormatInt(cursor.seq, 10)
+}
+
+// parseChangeCursor decodes a cursor, where "" is the start of the feed
+func parseChangeCursor(s string) (changeCursor, error) {
+	if s == "" {
+		return changeCursor{}, nil
+	}
+	txid, seq, ok := strings.Cut(s, "-")
+	if !ok {
+		return changeCursor{}, fmt.Errorf("invalid cursor %q", s)
+	}
+	var cursor changeCursor
+	var err error
+	if cursor.txid, err = strconv.ParseInt(txid, 10, 64); err != nil || cursor.txid < 0 {
+		return changeCursor{}, fmt.Errorf("invalid cursor %q", s)
+	}
+	if cursor.seq, err = strconv.ParseInt(seq, 10, 64); err != nil || cursor.seq < 0 {
+		return changeCursor{}, fmt.Errorf("invalid cursor %q", s)
+	}
+	return cursor, nil
+}
+
+// errCursorExpired marks a cursor older than the retained changes
+var errCursorExpired = errors.New("Cursor expired, download all notes again")
+
+// settled limits changes to transactions older than every one still running,
+// whose changes can no longer be overtaken
+const settled = "txid < pg_snapshot_xmin(pg_current_snapshot())"
+
+// latestCursor returns the cursor after every settled change
+func latestCursor(db dbtx) (changeCursor, error) {
+	var cursor changeCursor
+	err := db.QueryRow(context.Background(), `
+		SELECT txid::text::bigint, seq FROM (
+			SELECT txid, seq FROM note_changes WHERE `+settled+`
+			UNION ALL
+			SELECT txid, seq FROM note_change_horizon
+		) c
+		ORDER BY txid DESC, seq DESC
+		LIMIT 1`).Scan(&cursor.txid, &cursor.seq)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return changeCursor{}, nil
+	}
+	return cursor, err
+}
+
+// GetChanges returns the changes to the user's notes after the since cursor,
+// oldest first. Each note appears once per page with its latest change.
+// Clients keep the returned cursor for the next call and continue while
+// has_more is set. A cursor older than the retained changes gets a 410 with
+// a fresh cursor; the client should then download its notes again.
+func GetChanges(c *gin.Context) {
+	userID := c.GetString("user_id")
+	db := c.MustGet("db").(*pgxpool.Pool)
+
+	since, err := parseChangeCursor(c.Query("since"))
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Invalid since cursor"})
+		return
+	}
+
+	writeChanges(c, db, userID, since)
+}
+
+// writeChanges responds with a page of the user's changes after since, the
+// size given by the limit query parameter
+func writeChanges(c *gin.Context, db *pgxpool.Pool, userID string, since changeCursor) {
+	limit := 500
+	if limitStr := c.Query("limit"); limitStr != "" {
+		l, err := strconv.Atoi(limitStr)
+		if err != nil || l <= 0 || l > 1000 {
+			c.JSON(400, gin.H{"error": "Invalid limit, expected 1 to 1000"})
+			return
+		}
+		limit = l
+	}
+
+	changes, cursor, hasMore, err := changesSince(db, userID, since, limit)
+	if errors.Is(err, errCursorExpired) {
+		latest, err := latestCursor(db)
+		if err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(410, gin.H{
+			"error":  errCursorExpired.Error(),
+			"cursor": latest.String(),
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"changes":  changes,
+		"cursor":   cursor.String(),
+		"has_more": hasMore,
+	})
+}
+
+// changesSince loads up to limit changes of the user after since, keeping
+// the latest per note, and returns them with the cursor after them
+func changesSince(db dbtx, userID string, since changeCursor, limit int) ([]NoteChange, changeCursor, bool, error) {
+	var expired bool
+	err := db.QueryRow(context.Background(),
+		"SELECT EXISTS(SELECT 1 FROM note_change_horizon WHERE (txid::text::bigint, seq) > ($1, $2))",
+		since.txid, since.seq).Scan(&expired)
+	if err != nil {
+		return nil, since, false, err
+	}
+	if expired {
+		return nil, since, false, errCursorExpired
+	}
+
+	rows, err := db.Query(context.Background(), `
+		SELECT txid::text::bigint, seq, note_id, kind, version, changed_at
+		FROM note_changes
+		WHERE user_id = $1 AND (txid, seq) > ($2::text::xid8, $3) AND `+settled+`
+		ORDER BY txid, seq
+		LIMIT $4`, userID, strconv.FormatInt(since.txid, 10), since.seq, limit+1)
+	if err != nil {
+		return nil, since, false, err
+	}
+	var all []NoteChange
+	var positions []changeCursor
+	for rows.Next() {
+		var change NoteChange
+		var position changeCursor
+		if err := rows.Scan(&position.txid, &change.Seq, &change.NoteID, &change.Kind, &change.Version, &change.ChangedAt); err != nil {
+			rows.Close()
+			return nil, since, false, err
+		}
+		position.seq = change.Seq
+		all = append(all, change)
+		positions = append(positions, position)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, since, false, err
+	}
+
+	hasMore := len(all) > limit
+	if hasMore {
+		all = all[:limit]
+	}
+	cursor := since
+	if len(all) > 0 {
+		cursor = positions[len(all)-1]
+	}
+
+	// Keep the latest change of each note, in the order of those changes
+	latest := make(map[uuid.UUID]int)
+	for i, change := range all {
+		latest[change.NoteID] = i
+	}
+	changes := []NoteChange{}
+	var live []uuid.UUID
+	for i, change := range all {
+		if latest[change.NoteID] != i {
+			continue
+		}
+		changes = append(changes, change)
+		if change.Kind != changeDeleted {
+			live = append(live, change.NoteID)
+		}
+	}
+
+	if len(live) > 0 {
+		q := NewQuery("notes").SelectNote("notes", DefaultNoteFields)
+		filterNotes(q, userID, SearchParams{}, "notes")
+		q.Where("notes.id = ANY(" + q.Arg(live) + "::uuid[])")
+		sql, args := q.SQL()
+		rows, err := db.Query(context.Background(), sql, args...)
+		if err != nil {
+			return nil, since, false, err
+		}
+		notes, err := scanNotes(rows, DefaultNoteFields, nil)
+		if err != nil {
+			return nil, since, false, err
+		}
+		current := make(map[uuid.UUID]*Note, len(notes))
+		for i := range notes {
+			current[notes[i].ID] = &notes[i]
+		}
+		// Notes deleted since have a later change still to come
+		for i := range changes {
+			changes[i].Note = current[changes[i].NoteID]
+		}
+	}
+
+	return changes, cursor, hasMore, nil
+}
+
+// StartChangePruner deletes recorded changes and sync mutation receipts
+// older than CHANGE_RETENTION (90 days by default), checking hourly until ctx
+// is cancelled
+func StartChangePruner(ctx context.Context, db *pgxpool.Pool) {
+	retention, err := time.ParseDuration(os.Getenv("CHANGE_RETENTION"))
+	if err != nil || retention <= 0 {
+		retention = defaultChangeRetention
+	}
+
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		cutoff := time.Now().Add(-retention)
+		if err := pruneChanges(ctx, db, cutoff); err != nil {
+			fmt.Fprintf(os.Stderr, "Change pruning failed: %v\n", err)
+		}
+		if _, err := db.Exec(ctx, "DELETE FROM sync_mutations WHERE created_at < $1", cutoff); err != nil {
+			fmt.Fprintf(os.Stderr, "Sync mutation pruning failed: %v\n", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// pruneChanges deletes settled changes made before cutoff and moves the
+// horizon past them
+func pruneChanges(ctx context.Context, db *pgxpool.Pool, cutoff time.Time) error {
+	_, err := db.Exec(ctx, `
+		WITH pruned AS (
+			DELETE FROM note_changes WHERE changed_at < $1 AND `+settled+`
+			RETURNING txid, seq
+		)
+		INSERT INTO note_change_horizon (txid, seq)
+		SELECT txid, seq FROM pruned ORDER BY txid DESC, seq DESC LIMIT 1
+		ON CONFLICT (id) DO UPDATE SET txid = EXCLUDED.txid, seq = EXCLUDED.seq
+		WHERE (EXCLUDED.txid, EXCLUDED.seq) > (note_change_horizon.txid, note_change_horizon.seq)`, cutoff)
+	return err
+}
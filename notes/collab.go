@@ -0,0 +1,765 @@
+package notes
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/pgvector/pgvector-go"
+	uuid "github.com/satori/go.uuid"
+	"github.com/stevecastle/modelpad/markdown"
+)
+
+const (
+	// collabChannel is the Postgres notification channel collaborative
+	// edits are relayed between server replicas on
+	collabChannel = "note_collab"
+
+	// collabSaveInterval is how often a shared document is saved to its
+	// note while it is being edited
+	collabSaveInterval = 30 * time.Second
+
+	// collabPingInterval is how often connections are pinged, one that has
+	// not answered for two intervals is closed
+	collabPingInterval = 30 * time.Second
+
+	// maxCollabMessage is the largest message a client may send
+	maxCollabMessage = 8 << 20
+
+	// collabSendBuffer is how many messages a slow client may fall behind
+	// before it is disconnected
+	collabSendBuffer = 256
+
+	// maxNotifyPayload keeps notifications below the Postgres limit of 8000
+	// bytes. Larger awareness updates are not relayed to other replicas.
+	maxNotifyPayload = 7000
+)
+
+// replicaID tells this server's notifications apart from other replicas'
+var replicaID = uuid.NewV4().String()
+
+// collabClient is one connection to a shared document
+type collabClient struct {
+	userID    string
+	canEdit   bool
+	conn      *websocket.Conn
+	send      chan []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+	// clientIDs are the Yjs clients whose presence came over this
+	// connection, guarded by the room
+	clientIDs map[uint64]bool
+}
+
+// write queues a message, closing clients that have fallen too far behind
+func (client *collabClient) write(message []byte) {
+	select {
+	case client.send <- message:
+	case <-client.closed:
+	default:
+		client.close()
+	}
+}
+
+func (client *collabClient) close() {
+	client.closeOnce.Do(func() {
+		close(client.closed)
+		client.conn.Close()
+	})
+}
+
+// writeLoop sends queued messages and pings until the client is closed
+func (client *collabClient) writeLoop() {
+	ping := time.NewTicker(collabPingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case <-client.closed:
+			return
+		case message := <-client.send:
+			client.conn.SetWriteDeadline(time.Now().Add(collabPingInterval))
+			if err := client.conn.WriteMessage(websocket.BinaryMessage, message); err != nil {
+				client.close()
+				return
+			}
+		case <-ping.C:
+			if err := client.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(collabPingInterval)); err != nil {
+				client.close()
+				return
+			}
+		}
+	}
+}
+
+// collabSnapshot is a client's copy of a shared document: its full Yjs
+// state and the same document as Lexical JSON
+type collabSnapshot struct {
+	update []byte
+	state  *yDocState
+	body   string
+}
+
+var errStaleSnapshot = errors.New("snapshot does not match the shared document")
+
+// collabRoom is a shared document being edited on this server. The latest
+// snapshot sent by a client is saved to the note periodically and when the
+// last client leaves.
+type collabRoom struct {
+	noteID uuid.UUID
+	done   chan struct{}
+
+	mu        sync.Mutex
+	clients   map[*collabClient]bool
+	awareness map[uint64]awarenessState
+	// users are the users of the Yjs clients connected to this server
+	users    map[uint64]string
+	snapshot collabSnapshot
+	dirty    bool
+}
+
+// collabRooms are the rooms open on this server by note
+var collabRooms = struct {
+	sync.Mutex
+	rooms map[uuid.UUID]*collabRoom
+}{rooms: make(map[uuid.UUID]*collabRoom)}
+
+// collabNotification relays an update or awareness change to the rooms of
+// the same note on other replicas. Updates are sent by id, they may be too
+// large for a notification.
+type collabNotification struct {
+	Replica   string    `json:"replica"`
+	NoteID    uuid.UUID `json:"note_id"`
+	UpdateID  int64     `json:"update_id,omitempty"`
+	Awareness []byte    `json:"awareness,omitempty"`
+}
+
+// CollaborateNote returns the WebSocket handler for editing a note together.
+// It speaks the y-websocket protocol, so a y-websocket provider whose server
+// URL ends in /api/notes/:id and whose room is named collab can connect.
+// Clients also send snapshot messages (type 100, followed by the document's
+// full Yjs state as an update and the document as Lexical JSON in a string),
+// which are saved as the note's body. Origins other than the server itself
+// must be in allowedOrigins. Users without the editor role can follow along,
+// but their changes are dropped.
+//
+// The server does not build the document, so it trusts the JSON of a
+// snapshot to match its Yjs state, as it trusts any save from an editor. It
+// only saves snapshots whose Yjs state has every stored update, which keeps
+// stale and partial copies from overwriting newer edits, and then replaces
+// the stored updates with that state.
+func CollaborateNote(allowedOrigins []string) gin.HandlerFunc {
+	upgrader := websocket.Upgrader{
+		CheckOrigin: func(r *http.Request) bool {
+			origin := r.Header.Get("Origin")
+			if origin == "" {
+				return true
+			}
+			for _, allowed := range allowedOrigins {
+				if origin == allowed {
+					return true
+				}
+			}
+			u, err := url.Parse(origin)
+			return err == nil && u.Host == r.Host
+		},
+	}
+
+	return func(c *gin.Context) {
+		userID := c.GetString("user_id")
+		db := c.MustGet("db").(*pgxpool.Pool)
+
+		noteID, err := uuid.FromString(c.Param("id"))
+		if err != nil {
+			c.JSON(400, gin.H{"error": "Invalid note ID"})
+			return
+		}
+		access, ok := AuthorizeNote(c, db, noteID.String(), RoleViewer)
+		if !ok {
+			return
+		}
+
+		conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+		if err != nil {
+			// The upgrader has already responded
+			return
+		}
+
+		client := &collabClient{
+			userID:    userID,
+			canEdit:   roleRank(access.Role) >= roleRank(RoleEditor),
+			conn:      conn,
+			send:      make(chan []byte, collabSendBuffer),
+			closed:    make(chan struct{}),
+			clientIDs: make(map[uint64]bool),
+		}
+		room, err := joinRoom(db, noteID, client)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to open shared note %s: %v\n", noteID, err)
+			conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseInternalServerErr, "Unable to open note"), time.Now().Add(time.Second))
+			conn.Close()
+			return
+		}
+		defer room.leave(db, client)
+
+		go client.writeLoop()
+
+		// Ask for the client's state, which may have offline edits, and tell
+		// it who else is here
+		client.write(syncMessage(syncStep1, emptyStateVector))
+		if states := room.states(); len(states) > 0 {
+			client.write(awarenessMessage(states))
+		}
+
+		conn.SetReadLimit(maxCollabMessage)
+		conn.SetReadDeadline(time.Now().Add(2 * collabPingInterval))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(2 * collabPingInterval))
+		})
+		for {
+			messageType, message, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			conn.SetReadDeadline(time.Now().Add(2 * collabPingInterval))
+			if messageType != websocket.BinaryMessage {
+				continue
+			}
+			if err := room.handle(db, client, message); err != nil {
+				fmt.Fprintf(os.Stderr, "Closing shared note %s connection: %v\n", noteID, err)
+				return
+			}
+		}
+	}
+}
+
+// joinRoom adds a client to the note's room, opening it if needed
+func joinRoom(db *pgxpool.Pool, noteID uuid.UUID, client *collabClient) (*collabRoom, error) {
+	collabRooms.Lock()
+	defer collabRooms.Unlock()
+
+	room := collabRooms.rooms[noteID]
+	if room == nil {
+		if err := resetStaleUpdates(db, noteID); err != nil {
+			return nil, err
+		}
+		room = &collabRoom{
+			noteID:    noteID,
+			done:      make(chan struct{}),
+			clients:   make(map[*collabClient]bool),
+			awareness: make(map[uint64]awarenessState),
+			users:     make(map[uint64]string),
+		}
+		collabRooms.rooms[noteID] = room
+		go room.saveLoop(db)
+	}
+
+	room.mu.Lock()
+	room.clients[client] = true
+	room.mu.Unlock()
+	return room, nil
+}
+
+// resetStaleUpdates discards the updates of a note saved some other way
+// since its shared document was last saved, so editing starts from its body
+func resetStaleUpdates(db *pgxpool.Pool, noteID uuid.UUID) error {
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+
+	var version int64
+	var savedVersion *int64
+	err = tx.QueryRow(context.Background(), `
+		SELECT n.version, s.version FROM notes n
+		LEFT JOIN note_collab_state s ON s.note_id = n.id
+		WHERE n.id = $1 FOR UPDATE OF n`, noteID).Scan(&version, &savedVersion)
+	if err != nil {
+		return err
+	}
+	if savedVersion != nil && *savedVersion == version {
+		return nil
+	}
+
+	_, err = tx.Exec(context.Background(), "DELETE FROM note_collab_updates WHERE note_id = $1", noteID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(context.Background(), `
+		INSERT INTO note_collab_state (note_id, version) VALUES ($1, $2)
+		ON CONFLICT (note_id) DO UPDATE SET version = EXCLUDED.version`, noteID, version)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(context.Background())
+}
+
+// leave removes a client and its presence. The last client to leave closes
+// the room and saves the document.
+func (room *collabRoom) leave(db *pgxpool.Pool, client *collabClient) {
+	client.close()
+
+	room.mu.Lock()
+	delete(room.clients, client)
+	var removed []awarenessState
+	for clientID := range client.clientIDs {
+		if state, ok := room.awareness[clientID]; ok {
+			removed = append(removed, awarenessState{ClientID: clientID, Clock: state.Clock + 1, State: "null"})
+			delete(room.awareness, clientID)
+			delete(room.users, clientID)
+		}
+	}
+	room.mu.Unlock()
+
+	if len(removed) > 0 {
+		message := awarenessMessage(removed)
+		room.broadcast(nil, message)
+		room.notify(db, collabNotification{Awareness: awarenessUpdate(message)})
+	}
+
+	collabRooms.Lock()
+	room.mu.Lock()
+	last := len(room.clients) == 0 && collabRooms.rooms[room.noteID] == room
+	if last {
+		delete(collabRooms.rooms, room.noteID)
+		close(room.done)
+	}
+	room.mu.Unlock()
+	collabRooms.Unlock()
+
+	if last {
+		if err := room.save(db); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to save shared note %s: %v\n", room.noteID, err)
+		}
+	}
+}
+
+// handle processes one message from a client
+func (room *collabRoom) handle(db *pgxpool.Pool, client *collabClient, message []byte) error {
+	d := yDecoder{data: message}
+	messageType, err := d.varUint()
+	if err != nil {
+		return err
+	}
+
+	switch messageType {
+	case messageSync:
+		step, err := d.varUint()
+		if err != nil {
+			return err
+		}
+		payload, err := d.varBytes()
+		if err != nil {
+			return err
+		}
+		switch step {
+		case syncStep1:
+			// Updates the client already has are ignored by Yjs, so every
+			// update is sent rather than working out which it lacks
+			updates, err := loadCollabUpdates(db, room.noteID)
+			if err != nil {
+				return err
+			}
+			for _, update := range updates {
+				client.write(syncMessage(syncUpdate, update))
+			}
+			client.write(syncMessage(syncStep2, emptyUpdate))
+		case syncStep2, syncUpdate:
+			// Readers follow along but their changes are not shared
+			if !client.canEdit || bytes.Equal(payload, emptyUpdate) {
+				return nil
+			}
+			// Stored updates are read back when snapshots are checked
+			if err := newYDocState().apply(payload); err != nil {
+				return fmt.Errorf("invalid update: %w", err)
+			}
+			var updateID int64
+			err := db.QueryRow(context.Background(),
+				"INSERT INTO note_collab_updates (note_id, data) VALUES ($1, $2) RETURNING id",
+				room.noteID, payload).Scan(&updateID)
+			if err != nil {
+				return err
+			}
+			room.broadcast(client, syncMessage(syncUpdate, payload))
+			room.notify(db, collabNotification{UpdateID: updateID})
+		default:
+			return errMalformedMessage
+		}
+
+	case messageAwareness:
+		update, err := d.varBytes()
+		if err != nil {
+			return err
+		}
+		states, err := decodeAwareness(update)
+		if err != nil {
+			return err
+		}
+		room.mu.Lock()
+		for _, state := range states {
+			client.clientIDs[state.ClientID] = true
+		}
+		room.mu.Unlock()
+		room.applyAwareness(states, client.userID)
+		room.broadcast(client, message)
+		room.notify(db, collabNotification{Awareness: update})
+
+	case messageQueryAwareness:
+		client.write(awarenessMessage(room.states()))
+
+	case messageSnapshot:
+		update, err := d.varBytes()
+		if err != nil {
+			return err
+		}
+		body, err := d.varString()
+		if err != nil {
+			return err
+		}
+		if !client.canEdit {
+			return nil
+		}
+		state := newYDocState()
+		if err := state.apply(update); err != nil {
+			return fmt.Errorf("invalid snapshot: %w", err)
+		}
+		if _, err := markdown.ConvertJSONToMarkdown(body); err != nil {
+			return fmt.Errorf("invalid snapshot: %w", err)
+		}
+		room.mu.Lock()
+		room.snapshot = collabSnapshot{update: update, state: state, body: body}
+		room.dirty = true
+		room.mu.Unlock()
+	}
+	return nil
+}
+
+// applyAwareness records presence changes, keeping the newest state of
+// each Yjs client. userID is empty for changes from other replicas.
+func (room *collabRoom) applyAwareness(states []awarenessState, userID string) {
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	for _, state := range states {
+		if current, ok := room.awareness[state.ClientID]; ok && current.Clock > state.Clock {
+			continue
+		}
+		if state.State == "null" {
+			delete(room.awareness, state.ClientID)
+			delete(room.users, state.ClientID)
+			continue
+		}
+		room.awareness[state.ClientID] = state
+		if userID != "" {
+			room.users[state.ClientID] = userID
+		}
+	}
+}
+
+// states returns the presence of everyone in the room
+func (room *collabRoom) states() []awarenessState {
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	states := make([]awarenessState, 0, len(room.awareness))
+	for _, state := range room.awareness {
+		states = append(states, state)
+	}
+	return states
+}
+
+// broadcast sends a message to every client in the room except from
+func (room *collabRoom) broadcast(from *collabClient, message []byte) {
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	for client := range room.clients {
+		if client != from {
+			client.write(message)
+		}
+	}
+}
+
+// notify relays a change to the note's rooms on other replicas
+func (room *collabRoom) notify(db *pgxpool.Pool, n collabNotification) {
+	n.Replica = replicaID
+	n.NoteID = room.noteID
+	payload, err := json.Marshal(n)
+	if err != nil || len(payload) > maxNotifyPayload {
+		return
+	}
+	if _, err := db.Exec(context.Background(), "SELECT pg_notify($1, $2)", collabChannel, string(payload)); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to relay shared note %s change: %v\n", room.noteID, err)
+	}
+}
+
+// relayCollab passes a change from another replica on to the clients here
+func relayCollab(db *pgxpool.Pool, payload string) {
+	var n collabNotification
+	if err := json.Unmarshal([]byte(payload), &n); err != nil || n.Replica == replicaID {
+		return
+	}
+	collabRooms.Lock()
+	room := collabRooms.rooms[n.NoteID]
+	collabRooms.Unlock()
+	if room == nil {
+		return
+	}
+
+	if n.UpdateID != 0 {
+		// A compacted update was merged into the next update left
+		var update []byte
+		err := db.QueryRow(context.Background(),
+			"SELECT data FROM note_collab_updates WHERE note_id = $1 AND id >= $2 ORDER BY id LIMIT 1",
+			n.NoteID, n.UpdateID).Scan(&update)
+		if err != nil {
+			return
+		}
+		room.broadcast(nil, syncMessage(syncUpdate, update))
+	}
+	if n.Awareness != nil {
+		states, err := decodeAwareness(n.Awareness)
+		if err != nil {
+			return
+		}
+		room.applyAwareness(states, "")
+		room.broadcast(nil, awarenessMessage(states))
+	}
+}
+
+// awarenessUpdate returns the awareness update of an awareness message
+func awarenessUpdate(message []byte) []byte {
+	d := yDecoder{data: message}
+	d.varUint()
+	update, _ := d.varBytes()
+	return update
+}
+
+// loadCollabUpdates returns the updates of a shared document in order
+func loadCollabUpdates(db *pgxpool.Pool, noteID uuid.UUID) ([][]byte, error) {
+	rows, err := db.Query(context.Background(),
+		"SELECT data FROM note_collab_updates WHERE note_id = $1 ORDER BY id", noteID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var updates [][]byte
+	for rows.Next() {
+		var update []byte
+		if err := rows.Scan(&update); err != nil {
+			return nil, err
+		}
+		updates = append(updates, update)
+	}
+	return updates, rows.Err()
+}
+
+// saveLoop saves the document periodically until the room closes
+func (room *collabRoom) saveLoop(db *pgxpool.Pool) {
+	ticker := time.NewTicker(collabSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-room.done:
+			return
+		case <-ticker.C:
+			if err := room.save(db); err != nil {
+				fmt.Fprintf(os.Stderr, "Unable to save shared note %s: %v\n", room.noteID, err)
+			}
+		}
+	}
+}
+
+// save writes the latest snapshot to the note when it has changed. A
+// snapshot that misses stored updates is dropped, the client that sent those
+// sends a newer one.
+func (room *collabRoom) save(db *pgxpool.Pool) error {
+	room.mu.Lock()
+	snapshot, dirty := room.snapshot, room.dirty
+	room.dirty = false
+	room.mu.Unlock()
+	if !dirty {
+		return nil
+	}
+
+	err := saveCollabBody(db, room.noteID, snapshot)
+	if errors.Is(err, errStaleSnapshot) {
+		return nil
+	}
+	if err != nil {
+		room.mu.Lock()
+		if room.snapshot.state == snapshot.state {
+			room.dirty = true
+		}
+		room.mu.Unlock()
+	}
+	return err
+}
+
+// saveCollabBody saves a snapshot as the note's body, records the new
+// version as the one the shared document matches and compacts the stored
+// updates into the snapshot's Yjs state. The body is rendered before the
+// note is locked. It fails with errStaleSnapshot when the snapshot does not
+// have every stored update.
+func saveCollabBody(db *pgxpool.Pool, noteID uuid.UUID, snapshot collabSnapshot) error {
+	var renderedTitle, renderedBody string
+	err := db.QueryRow(context.Background(),
+		"SELECT COALESCE(title, ''), COALESCE(body, '') FROM notes WHERE id = $1", noteID).Scan(&renderedTitle, &renderedBody)
+	if err != nil {
+		return err
+	}
+	var text string
+	var embedding *pgvector.Vector
+	if snapshot.body != renderedBody {
+		text, embedding, err = renderNote(renderedTitle, snapshot.body)
+		if err != nil {
+			return err
+		}
+	}
+
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+
+	var ownerID, title, currentBody string
+	var version int64
+	err = tx.QueryRow(context.Background(),
+		"SELECT user_id::text, COALESCE(title, ''), COALESCE(body, ''), version FROM notes WHERE id = $1 FOR UPDATE", noteID).
+		Scan(&ownerID, &title, &currentBody, &version)
+	if err != nil {
+		return err
+	}
+	// A note changed since it was read is rendered again on the next save
+	if snapshot.body != currentBody && (snapshot.body == renderedBody || title != renderedTitle) {
+		return errNoteChanged
+	}
+
+	ids, stored, err := lockCollabUpdates(tx, noteID)
+	if err != nil {
+		return err
+	}
+	if !snapshot.state.includes(stored) {
+		return errStaleSnapshot
+	}
+
+	if snapshot.body != currentBody {
+		body := snapshot.body
+		err = tx.QueryRow(context.Background(),
+			"UPDATE notes SET body = $1, markdown = $2, embedding = $3, updated_at = now(), version = version + 1 WHERE id = $4 RETURNING version",
+			body, text, embedding, noteID).Scan(&version)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(context.Background(),
+			"INSERT INTO revisions (note_id, title, body, user_id, size) VALUES ($1, $2, $3, $4, $5)",
+			noteID, title, body, ownerID, len(body))
+		if err != nil {
+			return err
+		}
+		if err := saveLinks(tx, noteID, body); err != nil {
+			return err
+		}
+	}
+
+	// The snapshot's state takes the place of the updates it was checked
+	// against, updates stored since are kept
+	if len(ids) > 0 {
+		last := len(ids) - 1
+		_, err = tx.Exec(context.Background(),
+			"UPDATE note_collab_updates SET data = $1 WHERE id = $2", snapshot.update, ids[last])
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(context.Background(),
+			"DELETE FROM note_collab_updates WHERE id = ANY($1)", ids[:last])
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(context.Background(), `
+		INSERT INTO note_collab_state (note_id, version) VALUES ($1, $2)
+		ON CONFLICT (note_id) DO UPDATE SET version = EXCLUDED.version`, noteID, version)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(context.Background())
+}
+
+// lockCollabUpdates locks the stored updates of a shared document and
+// returns their ids in order and what they hold
+func lockCollabUpdates(tx pgx.Tx, noteID uuid.UUID) ([]int64, *yDocState, error) {
+	rows, err := tx.Query(context.Background(),
+		"SELECT id, data FROM note_collab_updates WHERE note_id = $1 ORDER BY id FOR UPDATE", noteID)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	state := newYDocState()
+	for rows.Next() {
+		var id int64
+		var update []byte
+		if err := rows.Scan(&id, &update); err != nil {
+			return nil, nil, err
+		}
+		if err := state.apply(update); err != nil {
+			return nil, nil, fmt.Errorf("update %d: %w", id, err)
+		}
+		ids = append(ids, id)
+	}
+	return ids, state, rows.Err()
+}
+
+// Presence is a Yjs client in a shared document. State is whatever the
+// client shares, typically its user name, color and cursor.
+type Presence struct {
+	ClientID uint64          `json:"client_id"`
+	UserID   string          `json:"user_id,omitempty"`
+	State    json.RawMessage `json:"state"`
+}
+
+// GetPresence returns who is editing a note on this server and, as far as
+// their presence has been relayed, on other replicas
+func GetPresence(c *gin.Context) {
+	db := c.MustGet("db").(*pgxpool.Pool)
+
+	noteID, err := uuid.FromString(c.Param("id"))
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Invalid note ID"})
+		return
+	}
+	if _, ok := AuthorizeNote(c, db, noteID.String(), RoleViewer); !ok {
+		return
+	}
+
+	presence := []Presence{}
+	collabRooms.Lock()
+	room := collabRooms.rooms[noteID]
+	collabRooms.Unlock()
+	if room != nil {
+		room.mu.Lock()
+		for clientID, state := range room.awareness {
+			if !json.Valid([]byte(state.State)) {
+				continue
+			}
+			presence = append(presence, Presence{ClientID: clientID, UserID: room.users[clientID], State: json.RawMessage(state.State)})
+		}
+		room.mu.Unlock()
+	}
+
+	c.JSON(200, gin.H{"presence": presence})
+}
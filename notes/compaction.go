@@ -0,0 +1,412 @@
+package notes
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	uuid "github.com/satori/go.uuid"
+	"github.com/stevecastle/modelpad/delta"
+)
+
+// Revision storage encodings
+const (
+	encodingPlain    = "plain"
+	encodingKeyframe = "keyframe"
+	encodingDelta    = "delta"
+)
+
+// maxDeltaChain is how many deltas may share a keyframe before a new
+// keyframe is stored
+const maxDeltaChain = 50
+
+// RetentionTier keeps one revision per Every for revisions younger than
+// Within. A zero Every keeps every revision.
+type RetentionTier struct {
+	Within time.Duration
+	Every  time.Duration
+}
+
+// RetentionPolicy lists retention tiers from the most recent to the oldest.
+// Revisions older than the last tier are removed. Named revisions and the
+// newest revision of each note and branch are always kept.
+type RetentionPolicy []RetentionTier
+
+// DefaultRetentionPolicy keeps every revision for an hour, hourly revisions
+// for a day and daily revisions for a month
+var DefaultRetentionPolicy = RetentionPolicy{
+	{Within: time.Hour},
+	{Within: 24 * time.Hour, Every: time.Hour},
+	{Within: 30 * 24 * time.Hour, Every: 24 * time.Hour},
+}
+
+// ParseRetentionPolicy parses a policy written as comma separated
+// within:every tiers, for example "1h:all,24h:1h,720h:24h"
+func ParseRetentionPolicy(spec string) (RetentionPolicy, error) {
+	var policy RetentionPolicy
+	for _, tier := range strings.Split(spec, ",") {
+		within, every, ok := strings.Cut(strings.TrimSpace(tier), ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid retention tier %q, expected within:every", tier)
+		}
+		var t RetentionTier
+		var err error
+		if t.Within, err = time.ParseDuration(within); err != nil {
+			return nil, fmt.Errorf("invalid retention tier %q: %w", tier, err)
+		}
+		if every != "all" {
+			if t.Every, err = time.ParseDuration(every); err != nil || t.Every <= 0 {
+				return nil, fmt.Errorf("invalid retention tier %q, expected a positive interval or all", tier)
+			}
+		}
+		if len(policy) > 0 && t.Within <= policy[len(policy)-1].Within {
+			return nil, fmt.Errorf("retention tiers must be listed from the most recent")
+		}
+		policy = append(policy, t)
+	}
+	return policy, nil
+}
+
+// CurrentRetentionPolicy returns the policy configured by REVISION_RETENTION
+func CurrentRetentionPolicy() RetentionPolicy {
+	spec := os.Getenv("REVISION_RETENTION")
+	if spec == "" {
+		return DefaultRetentionPolicy
+	}
+	policy, err := ParseRetentionPolicy(spec)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Ignoring REVISION_RETENTION: %v\n", err)
+		return DefaultRetentionPolicy
+	}
+	return policy
+}
+
+// storedRevision is the storage metadata of a revision
+type storedRevision struct {
+	id         uuid.UUID
+	createdAt  time.Time
+	name       *string
+	encoding   string
+	keyframeID *uuid.UUID
+	branchID   uuid.UUID
+}
+
+// retentionBucket identifies the period of a tier a revision falls in. The
+// main body and each branch are thinned out separately.
+type retentionBucket struct {
+	branchID uuid.UUID
+	tier     int
+	period   int64
+}
+
+// keep returns the ids of the revisions the policy retains. revisions must be
+// ordered from oldest to newest.
+func (p RetentionPolicy) keep(revisions []storedRevision, now time.Time) map[uuid.UUID]bool {
+	kept := make(map[uuid.UUID]bool)
+	latest := make(map[uuid.UUID]bool)
+
+	// Walk from newest so the newest revision of each bucket is kept
+	buckets := make(map[retentionBucket]bool)
+	for i := len(revisions) - 1; i >= 0; i-- {
+		revision := revisions[i]
+		if !latest[revision.branchID] || revision.name != nil {
+			latest[revision.branchID] = true
+			kept[revision.id] = true
+			continue
+		}
+		age := now.Sub(revision.createdAt)
+		for tier, t := range p {
+			if age > t.Within {
+				continue
+			}
+			if t.Every == 0 {
+				kept[revision.id] = true
+			} else {
+				bucket := retentionBucket{revision.branchID, tier, revision.createdAt.UnixNano() / int64(t.Every)}
+				if !buckets[bucket] {
+					buckets[bucket] = true
+					kept[revision.id] = true
+				}
+			}
+			break
+		}
+	}
+	return kept
+}
+
+// compressBefore returns the time before which kept revisions are compressed.
+// Revisions in a leading keep-everything tier stay plain for fast access.
+func (p RetentionPolicy) compressBefore(now time.Time) time.Time {
+	if len(p) > 0 && p[0].Every == 0 {
+		return now.Add(-p[0].Within)
+	}
+	return now
+}
+
+func compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decompress(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// decodeRevision rebuilds a revision body from its stored form. keyframe is
+// the stored data of the revision's keyframe, needed for deltas.
+func decodeRevision(encoding string, body *string, data []byte, keyframe []byte) (string, error) {
+	switch encoding {
+	case encodingKeyframe:
+		decoded, err := decompress(data)
+		return string(decoded), err
+	case encodingDelta:
+		base, err := decompress(keyframe)
+		if err != nil {
+			return "", err
+		}
+		patch, err := decompress(data)
+		if err != nil {
+			return "", err
+		}
+		decoded, err := delta.Apply(base, patch)
+		return string(decoded), err
+	}
+	if body == nil {
+		return "", nil
+	}
+	return *body, nil
+}
+
+// revisionBodyColumns selects what decodeRevision needs from revisions r
+const revisionBodyColumns = "r.encoding, r.body, r.data, (SELECT k.data FROM revisions k WHERE k.id = r.keyframe_id)"
+
+// revisionBody loads and decodes the body of a revision
+func revisionBody(ctx context.Context, db dbtx, revisionID uuid.UUID) (string, error) {
+	var encoding string
+	var body *string
+	var data, keyframe []byte
+	err := db.QueryRow(ctx, "SELECT "+revisionBodyColumns+" FROM revisions r WHERE r.id = $1", revisionID).
+		Scan(&encoding, &body, &data, &keyframe)
+	if err != nil {
+		return "", err
+	}
+	return decodeRevision(encoding, body, data, keyframe)
+}
+
+// StartRevisionCompactor compacts revisions every REVISION_COMPACTION_INTERVAL
+// (one hour by default) until ctx is cancelled
+func StartRevisionCompactor(ctx context.Context, db *pgxpool.Pool) {
+	interval, err := time.ParseDuration(os.Getenv("REVISION_COMPACTION_INTERVAL"))
+	if err != nil || interval <= 0 {
+		interval = time.Hour
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := CompactRevisions(ctx, db, CurrentRetentionPolicy(), time.Now()); err != nil {
+			fmt.Fprintf(os.Stderr, "Revision compaction failed: %v\n", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// CompactRevisions applies the retention policy to every note's revisions and
+// compresses the revisions it keeps
+func CompactRevisions(ctx context.Context, db *pgxpool.Pool, policy RetentionPolicy, now time.Time) error {
+	rows, err := db.Query(ctx, `
+		SELECT note_id FROM revisions
+		WHERE note_id IS NOT NULL AND created_at < $2
+		GROUP BY note_id
+		HAVING bool_or(encoding = $1) OR count(*) FILTER (WHERE name IS NULL) > 1`,
+		encodingPlain, policy.compressBefore(now))
+	if err != nil {
+		return err
+	}
+	var noteIDs []uuid.UUID
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		noteIDs = append(noteIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, noteID := range noteIDs {
+		if err := compactNote(ctx, db, noteID, policy, now); err != nil {
+			fmt.Fprintf(os.Stderr, "Compacting revisions of note %s failed: %v\n", noteID, err)
+		}
+	}
+	return nil
+}
+
+// compactNote removes the revisions of a note the policy no longer keeps and
+// stores the rest as gzipped keyframes and deltas against them
+func compactNote(ctx context.Context, db *pgxpool.Pool, noteID uuid.UUID, policy RetentionPolicy, now time.Time) error {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	rows, err := tx.Query(ctx, `
+		SELECT id, created_at, name, encoding, keyframe_id, COALESCE(branch_id, '00000000-0000-0000-0000-000000000000')
+		FROM revisions
+		WHERE note_id = $1
+		ORDER BY created_at, id
+		FOR UPDATE`, noteID)
+	if err != nil {
+		return err
+	}
+	var revisions []storedRevision
+	for rows.Next() {
+		var r storedRevision
+		if err := rows.Scan(&r.id, &r.createdAt, &r.name, &r.encoding, &r.keyframeID, &r.branchID); err != nil {
+			rows.Close()
+			return err
+		}
+		revisions = append(revisions, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	kept := policy.keep(revisions, now)
+
+	// Deltas must not outlive their keyframe, so store them in full first
+	var removed []uuid.UUID
+	var remaining []storedRevision
+	for _, r := range revisions {
+		if !kept[r.id] {
+			removed = append(removed, r.id)
+			continue
+		}
+		if r.encoding == encodingDelta && !kept[*r.keyframeID] {
+			body, err := revisionBody(ctx, tx, r.id)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec(ctx,
+				"UPDATE revisions SET encoding = $1, body = $2, data = NULL, keyframe_id = NULL WHERE id = $3",
+				encodingPlain, body, r.id)
+			if err != nil {
+				return err
+			}
+			r.encoding, r.keyframeID = encodingPlain, nil
+		}
+		remaining = append(remaining, r)
+	}
+	if len(removed) > 0 {
+		if _, err := tx.Exec(ctx, "DELETE FROM revisions WHERE id = ANY($1)", removed); err != nil {
+			return err
+		}
+	}
+
+	// Deltas only reference keyframes on their own branch, so deleting a
+	// branch's revisions never breaks another chain
+	branches := make(map[uuid.UUID][]storedRevision)
+	for _, r := range remaining {
+		branches[r.branchID] = append(branches[r.branchID], r)
+	}
+	for _, branch := range branches {
+		if err := compressRevisions(ctx, tx, branch, policy.compressBefore(now)); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit(ctx)
+}
+
+// compressRevisions stores plain revisions created before the given time as
+// deltas against the latest keyframe while that keeps them small, and as new
+// keyframes otherwise. revisions must be ordered from oldest to newest.
+func compressRevisions(ctx context.Context, tx dbtx, revisions []storedRevision, before time.Time) error {
+	var keyframe []byte
+	var keyframeID uuid.UUID
+	chain := 0
+	for _, r := range revisions {
+		switch r.encoding {
+		case encodingKeyframe:
+			// Decoded only if a later revision is stored against it
+			keyframe, keyframeID, chain = nil, r.id, 0
+			continue
+		case encodingDelta:
+			if *r.keyframeID == keyframeID {
+				chain++
+			}
+			continue
+		}
+		if !r.createdAt.Before(before) {
+			continue
+		}
+
+		body, err := revisionBody(ctx, tx, r.id)
+		if err != nil {
+			return err
+		}
+		if keyframe == nil && keyframeID != uuid.Nil {
+			decoded, err := revisionBody(ctx, tx, keyframeID)
+			if err != nil {
+				return err
+			}
+			keyframe = []byte(decoded)
+		}
+		if keyframe != nil && chain < maxDeltaChain {
+			patch, err := compress(delta.Encode(keyframe, []byte(body)))
+			if err != nil {
+				return err
+			}
+			if len(patch) < len(body)/2 {
+				_, err = tx.Exec(ctx,
+					"UPDATE revisions SET encoding = $1, data = $2, keyframe_id = $3, body = NULL, size = $4 WHERE id = $5",
+					encodingDelta, patch, keyframeID, len(body), r.id)
+				if err != nil {
+					return err
+				}
+				chain++
+				continue
+			}
+		}
+
+		data, err := compress([]byte(body))
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx,
+			"UPDATE revisions SET encoding = $1, data = $2, keyframe_id = NULL, body = NULL, size = $3 WHERE id = $4",
+			encodingKeyframe, data, len(body), r.id)
+		if err != nil {
+			return err
+		}
+		keyframe, keyframeID, chain = []byte(body), r.id, 0
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package notes
+
+import (
+	"testing"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+func TestRetentionPolicyKeep(t *testing.T) {
+	now := time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)
+	branch := uuid.NewV4()
+	snapshot := "release"
+
+	type rev struct {
+		name   string
+		age    time.Duration
+		branch uuid.UUID
+		named  *string
+		kept   bool
+	}
+	// Oldest first, as keep expects
+	revisions := []rev{
+		{name: "named beyond the last tier", age: 50 * 24 * time.Hour, named: &snapshot, kept: true},
+		{name: "beyond the last tier", age: 40 * 24 * time.Hour, kept: false},
+		{name: "newest of a branch", age: 40 * 24 * time.Hour, branch: branch, kept: true},
+		{name: "older in the same day", age: 2*24*time.Hour + 2*time.Hour, kept: false},
+		{name: "newest in a day", age: 2*24*time.Hour + time.Hour, kept: true},
+		{name: "day tier boundary", age: 24 * time.Hour, kept: true},
+		{name: "older in the same hour", age: 3*time.Hour + 20*time.Minute, kept: false},
+		{name: "newest in an hour", age: 3*time.Hour + 10*time.Minute, kept: true},
+		{name: "older just past the first tier", age: time.Hour + 30*time.Minute, kept: false},
+		{name: "just past the first tier", age: time.Hour + time.Nanosecond, kept: true},
+		{name: "first tier boundary", age: time.Hour, kept: true},
+		{name: "recent", age: 10 * time.Minute, kept: true},
+		{name: "recent in the same minute", age: 10*time.Minute - time.Second, kept: true},
+		{name: "newest", age: 5 * time.Minute, kept: true},
+	}
+
+	var stored []storedRevision
+	for _, r := range revisions {
+		stored = append(stored, storedRevision{
+			id:        uuid.NewV4(),
+			createdAt: now.Add(-r.age),
+			name:      r.named,
+			branchID:  r.branch,
+		})
+	}
+
+	kept := DefaultRetentionPolicy.keep(stored, now)
+	for i, r := range revisions {
+		if kept[stored[i].id] != r.kept {
+			t.Errorf("%s: kept = %v, want %v", r.name, kept[stored[i].id], r.kept)
+		}
+	}
+}
+
+func TestRetentionPolicyKeepsNewestOnly(t *testing.T) {
+	now := time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)
+	old := storedRevision{id: uuid.NewV4(), createdAt: now.Add(-90 * 24 * time.Hour)}
+	older := storedRevision{id: uuid.NewV4(), createdAt: now.Add(-100 * 24 * time.Hour)}
+
+	kept := DefaultRetentionPolicy.keep([]storedRevision{older, old}, now)
+	if !kept[old.id] || kept[older.id] {
+		t.Errorf("keep() = %v, want only the newest revision", kept)
+	}
+}
+
+func TestParseRetentionPolicy(t *testing.T) {
+	policy, err := ParseRetentionPolicy("1h:all, 24h:1h,720h:24h")
+	if err != nil {
+		t.Fatalf("ParseRetentionPolicy() error = %v", err)
+	}
+	if len(policy) != 3 || policy[0].Every != 0 || policy[1].Every != time.Hour || policy[2].Within != 720*time.Hour {
+		t.Errorf("ParseRetentionPolicy() = %v", policy)
+	}
+
+	for _, spec := range []string{"", "1h", "1h:0s", "24h:1h,1h:all", "x:all"} {
+		if _, err := ParseRetentionPolicy(spec); err == nil {
+			t.Errorf("ParseRetentionPolicy(%q) succeeded, want an error", spec)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package notes
+
+import (
+	"context"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5/pgxpool"
+	uuid "github.com/satori/go.uuid"
+)
+
+// copyNotes inserts copies of notes with new ids and parents. The copies keep
+// their titles, bodies, tags, positions, markdown, embeddings and links, and
+// start private and not templates. Titles are replaced where titles has an
+// entry for the original.
+func copyNotes(tx dbtx, userID string, oldIDs []uuid.UUID, newIDs []uuid.UUID, newParents []*uuid.UUID, titles map[uuid.UUID]string) error {
+	newTitles := make([]*string, len(oldIDs))
+	for i, id := range oldIDs {
+		if title, ok := titles[id]; ok {
+			newTitles[i] = &title
+		}
+	}
+
+	// Foreign keys are checked at the end of the statement, so parents and
+	// children can be inserted together
+	_, err := tx.Exec(context.Background(), `
+		INSERT INTO notes (id, title, body, user_id, parent, embedding, tags, markdown, position)
+		SELECT m.new_id, COALESCE(m.title, n.title), n.body, n.user_id, m.new_parent, n.embedding, n.tags, n.markdown, n.position
+		FROM unnest($1::uuid[], $2::uuid[], $3::uuid[], $4::text[]) AS m(old_id, new_id, new_parent, title)
+		INNER JOIN notes n ON n.id = m.old_id
+		WHERE n.user_id = $5`,
+		oldIDs, newIDs, newParents, newTitles, userID)
+	if err != nil {
+		return err
+	}
+	return copyLinks(tx, oldIDs, newIDs)
+}
+
+// recordRevisions saves the current title and body of notes as revisions
+func recordRevisions(tx dbtx, ids []uuid.UUID) error {
+	_, err := tx.Exec(context.Background(), `
+		INSERT INTO revisions (note_id, title, body, user_id, size)
+		SELECT id, title, body, user_id, COALESCE(octet_length(body), 0)
+		FROM notes WHERE id = ANY($1::uuid[])`, ids)
+	return err
+}
+
+// DuplicateNote copies a note, placed right after it. With deep set its
+// subtree is copied too, keeping the structure. Every copy gets a new id.
+// The body may give the copy's title, which defaults to the original title
+// followed by "(copy)", and a different parent. The copy belongs to the
+// note's owner, so the user must be able to edit the note and the parent.
+func DuplicateNote(c *gin.Context) {
+	userID := c.GetString("user_id")
+
+	noteID, err := uuid.FromString(c.Param("id"))
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Invalid note ID"})
+		return
+	}
+
+	var requestBody struct {
+		Deep   bool    `json:"deep"`
+		Title  *string `json:"title"`
+		Parent *string `json:"parent"`
+	}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&requestBody); err != nil {
+			c.JSON(400, gin.H{"error": "Invalid request body"})
+			return
+		}
+	}
+
+	db := c.MustGet("db").(*pgxpool.Pool)
+
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback(context.Background())
+
+	access, ok := AuthorizeNote(c, tx, noteID.String(), RoleEditor)
+	if !ok {
+		return
+	}
+	owner := access.OwnerID
+
+	original, err := getNote(tx, noteID.String(), owner)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	oldIDs := []uuid.UUID{original.ID}
+	if requestBody.Deep {
+		oldIDs, err = subtreeIDs(tx, original.ID)
+		if err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	newIDs, newParents, err := copyStructure(tx, oldIDs)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	title := original.Title + " (copy)"
+	if requestBody.Title != nil {
+		title = *requestBody.Title
+	}
+	if err := copyNotes(tx, owner, oldIDs, newIDs, newParents, map[uuid.UUID]string{original.ID: title}); err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	if err := recordRevisions(tx, newIDs); err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Place the copy after the original, or last under another parent
+	parent, after := original.Parent, &original.ID
+	if requestBody.Parent != nil {
+		parent, err = parseOptionalUUID(requestBody.Parent)
+		if err != nil {
+			c.JSON(400, gin.H{"error": "Invalid parent ID"})
+			return
+		}
+		after = nil
+	}
+	if _, err := placeNote(tx, userID, owner, newIDs[0], parent, after, nil); err != nil {
+		c.JSON(operationStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	duplicate, err := getNote(tx, newIDs[0].String(), owner)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	err = tx.Commit(context.Background())
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(201, gin.H{
+		"note":  duplicate,
+		"count": len(newIDs),
+	})
+}
+
+// subtreeIDs returns the id of a note followed by the ids of its descendants,
+// parents before children. Descendants in the trash or of another owner are
+// left out.
+func subtreeIDs(tx dbtx, noteID uuid.UUID) ([]uuid.UUID, error) {
+	rows, err := tx.Query(context.Background(), `
+		WITH RECURSIVE subtree AS (
+			SELECT c.id, c.user_id FROM notes c
+			INNER JOIN notes p ON p.id = c.parent AND p.user_id = c.user_id
+			WHERE p.id = $1 AND c.deleted_at IS NULL
+			UNION ALL
+			SELECT n.id, n.user_id FROM notes n
+			INNER JOIN subtree s ON n.parent = s.id
+			WHERE n.user_id = s.user_id AND n.deleted_at IS NULL
+		)
+		SELECT id FROM subtree`, noteID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []uuid.UUID{noteID}
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// copyStructure gives each note a new id and maps the parents of all but the
+// first note, the root of the copy, to the new ids
+func copyStructure(tx dbtx, oldIDs []uuid.UUID) ([]uuid.UUID, []*uuid.UUID, error) {
+	parents, err := noteParents(tx, oldIDs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	copies := make(map[uuid.UUID]uuid.UUID, len(oldIDs))
+	newIDs := make([]uuid.UUID, len(oldIDs))
+	for i, id := range oldIDs {
+		newIDs[i] = uuid.NewV4()
+		copies[id] = newIDs[i]
+	}
+	newParents := make([]*uuid.UUID, len(oldIDs))
+	for i, id := range oldIDs[1:] {
+		newParent := copies[*parents[id]]
+		newParents[i+1] = &newParent
+	}
+	return newIDs, newParents, nil
+}
+
+// noteParents returns the parent of each of the notes
+func noteParents(tx dbtx, ids []uuid.UUID) (map[uuid.UUID]*uuid.UUID, error) {
+	rows, err := tx.Query(context.Background(), "SELECT id, parent FROM notes WHERE id = ANY($1::uuid[])", ids)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	parents := make(map[uuid.UUID]*uuid.UUID, len(ids))
+	for rows.Next() {
+		var id uuid.UUID
+		var parent *uuid.UUID
+		if err := rows.Scan(&id, &parent); err != nil {
+			return nil, err
+		}
+		parents[id] = parent
+	}
+	return parents, rows.Err()
+}
@@ -0,0 +1,197 @@
+package notes
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5/pgxpool"
+	uuid "github.com/satori/go.uuid"
+)
+
+const (
+	// eventsChannel is the Postgres notification channel note changes are
+	// published on, see init-scripts/17_note_events.sql
+	eventsChannel = "note_events"
+
+	// eventBuffer is how many events a slow stream may fall behind before
+	// events are dropped and it is told to resync
+	eventBuffer = 64
+
+	// eventHeartbeat is how often idle streams get a comment, which keeps
+	// proxies from closing them
+	eventHeartbeat = 25 * time.Second
+)
+
+// NoteEvent is a change to one of the user's notes. Kind is created,
+// updated, moved or deleted, as in the change feed.
+type NoteEvent struct {
+	NoteID  uuid.UUID `json:"note_id"`
+	Kind    string    `json:"kind"`
+	Version *int64    `json:"version"`
+	Seq     int64     `json:"seq"`
+}
+
+// notification is the payload of a note_events notification
+type notification struct {
+	UserID string `json:"user_id"`
+	NoteEvent
+}
+
+// subscriber is one open event stream. resync is signalled when events for
+// it were lost.
+type subscriber struct {
+	events chan NoteEvent
+	resync chan struct{}
+}
+
+// eventHub passes the notifications received by this server on to the
+// streams of their users
+type eventHub struct {
+	mu          sync.Mutex
+	subscribers map[string]map[*subscriber]bool
+}
+
+var hub = &eventHub{subscribers: make(map[string]map[*subscriber]bool)}
+
+func (h *eventHub) subscribe(userID string) *subscriber {
+	s := &subscriber{events: make(chan NoteEvent, eventBuffer), resync: make(chan struct{}, 1)}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subscribers[userID] == nil {
+		h.subscribers[userID] = make(map[*subscriber]bool)
+	}
+	h.subscribers[userID][s] = true
+	return s
+}
+
+func (h *eventHub) unsubscribe(userID string, s *subscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subscribers[userID], s)
+	if len(h.subscribers[userID]) == 0 {
+		delete(h.subscribers, userID)
+	}
+}
+
+// publish sends an event to the user's streams without waiting for them
+func (h *eventHub) publish(userID string, event NoteEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for s := range h.subscribers[userID] {
+		select {
+		case s.events <- event:
+		default:
+			s.signalResync()
+		}
+	}
+}
+
+// resyncAll tells every stream that events may have been lost
+func (h *eventHub) resyncAll() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, subscribers := range h.subscribers {
+		for s := range subscribers {
+			s.signalResync()
+		}
+	}
+}
+
+func (s *subscriber) signalResync() {
+	select {
+	case s.resync <- struct{}{}:
+	default:
+	}
+}
+
+// StartEventListener listens for note change notifications on a dedicated
+// connection and passes them on to the open event streams, and collaborative
+// edits on to the shared notes open here, until ctx is cancelled. Lost
+// connections are reopened, after which every stream is told to resync.
+func StartEventListener(ctx context.Context, db *pgxpool.Pool) {
+	for {
+		err := listen(ctx, db)
+		if ctx.Err() != nil {
+			return
+		}
+		fmt.Fprintf(os.Stderr, "Note event listener failed: %v\n", err)
+		hub.resyncAll()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+// listen receives notifications until the connection fails
+func listen(ctx context.Context, db *pgxpool.Pool) error {
+	pooled, err := db.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	// A listening connection must not be reused, so it is taken out of the pool
+	conn := pooled.Hijack()
+	defer conn.Close(context.Background())
+
+	if _, err := conn.Exec(ctx, "LISTEN "+eventsChannel+"; LISTEN "+collabChannel); err != nil {
+		return err
+	}
+	for {
+		received, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		if received.Channel == collabChannel {
+			go relayCollab(db, received.Payload)
+			continue
+		}
+		var n notification
+		if err := json.Unmarshal([]byte(received.Payload), &n); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid note event %q: %v\n", received.Payload, err)
+			continue
+		}
+		hub.publish(n.UserID, n.NoteEvent)
+	}
+}
+
+// StreamEvents streams changes to the user's notes as Server-Sent Events
+// until the client disconnects. Each change is a note event. A resync event
+// means changes may have been missed and the client should read the change
+// feed from its last cursor.
+func StreamEvents(c *gin.Context) {
+	userID := c.GetString("user_id")
+
+	s := hub.subscribe(userID)
+	defer hub.unsubscribe(userID, s)
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	// Stops nginx from buffering the stream
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(200)
+	c.Writer.WriteString("retry: 3000\n\n")
+	c.Writer.Flush()
+
+	heartbeat := time.NewTicker(eventHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case event := <-s.events:
+			c.SSEvent("note", event)
+		case <-s.resync:
+			c.SSEvent("resync", gin.H{})
+		case <-heartbeat.C:
+			c.Writer.WriteString(": ping\n\n")
+		}
+		c.Writer.Flush()
+	}
+}
@@ -0,0 +1,302 @@
+package notes
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5/pgxpool"
+	uuid "github.com/satori/go.uuid"
+)
+
+const (
+	// maxGraphNodes is the most notes returned in a graph, the most
+	// recently updated are kept
+	maxGraphNodes = 2000
+
+	// maxTagGroup is the most notes a tag may have to produce edges. Tags
+	// shared by more notes connect nearly everything and say little.
+	maxTagGroup = 50
+
+	// similarCandidates is how many of its nearest notes are looked at for
+	// each note's similar edges, before keeping the ones in the graph. The
+	// vector index returns no more than hnsw.ef_search rows, 40 by default.
+	similarCandidates = 40
+)
+
+// Graph edge types
+const (
+	edgeParent  = "parent"
+	edgeLink    = "link"
+	edgeTag     = "tag"
+	edgeSimilar = "similar"
+)
+
+// GraphNode is a note in the graph
+type GraphNode struct {
+	ID     uuid.UUID  `json:"id"`
+	Title  string     `json:"title"`
+	Parent *uuid.UUID `json:"parent"`
+	Tags   []NoteTag  `json:"tags,omitempty"`
+}
+
+// GraphEdge connects two notes. Parent edges go from parent to child and
+// link edges from the linking note to the linked one. Tag edges list the tag
+// paths both notes have and similar edges the normalized distance between
+// their embeddings.
+type GraphEdge struct {
+	Source   uuid.UUID  `json:"source"`
+	Target   uuid.UUID  `json:"target"`
+	Type     string     `json:"type"`
+	Tags     [][]string `json:"tags,omitempty"`
+	Distance float64    `json:"distance,omitempty"`
+}
+
+// GetGraph returns the user's notes as nodes and the typed edges between
+// them. root limits the graph to a note and its subtree and types to a comma
+// separated list of parent, link, tag and similar edges. Similar edges join
+// each note to at most neighbors notes within distance. The root may be a
+// note shared with the user.
+func GetGraph(c *gin.Context) {
+	userID := c.GetString("user_id")
+	db := c.MustGet("db").(*pgxpool.Pool)
+
+	types := map[string]bool{edgeParent: true, edgeLink: true, edgeTag: true, edgeSimilar: true}
+	if typesStr := c.Query("types"); typesStr != "" {
+		types = make(map[string]bool)
+		for _, edgeType := range strings.Split(typesStr, ",") {
+			edgeType = strings.TrimSpace(edgeType)
+			switch edgeType {
+			case edgeParent, edgeLink, edgeTag, edgeSimilar:
+				types[edgeType] = true
+			default:
+				c.JSON(400, gin.H{"error": "Invalid edge type, expected parent, link, tag or similar"})
+				return
+			}
+		}
+	}
+
+	distance := DefaultDistance
+	if distanceStr := c.Query("distance"); distanceStr != "" {
+		d, err := strconv.ParseFloat(distanceStr, 64)
+		if err != nil || d <= 0 {
+			c.JSON(400, gin.H{"error": "Invalid distance threshold"})
+			return
+		}
+		distance = d
+	}
+
+	neighbors := 5
+	if neighborsStr := c.Query("neighbors"); neighborsStr != "" {
+		n, err := strconv.Atoi(neighborsStr)
+		if err != nil || n <= 0 || n > 20 {
+			c.JSON(400, gin.H{"error": "Invalid neighbors, expected 1 to 20"})
+			return
+		}
+		neighbors = n
+	}
+
+	scope := "n.user_id = $1 AND " + notTrashed("n", "$1")
+	args := []interface{}{userID}
+	if rootID := c.Query("root"); rootID != "" {
+		// A root shared with the user scopes the graph to its owner's notes
+		access, ok := AuthorizeNote(c, db, rootID, RoleViewer)
+		if !ok {
+			return
+		}
+		args[0] = access.OwnerID
+		scope = `n.user_id = $1 AND n.id IN (
+			WITH RECURSIVE subtree AS (
+				SELECT id FROM notes WHERE id = $2
+				UNION ALL
+				SELECT c.id FROM notes c
+				INNER JOIN subtree s ON c.parent = s.id
+				WHERE c.user_id = $1 AND c.deleted_at IS NULL
+			)
+			SELECT id FROM subtree
+		)`
+		args = append(args, rootID)
+	}
+
+	rows, err := db.Query(context.Background(),
+		"SELECT n.id, COALESCE(n.title, ''), n.parent, COALESCE(n.tags, '[]'::jsonb) FROM notes n WHERE "+scope+
+			" ORDER BY n.updated_at DESC, n.id LIMIT "+strconv.Itoa(maxGraphNodes+1), args...)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	nodes := []GraphNode{}
+	for rows.Next() {
+		var node GraphNode
+		if err := rows.Scan(&node.ID, &node.Title, &node.Parent, &node.Tags); err != nil {
+			rows.Close()
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		nodes = append(nodes, node)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	truncated := len(nodes) > maxGraphNodes
+	if truncated {
+		nodes = nodes[:maxGraphNodes]
+	}
+	ids := make([]uuid.UUID, len(nodes))
+	inGraph := make(map[uuid.UUID]bool, len(nodes))
+	for i, node := range nodes {
+		ids[i] = node.ID
+		inGraph[node.ID] = true
+	}
+
+	edges := []GraphEdge{}
+	if types[edgeParent] {
+		for _, node := range nodes {
+			if node.Parent != nil && inGraph[*node.Parent] {
+				edges = append(edges, GraphEdge{Source: *node.Parent, Target: node.ID, Type: edgeParent})
+			}
+		}
+	}
+	if types[edgeTag] {
+		edges = append(edges, tagEdges(nodes)...)
+	}
+	if types[edgeLink] {
+		linkEdges, err := graphLinkEdges(db, ids)
+		if err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		edges = append(edges, linkEdges...)
+	}
+	if types[edgeSimilar] {
+		similarEdges, err := graphSimilarEdges(db, ids, distance, neighbors)
+		if err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		edges = append(edges, similarEdges...)
+	}
+
+	c.JSON(200, gin.H{
+		"nodes":     nodes,
+		"edges":     edges,
+		"truncated": truncated,
+	})
+}
+
+// tagEdges joins every pair of notes that have a tag path in common, once
+// per pair
+func tagEdges(nodes []GraphNode) []GraphEdge {
+	groups := make(map[string][]uuid.UUID)
+	paths := make(map[string][]string)
+	var keys []string
+	for _, node := range nodes {
+		seen := make(map[string]bool)
+		for _, tag := range node.Tags {
+			key := strings.Join(tag.Path, "/")
+			if len(tag.Path) == 0 || seen[key] {
+				continue
+			}
+			seen[key] = true
+			if groups[key] == nil {
+				keys = append(keys, key)
+				paths[key] = tag.Path
+			}
+			groups[key] = append(groups[key], node.ID)
+		}
+	}
+
+	type pair struct{ a, b uuid.UUID }
+	shared := make(map[pair]int)
+	edges := []GraphEdge{}
+	for _, key := range keys {
+		group := groups[key]
+		if len(group) > maxTagGroup {
+			continue
+		}
+		for i := range group {
+			for j := i + 1; j < len(group); j++ {
+				p := pair{group[i], group[j]}
+				if index, ok := shared[p]; ok {
+					edges[index].Tags = append(edges[index].Tags, paths[key])
+					continue
+				}
+				shared[p] = len(edges)
+				edges = append(edges, GraphEdge{Source: p.a, Target: p.b, Type: edgeTag, Tags: [][]string{paths[key]}})
+			}
+		}
+	}
+	return edges
+}
+
+// graphLinkEdges returns the links between the notes
+func graphLinkEdges(db *pgxpool.Pool, ids []uuid.UUID) ([]GraphEdge, error) {
+	rows, err := db.Query(context.Background(),
+		"SELECT source_id, target_id FROM note_links WHERE source_id = ANY($1::uuid[]) AND target_id = ANY($1::uuid[])", ids)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	edges := []GraphEdge{}
+	for rows.Next() {
+		edge := GraphEdge{Type: edgeLink}
+		if err := rows.Scan(&edge.Source, &edge.Target); err != nil {
+			return nil, err
+		}
+		edges = append(edges, edge)
+	}
+	return edges, rows.Err()
+}
+
+// graphSimilarEdges joins each note to its nearest neighbours among the
+// notes by embedding, once per pair. Neighbours are taken from each note's
+// similarCandidates nearest notes, picked by distance alone so the vector
+// index can serve them.
+func graphSimilarEdges(db *pgxpool.Pool, ids []uuid.UUID, distance float64, neighbors int) ([]GraphEdge, error) {
+	metric := CurrentDistanceMetric()
+	distanceExpr := metric.Distance("b.embedding", "a.embedding")
+	rows, err := db.Query(context.Background(), `
+		SELECT a.id, nearest.id, `+metric.Normalize("nearest.distance")+`
+		FROM notes a
+		CROSS JOIN LATERAL (
+			SELECT candidate.id, candidate.distance
+			FROM (
+				SELECT b.id, `+distanceExpr+` AS distance
+				FROM notes b
+				WHERE b.user_id = a.user_id AND b.embedding IS NOT NULL
+				ORDER BY `+distanceExpr+`
+				LIMIT $4
+			) candidate
+			WHERE candidate.id = ANY($1::uuid[]) AND candidate.id <> a.id AND candidate.distance < $2
+			ORDER BY candidate.distance
+			LIMIT $3
+		) nearest
+		WHERE a.id = ANY($1::uuid[]) AND a.embedding IS NOT NULL`,
+		ids, metric.Threshold(distance), neighbors, similarCandidates)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	type pair struct{ a, b uuid.UUID }
+	seen := make(map[pair]bool)
+	edges := []GraphEdge{}
+	for rows.Next() {
+		edge := GraphEdge{Type: edgeSimilar}
+		if err := rows.Scan(&edge.Source, &edge.Target, &edge.Distance); err != nil {
+			return nil, err
+		}
+		// Distance is symmetric, so each pair is reported once
+		if seen[pair{edge.Target, edge.Source}] {
+			continue
+		}
+		seen[pair{edge.Source, edge.Target}] = true
+		edges = append(edges, edge)
+	}
+	return edges, rows.Err()
+}
@@ -0,0 +1,236 @@
+package notes
+
+import (
+	"context"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5/pgxpool"
+	uuid "github.com/satori/go.uuid"
+	"github.com/stevecastle/modelpad/markdown"
+)
+
+// minMentionLength is the shortest title searched for as an unlinked mention,
+// shorter titles match too much text to be useful
+const minMentionLength = 3
+
+// saveLinks replaces the links recorded for a note with the note links in
+// its body. Bodies that are not JSON have no links.
+func saveLinks(tx dbtx, noteID uuid.UUID, body string) error {
+	_, err := tx.Exec(context.Background(), "DELETE FROM note_links WHERE source_id = $1", noteID)
+	if err != nil {
+		return err
+	}
+
+	links, err := markdown.NoteLinks(body)
+	if err != nil {
+		return nil
+	}
+	targets := []uuid.UUID{}
+	for _, link := range links {
+		if target, err := uuid.FromString(link); err == nil && target != noteID {
+			targets = append(targets, target)
+		}
+	}
+	if len(targets) == 0 {
+		return nil
+	}
+
+	_, err = tx.Exec(context.Background(),
+		"INSERT INTO note_links (source_id, target_id) SELECT $1, unnest($2::uuid[]) ON CONFLICT DO NOTHING",
+		noteID, targets)
+	return err
+}
+
+// copyLinks records the same links for copies of notes as for the originals.
+// Links between the copied notes point at the copies.
+func copyLinks(tx dbtx, oldIDs []uuid.UUID, newIDs []uuid.UUID) error {
+	_, err := tx.Exec(context.Background(), `
+		INSERT INTO note_links (source_id, target_id)
+		SELECT s.new_id, COALESCE(t.new_id, l.target_id)
+		FROM unnest($1::uuid[], $2::uuid[]) AS s(old_id, new_id)
+		INNER JOIN note_links l ON l.source_id = s.old_id
+		LEFT JOIN unnest($1::uuid[], $2::uuid[]) AS t(old_id, new_id) ON t.old_id = l.target_id
+		ON CONFLICT DO NOTHING`, oldIDs, newIDs)
+	return err
+}
+
+// GetBacklinks returns a page of the notes that link to a note, most
+// recently updated first
+func GetBacklinks(c *gin.Context) {
+	userID := c.GetString("user_id")
+	noteID := c.Param("id")
+	db := c.MustGet("db").(*pgxpool.Pool)
+
+	access, ok := AuthorizeNote(c, db, noteID, RoleViewer)
+	if !ok {
+		return
+	}
+
+	params := pageParams(c)
+	params.Fields = []string{"id", "title", "parent", "created_at", "updated_at", "is_shared", "tags", "has_children"}
+
+	q := NewQuery("notes").SelectNote("notes", params.Fields)
+	filterNotes(q, access.OwnerID, SearchParams{}, "notes")
+	readableBy(q, "notes", access, userID)
+	q.Where("notes.id IN (SELECT source_id FROM note_links WHERE target_id = "+q.Arg(noteID)+")").
+		Select("left(COALESCE(notes.markdown, ''), 1000) AS snippet").
+		OrderBy("notes.updated_at DESC", "notes.id")
+
+	backlinks, totalCount, err := runSearch(q, params, c, func(note *Note) []interface{} {
+		return []interface{}{&note.Snippet}
+	})
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	if backlinks == nil {
+		backlinks = []Note{}
+	}
+	for i := range backlinks {
+		backlinks[i].Snippet = snippet(backlinks[i].Snippet, snippetLength)
+	}
+
+	c.JSON(200, gin.H{
+		"notes": backlinks,
+		"pagination": PaginationInfo{
+			Page:    params.Page,
+			Limit:   params.Limit,
+			Total:   totalCount,
+			HasMore: params.Page*params.Limit < totalCount,
+		},
+	})
+}
+
+// GetUnlinkedMentions returns a page of the notes whose text contains a
+// note's title without linking to it, with a snippet around the mention
+func GetUnlinkedMentions(c *gin.Context) {
+	userID := c.GetString("user_id")
+	noteID := c.Param("id")
+	db := c.MustGet("db").(*pgxpool.Pool)
+
+	access, ok := AuthorizeNote(c, db, noteID, RoleViewer)
+	if !ok {
+		return
+	}
+	note, err := getNote(db, noteID, access.OwnerID)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	params := pageParams(c)
+	title := strings.TrimSpace(note.Title)
+	if utf8.RuneCountInString(title) < minMentionLength {
+		c.JSON(200, gin.H{
+			"notes":      []Note{},
+			"pagination": PaginationInfo{Page: params.Page, Limit: params.Limit},
+		})
+		return
+	}
+	params.Fields = []string{"id", "title", "parent", "created_at", "updated_at", "is_shared", "tags", "has_children"}
+
+	q := NewQuery("notes").SelectNote("notes", params.Fields)
+	filterNotes(q, access.OwnerID, SearchParams{}, "notes")
+	readableBy(q, "notes", access, userID)
+	target := q.Arg(noteID)
+	q.Where(
+		"notes.id <> "+target,
+		"strpos(lower(COALESCE(notes.markdown, '')), lower("+q.Arg(title)+")) > 0",
+		"notes.id NOT IN (SELECT source_id FROM note_links WHERE target_id = "+target+")",
+	).
+		Select("COALESCE(notes.markdown, '') AS snippet").
+		OrderBy("notes.updated_at DESC", "notes.id")
+
+	mentions, totalCount, err := runSearch(q, params, c, func(note *Note) []interface{} {
+		return []interface{}{&note.Snippet}
+	})
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	if mentions == nil {
+		mentions = []Note{}
+	}
+	for i := range mentions {
+		mentions[i].Snippet = mentionSnippet(mentions[i].Snippet, title, snippetLength)
+	}
+
+	c.JSON(200, gin.H{
+		"notes": mentions,
+		"pagination": PaginationInfo{
+			Page:    params.Page,
+			Limit:   params.Limit,
+			Total:   totalCount,
+			HasMore: params.Page*params.Limit < totalCount,
+		},
+	})
+}
+
+// mentionSnippet shortens markdown to at most n characters around the first
+// mention of title
+func mentionSnippet(markdown string, title string, n int) string {
+	runes := []rune(strings.Join(strings.Fields(markdown), " "))
+	lower := []rune(strings.ToLower(string(runes)))
+	if len(lower) != len(runes) {
+		return snippet(markdown, n)
+	}
+	at := strings.Index(string(lower), strings.ToLower(title))
+	if at < 0 {
+		return snippet(markdown, n)
+	}
+
+	// Start a third of the way before the mention
+	start := utf8.RuneCountInString(string(lower)[:at]) - n/3
+	if start <= 0 {
+		return snippet(string(runes), n)
+	}
+	return "…" + snippet(string(runes[start:]), n)
+}
+
+// SharedNoteURLs returns the /doc URLs of the notes linked from a body that
+// can be viewed publicly, keyed by the ids the links use
+func SharedNoteURLs(db *pgxpool.Pool, body string) (map[string]string, error) {
+	urls := make(map[string]string)
+	links, err := markdown.NoteLinks(body)
+	if err != nil || len(links) == 0 {
+		return urls, nil
+	}
+
+	ids := make(map[string]uuid.UUID)
+	targets := []uuid.UUID{}
+	for _, link := range links {
+		if target, err := uuid.FromString(link); err == nil {
+			ids[link] = target
+			targets = append(targets, target)
+		}
+	}
+
+	rows, err := db.Query(context.Background(),
+		"SELECT n.id FROM notes n WHERE n.id = ANY($1::uuid[]) AND n.is_shared = true AND "+notTrashed("n", "n.user_id"),
+		targets)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	shared := make(map[uuid.UUID]bool)
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		shared[id] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for link, id := range ids {
+		if shared[id] {
+			urls[link] = "/doc/" + id.String()
+		}
+	}
+	return urls, nil
+}
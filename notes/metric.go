@@ -0,0 +1,154 @@
+package notes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// DefaultDistance is the default search threshold in normalized units. It is
+// equivalent to the L2 distance of 0.8 search used before the metric became
+// configurable.
+const DefaultDistance = 0.32
+
+// DistanceMetric is a pgvector distance operator. Thresholds and distances
+// returned to clients are normalized to cosine distance (1 - cosine
+// similarity, from 0 to 2) so they mean the same thing whichever metric is
+// configured. Embeddings are unit length, which makes the conversions exact.
+type DistanceMetric struct {
+	Name     string
+	Operator string
+	OpsClass string
+}
+
+var (
+	MetricCosine       = DistanceMetric{Name: "cosine", Operator: "<=>", OpsClass: "vector_cosine_ops"}
+	MetricInnerProduct = DistanceMetric{Name: "inner_product", Operator: "<#>", OpsClass: "vector_ip_ops"}
+	MetricL2           = DistanceMetric{Name: "l2", Operator: "<->", OpsClass: "vector_l2_ops"}
+)
+
+// ParseDistanceMetric looks up a metric by name
+func ParseDistanceMetric(name string) (DistanceMetric, error) {
+	for _, metric := range []DistanceMetric{MetricCosine, MetricInnerProduct, MetricL2} {
+		if metric.Name == name {
+			return metric, nil
+		}
+	}
+	return DistanceMetric{}, fmt.Errorf("unknown distance metric %q, expected cosine, inner_product or l2", name)
+}
+
+// distanceMetric is the configured metric, see LoadDistanceMetric
+var distanceMetric = MetricL2
+
+// LoadDistanceMetric reads the metric from VECTOR_DISTANCE_METRIC. It
+// defaults to l2, the metric searches used before it became configurable,
+// and fails on unknown names so a typo cannot silently change results.
+func LoadDistanceMetric() error {
+	name := os.Getenv("VECTOR_DISTANCE_METRIC")
+	if name == "" {
+		return nil
+	}
+	metric, err := ParseDistanceMetric(name)
+	if err != nil {
+		return err
+	}
+	distanceMetric = metric
+	return nil
+}
+
+// CurrentDistanceMetric returns the metric loaded by LoadDistanceMetric
+func CurrentDistanceMetric() DistanceMetric {
+	return distanceMetric
+}
+
+// Distance returns the SQL expression for the native distance between two
+// vector expressions. Order by this expression so the vector index is used.
+func (m DistanceMetric) Distance(left string, right string) string {
+	return left + " " + m.Operator + " " + right
+}
+
+// Threshold converts a normalized threshold to the metric's native units
+func (m DistanceMetric) Threshold(normalized float64) float64 {
+	switch m.Name {
+	case MetricL2.Name:
+		return math.Sqrt(2 * normalized)
+	case MetricInnerProduct.Name:
+		// <#> returns the negated inner product
+		return normalized - 1
+	}
+	return normalized
+}
+
+// Normalize wraps a native distance expression so it yields normalized units
+func (m DistanceMetric) Normalize(expr string) string {
+	switch m.Name {
+	case MetricL2.Name:
+		return "(power(" + expr + ", 2) / 2)"
+	case MetricInnerProduct.Name:
+		return "(1 + " + expr + ")"
+	}
+	return expr
+}
+
+// EnsureVectorIndex creates the approximate nearest neighbour index for the
+// configured metric when the migrations have not already created it. The
+// index type is taken from VECTOR_INDEX_TYPE, hnsw or ivfflat. An index left
+// invalid by an interrupted build is dropped and built again.
+func EnsureVectorIndex(ctx context.Context, db *pgxpool.Pool) error {
+	metric := CurrentDistanceMetric()
+	method := os.Getenv("VECTOR_INDEX_TYPE")
+	if method == "" {
+		method = "hnsw"
+	}
+
+	var options string
+	switch method {
+	case "hnsw":
+		options = "WITH (m = 16, ef_construction = 64)"
+	case "ivfflat":
+		options = "WITH (lists = 100)"
+	default:
+		return fmt.Errorf("unknown vector index type %q, expected hnsw or ivfflat", method)
+	}
+
+	// Vector indexes need a fixed number of dimensions, which migration 06
+	// leaves unset when stored embeddings have mixed dimensions
+	var dimensions int
+	err := db.QueryRow(ctx,
+		"SELECT atttypmod FROM pg_attribute WHERE attrelid = 'public.notes'::regclass AND attname = 'embedding'").Scan(&dimensions)
+	if err != nil {
+		return err
+	}
+	if dimensions == -1 {
+		return fmt.Errorf("notes.embedding has no fixed dimensions, remove embeddings of other sizes and run migration 06")
+	}
+
+	name := fmt.Sprintf("idx_notes_embedding_%s_%s", method, metric.Name)
+	var valid bool
+	err = db.QueryRow(ctx, `
+		SELECT i.indisvalid FROM pg_index i
+		INNER JOIN pg_class c ON c.oid = i.indexrelid
+		WHERE c.relname = $1 AND c.relnamespace = 'public'::regnamespace`, name).Scan(&valid)
+	if err == nil && valid {
+		return nil
+	}
+	if err == nil {
+		// CREATE INDEX CONCURRENTLY leaves the index behind when it fails,
+		// and IF NOT EXISTS would skip it from then on
+		if _, err := db.Exec(ctx, "DROP INDEX CONCURRENTLY IF EXISTS public."+name); err != nil {
+			return err
+		}
+	} else if !errors.Is(err, pgx.ErrNoRows) {
+		return err
+	}
+
+	_, err = db.Exec(ctx, fmt.Sprintf(
+		"CREATE INDEX CONCURRENTLY IF NOT EXISTS %s ON public.notes USING %s (embedding %s) %s",
+		name, method, metric.OpsClass, options))
+	return err
+}
@@ -0,0 +1,222 @@
+package notes
+
+import (
+	"context"
+	"errors"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	uuid "github.com/satori/go.uuid"
+	"github.com/stevecastle/modelpad/fractional"
+)
+
+// siblingPosition returns a position for a note placed under parent, right
+// after the sibling after or right before the sibling before. With neither
+// the note goes after the last sibling. The note itself is ignored so it can
+// be moved within its own siblings.
+func siblingPosition(tx dbtx, userID string, noteID *uuid.UUID, parent *uuid.UUID, after *uuid.UUID, before *uuid.UUID) (string, error) {
+	siblings := "user_id = $1 AND parent IS NOT DISTINCT FROM $2 AND id IS DISTINCT FROM $3 AND deleted_at IS NULL AND position IS NOT NULL"
+
+	var low, high string
+	var err error
+	switch {
+	case after != nil:
+		err = tx.QueryRow(context.Background(),
+			"SELECT position FROM notes WHERE "+siblings+" AND id = $4", userID, parent, noteID, after).Scan(&low)
+		if err != nil {
+			return "", err
+		}
+		err = tx.QueryRow(context.Background(),
+			"SELECT COALESCE(MIN(position), '') FROM notes WHERE "+siblings+" AND position > $4", userID, parent, noteID, low).Scan(&high)
+	case before != nil:
+		err = tx.QueryRow(context.Background(),
+			"SELECT position FROM notes WHERE "+siblings+" AND id = $4", userID, parent, noteID, before).Scan(&high)
+		if err != nil {
+			return "", err
+		}
+		err = tx.QueryRow(context.Background(),
+			"SELECT COALESCE(MAX(position), '') FROM notes WHERE "+siblings+" AND position < $4", userID, parent, noteID, high).Scan(&low)
+	default:
+		err = tx.QueryRow(context.Background(),
+			"SELECT COALESCE(MAX(position), '') FROM notes WHERE "+siblings, userID, parent, noteID).Scan(&low)
+	}
+	if err != nil {
+		return "", err
+	}
+	return fractional.KeyBetween(low, high)
+}
+
+// Errors of note operations, worded for clients
+var (
+	errNoteNotFound   = errors.New("Note not found or you don't have permission to modify it")
+	errParentNotFound = errors.New("Parent note not found or you don't have permission to access it")
+	errCircularParent = errors.New("Cannot set parent: would create circular reference")
+	errNotSibling     = errors.New("The note to place next to is not a sibling under the new parent")
+)
+
+// operationStatus is the response status for an error of a note operation
+func operationStatus(err error) int {
+	switch {
+	case errors.Is(err, errNoteNotFound):
+		return 404
+	case errors.Is(err, errParentNotFound), errors.Is(err, errCircularParent), errors.Is(err, errNotSibling):
+		return 400
+	case errors.Is(err, errForbidden):
+		return 403
+	}
+	return 500
+}
+
+// moveNote sets the parent of a note the user can edit and places it after
+// or before a sibling, or last. It returns the note's new position.
+func moveNote(tx dbtx, userID string, noteID uuid.UUID, parent *uuid.UUID, after *uuid.UUID, before *uuid.UUID) (string, error) {
+	access, err := Authorize(tx, noteID.String(), userID, RoleEditor)
+	if err != nil {
+		return "", err
+	}
+	return placeNote(tx, userID, access.OwnerID, noteID, parent, after, before)
+}
+
+// placeNote moves a note of owner like moveNote, without checking the user
+// can edit the note itself. The user must be able to edit the new parent,
+// and only the owner may move notes to the root.
+func placeNote(tx dbtx, userID string, owner string, noteID uuid.UUID, parent *uuid.UUID, after *uuid.UUID, before *uuid.UUID) (string, error) {
+	if parent == nil && userID != owner {
+		return "", errForbidden
+	}
+	if parent != nil {
+		if err := checkParent(tx, userID, owner, noteID, *parent); err != nil {
+			return "", err
+		}
+	}
+
+	position, err := siblingPosition(tx, owner, &noteID, parent, after, before)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", errNotSibling
+	}
+	if err != nil {
+		return "", err
+	}
+
+	_, err = tx.Exec(context.Background(),
+		"UPDATE notes SET parent = $1, position = $2, updated_at = now(), version = version + 1 WHERE id = $3 AND user_id = $4",
+		parent, position, noteID, owner)
+	return position, err
+}
+
+// checkParent verifies a note of owner can be put under parent: the parent
+// must be one of the owner's notes the user can edit, and not the note or
+// one of its descendants
+func checkParent(tx dbtx, userID string, owner string, noteID uuid.UUID, parent uuid.UUID) error {
+	parentAccess, err := Authorize(tx, parent.String(), userID, RoleEditor)
+	if errors.Is(err, errNoteNotFound) || (err == nil && parentAccess.OwnerID != owner) {
+		return errParentNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	// Check for circular reference (prevent setting parent to a descendant)
+	var wouldCreateCycle bool
+	err = tx.QueryRow(context.Background(), `
+		WITH RECURSIVE note_hierarchy AS (
+			SELECT id, parent FROM notes WHERE id = $1 AND user_id = $3
+			UNION ALL
+			SELECT n.id, n.parent FROM notes n
+			INNER JOIN note_hierarchy nh ON n.parent = nh.id
+			WHERE n.user_id = $3
+		)
+		SELECT EXISTS(SELECT 1 FROM note_hierarchy WHERE id = $2)
+	`, noteID, parent, owner).Scan(&wouldCreateCycle)
+	if err != nil {
+		return err
+	}
+	if wouldCreateCycle {
+		return errCircularParent
+	}
+	return nil
+}
+
+// parseOptionalUUID parses an optional id where null and "" mean none
+func parseOptionalUUID(value *string) (*uuid.UUID, error) {
+	if value == nil || *value == "" {
+		return nil, nil
+	}
+	parsed, err := uuid.FromString(*value)
+	if err != nil {
+		return nil, err
+	}
+	return &parsed, nil
+}
+
+// MoveNote sets the parent of a note and its position among its new
+// siblings. The body names the parent, null for the root, and optionally the
+// sibling to place the note after or before. Without either the note is
+// placed last.
+func MoveNote(c *gin.Context) {
+	userID := c.GetString("user_id")
+
+	noteUUID, err := uuid.FromString(c.Param("id"))
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Invalid note ID"})
+		return
+	}
+
+	var requestBody struct {
+		Parent *string `json:"parent"`
+		After  *string `json:"after"`
+		Before *string `json:"before"`
+	}
+	if err := c.ShouldBindJSON(&requestBody); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if requestBody.After != nil && requestBody.Before != nil {
+		c.JSON(400, gin.H{"error": "Give either after or before, not both"})
+		return
+	}
+
+	parentUUID, err := parseOptionalUUID(requestBody.Parent)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Invalid parent ID"})
+		return
+	}
+	afterUUID, err := parseOptionalUUID(requestBody.After)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Invalid after ID"})
+		return
+	}
+	beforeUUID, err := parseOptionalUUID(requestBody.Before)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Invalid before ID"})
+		return
+	}
+
+	db := c.MustGet("db").(*pgxpool.Pool)
+
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback(context.Background())
+
+	position, err := moveNote(tx, userID, noteUUID, parentUUID, afterUUID, beforeUUID)
+	if err != nil {
+		c.JSON(operationStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	err = tx.Commit(context.Background())
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"message":  "Note moved",
+		"parent":   parentUUID,
+		"position": position,
+	})
+}
@@ -3,6 +3,8 @@ package notes
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -22,7 +24,12 @@ import (
 //     body TEXT,
 //     user_id UUID,
 //     created_at TIMESTAMP WITHOUT TIME ZONE DEFAULT now(),
-//     updated_at TIMESTAMP WITHOUT TIME ZONE DEFAULT now()
+//     updated_at TIMESTAMP WITHOUT TIME ZONE DEFAULT now(),
+//     name TEXT,
+//     encoding TEXT NOT NULL DEFAULT 'plain',
+//     data BYTEA,
+//     keyframe_id UUID REFERENCES revisions(id),
+//     size INTEGER
 // );
 
 //Schema
@@ -42,19 +49,29 @@ type NoteTag struct {
 }
 
 type Note struct {
-	ID           uuid.UUID       `json:"id"`
-	Title        string          `json:"title"`
-	Body         string          `json:"body"`
-	Embedding    pgvector.Vector `json:"-"`
-	UserId       uuid.UUID       `json:"user_id"`
-	Parent       *uuid.UUID      `json:"parent"`
-	CreatedAt    time.Time       `json:"created_at"`
-	UpdatedAt    time.Time       `json:"updated_at"`
-	Distance     float64         `json:"distance"`
-	IsShared     bool            `json:"is_shared"`
-	Tags         []NoteTag       `json:"tags,omitempty"`
-	HasChildren  bool            `json:"has_children"`
-	HasEmbedding bool            `json:"has_embedding"`
+	ID              uuid.UUID       `json:"id"`
+	Title           string          `json:"title"`
+	Body            string          `json:"body"`
+	Embedding       pgvector.Vector `json:"-"`
+	UserId          uuid.UUID       `json:"user_id"`
+	Parent          *uuid.UUID      `json:"parent"`
+	CreatedAt       time.Time       `json:"created_at"`
+	UpdatedAt       time.Time       `json:"updated_at"`
+	Version         int64           `json:"version"`
+	Position        string          `json:"position,omitempty"`
+	Distance        float64         `json:"distance"`
+	IsShared        bool            `json:"is_shared"`
+	IsTemplate      bool            `json:"is_template"`
+	Tags            []NoteTag       `json:"tags,omitempty"`
+	HasChildren     bool            `json:"has_children"`
+	HasEmbedding    bool            `json:"has_embedding"`
+	Score           float64         `json:"score,omitempty"`
+	Highlight       string          `json:"highlight,omitempty"`
+	Snippet         string          `json:"snippet,omitempty"`
+	Branch          string          `json:"branch,omitempty"`
+	DeletedAt       *time.Time      `json:"deleted_at,omitempty"`
+	DescendantCount int             `json:"descendant_count,omitempty"`
+	Role            string          `json:"role,omitempty"`
 }
 
 type PaginationInfo struct {
@@ -64,206 +81,181 @@ type PaginationInfo struct {
 	HasMore bool `json:"has_more"`
 }
 
-func RagSearch(text string, userID string, distance float64, parentFilter *string, page int, limit int, c *gin.Context) ([]Note, int, error) {
-	var vector pgvector.Vector
-	var notes []Note
-	if text != "" {
-		embedding, err := embeddings.CreateEmbedding(text)
+// SearchParams describes a note listing or search
+type SearchParams struct {
+	Text          string
+	Mode          string
+	Distance      float64
+	Parent        *string
+	Under         string
+	TagPrefixes   [][]string
+	Phrases       []string
+	CreatedAfter  *time.Time
+	CreatedBefore *time.Time
+	UpdatedAfter  *time.Time
+	UpdatedBefore *time.Time
+	Shared        *bool
+	Template      *bool
+	Sort          string
+	Order         string
+	Fields        []string
+	Page          int
+	Limit         int
+}
+
+func RagSearch(params SearchParams, userID string, c *gin.Context) ([]Note, int, error) {
+	if params.Text != "" && params.Mode != SearchModeSemantic {
+		return textSearch(params, userID, c)
+	}
+
+	q := NewQuery("notes").SelectNote("notes", params.Fields)
+	filterNotes(q, userID, params, "notes")
+
+	distance := "0"
+	if params.Text != "" {
+		embedding, err := embeddings.CreateEmbedding(params.Text)
 		if err != nil {
 			return nil, 0, err
 		}
-		vector = pgvector.NewVector(embedding.Embedding)
+		// The nearest notes are picked by distance alone so the vector index
+		// can serve them, the threshold and filters then apply to those
+		metric := CurrentDistanceMetric()
+		nearestDistance := metric.Distance("n.embedding", q.Arg(pgvector.NewVector(embedding.Embedding)))
+		nearest := q.Subquery("notes n").
+			Select("n.id", nearestDistance+" AS distance").
+			Where("n.user_id = "+q.Arg(userID), "n.embedding IS NOT NULL").
+			OrderBy(nearestDistance).
+			Page(semanticCandidates, 0)
+		nearestSQL, _ := nearest.SQL()
+		q.With("nearest AS (" + nearestSQL + ")").
+			Join("INNER JOIN nearest ON nearest.id = notes.id").
+			Where("nearest.distance < " + q.Arg(metric.Threshold(params.Distance))).
+			Select(metric.Normalize("nearest.distance") + " AS distance")
+		distance = "nearest.distance"
+	} else {
+		q.Select("0 AS distance")
+	}
+	q.OrderBy(searchOrder(params, "notes", distance+" ASC"))
+
+	return runSearch(q, params, c, func(note *Note) []interface{} {
+		return []interface{}{&note.Distance}
+	})
+}
+
+func ListNotes(c *gin.Context) {
+	userID := c.GetString("user_id")
+	params := pageParams(c)
+	params.Mode = c.DefaultQuery("mode", SearchModeSemantic)
+	params.Distance = DefaultDistance
+	params.Under = c.Query("under")
+	params.Sort = c.Query("sort")
+	params.Order = c.Query("order")
+	if !ValidSearchMode(params.Mode) {
+		c.JSON(400, gin.H{"error": "Invalid search mode, expected keyword, semantic or hybrid"})
+		return
 	}
-	db := c.MustGet("db").(*pgxpool.Pool)
 	
-	// Calculate offset
-	offset := (page - 1) * limit
+	fields, err := ParseNoteFields(c.Query("fields"))
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	params.Fields = fields
 	
-	// Get total count
-	var totalCount int
-	var countErr error
-	if text != "" {
-		if parentFilter != nil && *parentFilter == "" {
-			// Root notes only
-			countErr = db.QueryRow(context.Background(), "SELECT COUNT(*) FROM notes WHERE user_id = $1 AND parent IS NULL AND embedding <-> $2 < $3", userID, vector, distance).Scan(&totalCount)
-		} else if parentFilter != nil {
-			// Specific parent
-			countErr = db.QueryRow(context.Background(), "SELECT COUNT(*) FROM notes WHERE user_id = $1 AND parent = $2 AND embedding <-> $3 < $4", userID, parentFilter, vector, distance).Scan(&totalCount)
-		} else {
-			// All notes
-			countErr = db.QueryRow(context.Background(), "SELECT COUNT(*) FROM notes WHERE user_id = $1 AND embedding <-> $2 < $3", userID, vector, distance).Scan(&totalCount)
-		}
-	} else {
-		if parentFilter != nil && *parentFilter == "" {
-			// Root notes only
-			countErr = db.QueryRow(context.Background(), "SELECT COUNT(*) FROM notes WHERE user_id = $1 AND parent IS NULL", userID).Scan(&totalCount)
-		} else if parentFilter != nil {
-			// Specific parent
-			countErr = db.QueryRow(context.Background(), "SELECT COUNT(*) FROM notes WHERE user_id = $1 AND parent = $2", userID, parentFilter).Scan(&totalCount)
-		} else {
-			// All notes
-			countErr = db.QueryRow(context.Background(), "SELECT COUNT(*) FROM notes WHERE user_id = $1", userID).Scan(&totalCount)
+	if distanceStr := c.Query("distance"); distanceStr != "" {
+		d, err := strconv.ParseFloat(distanceStr, 64)
+		if err != nil || d <= 0 {
+			c.JSON(400, gin.H{"error": "Invalid distance threshold"})
+			return
 		}
+		params.Distance = d
 	}
 	
-	if countErr != nil {
-		return nil, 0, countErr
+	// Handle parent filter
+	// Check if 'parent' parameter exists in the query (even if empty)
+	if parentParam, exists := c.GetQuery("parent"); exists {
+		// Empty string means root notes, non-empty means specific parent
+		if _, err := uuid.FromString(parentParam); parentParam != "" && err != nil {
+			c.JSON(400, gin.H{"error": "Invalid parent ID"})
+			return
+		}
+		params.Parent = &parentParam
+	}
+	if _, err := uuid.FromString(params.Under); params.Under != "" && err != nil {
+		c.JSON(400, gin.H{"error": "Invalid under ID"})
+		return
 	}
 	
-	// Query notes with has_children flag
-	var rows pgx.Rows
-	var err error
-	if text != "" {
-		if parentFilter != nil && *parentFilter == "" {
-			// Root notes only with search
-			rows, err = db.Query(context.Background(), `
-				SELECT id, title, body, parent, created_at, updated_at, 
-				       embedding <-> $2 as distance, 
-				       COALESCE(is_shared, false) as is_shared, 
-				       COALESCE(tags, '[]'::jsonb) as tags,
-				       EXISTS(SELECT 1 FROM notes c WHERE c.parent = notes.id) as has_children,
-				       embedding IS NOT NULL as has_embedding
-				FROM notes 
-				WHERE user_id = $1 AND parent IS NULL AND embedding <-> $2 < $3 
-				ORDER BY embedding <-> $2
-				LIMIT $4 OFFSET $5`, userID, vector, distance, limit, offset)
-		} else if parentFilter != nil {
-			// Specific parent with search
-			rows, err = db.Query(context.Background(), `
-				SELECT id, title, body, parent, created_at, updated_at, 
-				       embedding <-> $3 as distance, 
-				       COALESCE(is_shared, false) as is_shared, 
-				       COALESCE(tags, '[]'::jsonb) as tags,
-				       EXISTS(SELECT 1 FROM notes c WHERE c.parent = notes.id) as has_children,
-				       embedding IS NOT NULL as has_embedding
-				FROM notes 
-				WHERE user_id = $1 AND parent = $2 AND embedding <-> $3 < $4 
-				ORDER BY embedding <-> $3
-				LIMIT $5 OFFSET $6`, userID, parentFilter, vector, distance, limit, offset)
-		} else {
-			// All notes with search
-			rows, err = db.Query(context.Background(), `
-				SELECT id, title, body, parent, created_at, updated_at, 
-				       embedding <-> $2 as distance, 
-				       COALESCE(is_shared, false) as is_shared, 
-				       COALESCE(tags, '[]'::jsonb) as tags,
-				       EXISTS(SELECT 1 FROM notes c WHERE c.parent = notes.id) as has_children,
-				       embedding IS NOT NULL as has_embedding
-				FROM notes 
-				WHERE user_id = $1 AND embedding <-> $2 < $3 
-				ORDER BY embedding <-> $2
-				LIMIT $4 OFFSET $5`, userID, vector, distance, limit, offset)
-		}
-	} else {
-		if parentFilter != nil && *parentFilter == "" {
-			// Root notes only without search
-			rows, err = db.Query(context.Background(), `
-				SELECT id, title, body, parent, created_at, updated_at, 
-				       0 as distance, 
-				       COALESCE(is_shared, false) as is_shared, 
-				       COALESCE(tags, '[]'::jsonb) as tags,
-				       EXISTS(SELECT 1 FROM notes c WHERE c.parent = notes.id) as has_children,
-				       embedding IS NOT NULL as has_embedding
-				FROM notes 
-				WHERE user_id = $1 AND parent IS NULL 
-				ORDER BY updated_at DESC
-				LIMIT $2 OFFSET $3`, userID, limit, offset)
-		} else if parentFilter != nil {
-			// Specific parent without search
-			rows, err = db.Query(context.Background(), `
-				SELECT id, title, body, parent, created_at, updated_at, 
-				       0 as distance, 
-				       COALESCE(is_shared, false) as is_shared, 
-				       COALESCE(tags, '[]'::jsonb) as tags,
-				       EXISTS(SELECT 1 FROM notes c WHERE c.parent = notes.id) as has_children,
-				       embedding IS NOT NULL as has_embedding
-				FROM notes 
-				WHERE user_id = $1 AND parent = $2 
-				ORDER BY updated_at DESC
-				LIMIT $3 OFFSET $4`, userID, parentFilter, limit, offset)
-		} else {
-			// All notes without search
-			rows, err = db.Query(context.Background(), `
-				SELECT id, title, body, parent, created_at, updated_at, 
-				       0 as distance, 
-				       COALESCE(is_shared, false) as is_shared, 
-				       COALESCE(tags, '[]'::jsonb) as tags,
-				       EXISTS(SELECT 1 FROM notes c WHERE c.parent = notes.id) as has_children,
-				       embedding IS NOT NULL as has_embedding
-				FROM notes 
-				WHERE user_id = $1 
-				ORDER BY updated_at DESC
-				LIMIT $2 OFFSET $3`, userID, limit, offset)
+	for _, tag := range c.QueryArray("tag") {
+		if path := ParseTagPath(tag); len(path) > 0 {
+			params.TagPrefixes = append(params.TagPrefixes, path)
 		}
 	}
 	
-	if err != nil {
-		return nil, 0, err
-	}
-	defer rows.Close()
-
-	for rows.Next() {
-		var note Note
-		var tagsJSON []byte
-		err := rows.Scan(&note.ID, &note.Title, &note.Body, &note.Parent, &note.CreatedAt, &note.UpdatedAt, &note.Distance, &note.IsShared, &tagsJSON, &note.HasChildren, &note.HasEmbedding)
+	if sharedStr := c.Query("shared"); sharedStr != "" {
+		shared, err := strconv.ParseBool(sharedStr)
 		if err != nil {
-			return nil, 0, err
-		}
-
-		// Unmarshal tags from JSON
-		if err := json.Unmarshal(tagsJSON, &note.Tags); err != nil {
-			return nil, 0, err
+			c.JSON(400, gin.H{"error": "Invalid shared filter"})
+			return
 		}
-
-		notes = append(notes, note)
+		params.Shared = &shared
 	}
 	
-	return notes, totalCount, nil
-}
-
-func ListNotes(c *gin.Context) {
-	userID := c.GetString("user_id")
-	searchParam := c.Query("search")
-	parentParam := c.Query("parent")
-	
-	// Parse pagination parameters
-	page := 1
-	if pageStr := c.Query("page"); pageStr != "" {
-		if p, err := json.Number(pageStr).Int64(); err == nil && p > 0 {
-			page = int(p)
+	if templateStr := c.Query("template"); templateStr != "" {
+		template, err := strconv.ParseBool(templateStr)
+		if err != nil {
+			c.JSON(400, gin.H{"error": "Invalid template filter"})
+			return
 		}
+		params.Template = &template
 	}
 	
-	limit := 50
-	if limitStr := c.Query("limit"); limitStr != "" {
-		if l, err := json.Number(limitStr).Int64(); err == nil && l > 0 && l <= 200 {
-			limit = int(l)
+	// After bounds are inclusive and before bounds are exclusive
+	dateFilters := []struct {
+		name  string
+		field **time.Time
+	}{
+		{"created_after", &params.CreatedAfter},
+		{"created_before", &params.CreatedBefore},
+		{"updated_after", &params.UpdatedAfter},
+		{"updated_before", &params.UpdatedBefore},
+	}
+	for _, filter := range dateFilters {
+		value := c.Query(filter.name)
+		if value == "" {
+			continue
 		}
+		start, _, err := parseDay(value)
+		if err != nil {
+			c.JSON(400, gin.H{"error": filter.name + ": " + err.Error()})
+			return
+		}
+		*filter.field = &start
 	}
 	
-	distance := .8
-	
-	// Handle parent filter
-	// Check if 'parent' parameter exists in the query (even if empty)
-	var parentFilter *string
-	if _, exists := c.GetQuery("parent"); exists {
-		// Empty string means root notes, non-empty means specific parent
-		parentFilter = &parentParam
+	// Filters written inline in the search box override query parameters
+	if err := ParseSearchQuery(c.Query("search"), &params); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if !validSort(params.Sort, params.Order) {
+		c.JSON(400, gin.H{"error": "Invalid sort, expected updated, created, title, position or relevance with order asc or desc"})
+		return
 	}
 	
-	notes, totalCount, err := RagSearch(searchParam, userID, distance, parentFilter, page, limit, c)
+	notes, totalCount, err := RagSearch(params, userID, c)
 	if err != nil {
 		c.JSON(500, gin.H{"error": err.Error()})
 		return
 	}
 	
-	hasMore := page*limit < totalCount
+	hasMore := params.Page*params.Limit < totalCount
 	
 	c.JSON(200, gin.H{
 		"notes": notes,
 		"pagination": PaginationInfo{
-			Page:    page,
-			Limit:   limit,
+			Page:    params.Page,
+			Limit:   params.Limit,
 			Total:   totalCount,
 			HasMore: hasMore,
 		},
@@ -271,124 +263,184 @@ func ListNotes(c *gin.Context) {
 }
 
 func GetNote(c *gin.Context) {
-	userID := c.GetString("user_id")
 	noteID := c.Param("id")
-	note := Note{}
 
 	db := c.MustGet("db").(*pgxpool.Pool)
-	var tagsJSON []byte
-	var hasChildren bool
-	var hasEmbedding bool
-	err := db.QueryRow(context.Background(), `
-		SELECT id, title, body, user_id, parent, created_at, updated_at, 
-		       COALESCE(is_shared, false) as is_shared, 
-		       COALESCE(tags, '[]'::jsonb) as tags,
-		       EXISTS(SELECT 1 FROM notes c WHERE c.parent = notes.id) as has_children,
-		       embedding IS NOT NULL as has_embedding
-		FROM notes 
-		WHERE id = $1 AND user_id = $2`, noteID, userID).Scan(&note.ID, &note.Title, &note.Body, &note.UserId, &note.Parent, &note.CreatedAt, &note.UpdatedAt, &note.IsShared, &tagsJSON, &hasChildren, &hasEmbedding)
+	access, ok := AuthorizeNote(c, db, noteID, RoleViewer)
+	if !ok {
+		return
+	}
+	note, err := getNote(db, noteID, access.OwnerID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.JSON(404, gin.H{"error": "Note not found"})
+		return
+	}
 	if err != nil {
 		c.JSON(500, gin.H{"error": err.Error()})
 		return
 	}
-	
-	note.HasChildren = hasChildren
-	note.HasEmbedding = hasEmbedding
 
-	// Unmarshal tags from JSON
-	if err := json.Unmarshal(tagsJSON, &note.Tags); err != nil {
-		c.JSON(500, gin.H{"error": "Failed to unmarshal tags: " + err.Error()})
-		return
+	// Show a branch's title and body in place of the main ones
+	if name := c.Query("branch"); name != "" {
+		branch, err := getBranch(db, noteID, name, access.OwnerID)
+		if errors.Is(err, pgx.ErrNoRows) {
+			c.JSON(404, gin.H{"error": "Branch not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		note.Title, note.Body, note.Branch = branch.Title, branch.Body, branch.Name
+	} else {
+		c.Header("ETag", noteETag(note.Version))
+		if match := c.GetHeader("If-None-Match"); match != "" {
+			if version, err := parseETag(match); err == nil && version == note.Version {
+				c.Status(304)
+				return
+			}
+		}
 	}
 
+	note.Role = access.Role
 	c.JSON(200, gin.H{"note": note})
 }
 
 // GetNoteChildren returns immediate children of a given note
 func GetNoteChildren(c *gin.Context) {
-	userID := c.GetString("user_id")
 	noteID := c.Param("id")
 	
-	// Verify the parent note exists and belongs to the user
+	// Verify the user can read the parent note, whose owner owns its children
 	db := c.MustGet("db").(*pgxpool.Pool)
-	var noteExists bool
-	err := db.QueryRow(context.Background(), 
-		"SELECT EXISTS(SELECT 1 FROM notes WHERE id = $1 AND user_id = $2)", 
-		noteID, userID).Scan(&noteExists)
-	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to verify parent note"})
+	access, ok := AuthorizeNote(c, db, noteID, RoleViewer)
+	if !ok {
 		return
 	}
-	if !noteExists {
-		c.JSON(404, gin.H{"error": "Parent note not found or you don't have permission to access it"})
+	
+	// Get children of the specified parent, most recently updated first
+	// unless another order is asked for
+	params := SearchParams{Parent: &noteID, Sort: c.Query("sort"), Order: c.Query("order")}
+	if params.Sort == "relevance" || !validSort(params.Sort, params.Order) {
+		c.JSON(400, gin.H{"error": "Invalid sort, expected updated, created, title or position with order asc or desc"})
 		return
 	}
-	
-	// Get children of the specified parent
-	rows, err := db.Query(context.Background(), `
-		SELECT id, title, body, parent, created_at, updated_at,
-		       0 as distance,
-		       COALESCE(is_shared, false) as is_shared,
-		       COALESCE(tags, '[]'::jsonb) as tags,
-		       EXISTS(SELECT 1 FROM notes c WHERE c.parent = notes.id) as has_children,
-		       embedding IS NOT NULL as has_embedding
-		FROM notes
-		WHERE user_id = $1 AND parent = $2
-		ORDER BY updated_at DESC`, userID, noteID)
-	
+	q := NewQuery("notes").SelectNote("notes", DefaultNoteFields).OrderBy(searchOrder(params, "notes", ""))
+	filterNotes(q, access.OwnerID, params, "notes")
+	sql, args := q.SQL()
+	rows, err := db.Query(context.Background(), sql, args...)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	notes, err := scanNotes(rows, DefaultNoteFields, nil)
 	if err != nil {
 		c.JSON(500, gin.H{"error": err.Error()})
 		return
 	}
-	defer rows.Close()
 	
-	var notes []Note
-	for rows.Next() {
-		var note Note
-		var tagsJSON []byte
-		err := rows.Scan(&note.ID, &note.Title, &note.Body, &note.Parent, &note.CreatedAt, &note.UpdatedAt, &note.Distance, &note.IsShared, &tagsJSON, &note.HasChildren, &note.HasEmbedding)
-		if err != nil {
-			c.JSON(500, gin.H{"error": err.Error()})
-			return
-		}
+	c.JSON(200, gin.H{"notes": notes})
+}
 
-		// Unmarshal tags from JSON
-		if err := json.Unmarshal(tagsJSON, &note.Tags); err != nil {
-			c.JSON(500, gin.H{"error": "Failed to unmarshal tags: " + err.Error()})
-			return
-		}
+// renderNote converts a note body to the markdown stored for full-text search
+// and creates the embedding stored for semantic search. The embedding is nil
+// when it cannot be created.
+func renderNote(title string, body string) (string, *pgvector.Vector, error) {
+	markdown, err := markdown.ConvertJSONToMarkdown(body)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return markdown, embedNote(title, markdown), nil
+}
 
-		notes = append(notes, note)
+// embedNote creates the embedding of a note from its title and markdown. It
+// returns nil when the embedding cannot be created.
+func embedNote(title string, markdown string) *pgvector.Vector {
+	// Append a new line to the start of the markdown with the Note title
+	embedding, err := embeddings.CreateEmbedding("# " + title + "\n" + markdown)
+	if err != nil {
+		// If embedding creation fails, use NULL
+		return nil
 	}
-	
-	c.JSON(200, gin.H{"notes": notes})
+	vector := pgvector.NewVector(embedding.Embedding)
+	return &vector
 }
 
+// UpsertNote creates or saves a note. A save based on an older version than
+// the stored one, given by If-Match or base_version, is rejected with 409
+// Conflict and the current note so the client can merge.
 func UpsertNote(c *gin.Context) {
-	userID := c.GetString("user_id")
-	note := Note{}
-	note.UserId = uuid.FromStringOrNil(userID)
-	err := c.BindJSON(&note)
+	requester := c.GetString("user_id")
+	userID := requester
+	var request struct {
+		Note
+		BaseVersion *int64 `json:"base_version"`
+	}
+	err := c.BindJSON(&request)
 	if err != nil {
 		c.JSON(400, gin.H{"error": err.Error()})
 		return
 	}
-	markdown, err := markdown.ConvertJSONToMarkdown(note.Body)
+	note := request.Note
+
+	expected, err := expectedVersion(c, request.BaseVersion)
 	if err != nil {
-		c.JSON(500, gin.H{"error": err.Error()})
+		c.JSON(400, gin.H{"error": err.Error()})
 		return
 	}
-	// Append a new line to the start of the markdown with the Note title
-	markdown = "# " + note.Title + "\n" + markdown
 
-	var newVector *pgvector.Vector
-	embedding, err := embeddings.CreateEmbedding(markdown)
+	db := c.MustGet("db").(*pgxpool.Pool)
+
+	// Editors save shared notes as their owner, but only the owner moves
+	// them. Notes the user cannot see are saved as new notes of the
+	// parent's owner, or their own at the root, which the upsert refuses if
+	// the id is taken.
+	access, err := Authorize(db, note.ID.String(), userID, RoleEditor)
+	switch {
+	case err == nil:
+		userID = access.OwnerID
+	case errors.Is(err, errForbidden):
+		c.JSON(403, gin.H{"error": err.Error()})
+		return
+	case !errors.Is(err, errNoteNotFound):
+		c.JSON(500, gin.H{"error": "Failed to verify note"})
+		return
+	}
+	if access.Role == RoleEditor {
+		err = db.QueryRow(context.Background(), "SELECT parent FROM notes WHERE id = $1", note.ID).Scan(&note.Parent)
+		if err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if access.Role == "" && note.Parent != nil {
+		parentAccess, err := Authorize(db, note.Parent.String(), requester, RoleEditor)
+		if err != nil {
+			if errors.Is(err, errNoteNotFound) {
+				err = errParentNotFound
+			}
+			c.JSON(operationStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		userID = parentAccess.OwnerID
+	}
+	note.UserId = uuid.FromStringOrNil(userID)
+
+	// Saves on a branch leave the main body untouched
+	if name := c.Query("branch"); name != "" {
+		saveBranch(c, db, note, name)
+		return
+	}
+
+	// Fail stale saves before paying for an embedding
+	if expected != nil && staleSave(c, db, note.ID.String(), userID, *expected) {
+		return
+	}
+
+	bodyMarkdown, newVector, err := renderNote(note.Title, note.Body)
 	if err != nil {
-		// If embedding creation fails, use NULL
-		newVector = nil
-	} else {
-		vector := pgvector.NewVector(embedding.Embedding)
-		newVector = &vector
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
 	}
 
 	// Marshal tags to JSON
@@ -398,123 +450,95 @@ func UpsertNote(c *gin.Context) {
 		return
 	}
 
-	db := c.MustGet("db").(*pgxpool.Pool)
-
 	tx, err := db.Begin(context.Background())
 	if err != nil {
 		c.JSON(500, gin.H{"error": err.Error()})
 		return
 	}
 
-	_, err = tx.Exec(context.Background(), "INSERT INTO notes (id, title, body, user_id, parent, embedding, tags) VALUES ($1, $2, $3, $4, $5, $6, $7) ON CONFLICT (id) DO UPDATE SET id = $1, title = $2, body = $3, parent = $5, embedding = $6, tags = $7, updated_at = now()", note.ID, note.Title, note.Body, userID, note.Parent, newVector, tagsJSON)
+	// The parent is checked within the transaction so it cannot become a
+	// descendant of the note in the meantime
+	if note.Parent != nil && access.Role != RoleEditor {
+		if err := checkParent(tx, requester, userID, note.ID, *note.Parent); err != nil {
+			tx.Rollback(context.Background())
+			c.JSON(operationStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	// New notes are placed after their siblings, as are notes given a new parent
+	position, err := siblingPosition(tx, userID, &note.ID, note.Parent, nil, nil)
 	if err != nil {
 		tx.Rollback(context.Background())
 		c.JSON(500, gin.H{"error": err.Error()})
 		return
 	}
 
-	_, err = tx.Exec(context.Background(), "INSERT INTO revisions (note_id, title, body, user_id) VALUES ($1, $2, $3, $4)", note.ID, note.Title, note.Body, note.UserId)
-	if err != nil {
+	// The version is checked again here in case of a save in the meantime
+	err = tx.QueryRow(context.Background(), `
+		INSERT INTO notes (id, title, body, user_id, parent, embedding, tags, markdown, position)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $10)
+		ON CONFLICT (id) DO UPDATE SET title = $2, body = $3, parent = $5, embedding = $6, tags = $7, markdown = $8,
+			position = CASE WHEN notes.parent IS DISTINCT FROM $5 THEN $10 ELSE notes.position END,
+			updated_at = now(), version = notes.version + 1
+		WHERE notes.user_id = $4 AND notes.id NOT IN (SELECT trashed_note_ids($4))
+			AND ($9::bigint IS NULL OR notes.version = $9)
+		RETURNING version, created_at, updated_at, COALESCE(position, '')`,
+		note.ID, note.Title, note.Body, userID, note.Parent, newVector, tagsJSON, bodyMarkdown, expected, position).
+		Scan(&note.Version, &note.CreatedAt, &note.UpdatedAt, &note.Position)
+	if errors.Is(err, pgx.ErrNoRows) {
 		tx.Rollback(context.Background())
-		c.JSON(500, gin.H{"error": err.Error()})
+		if expected == nil || !staleSave(c, db, note.ID.String(), userID, *expected) {
+			c.JSON(404, gin.H{"error": "Note not found or you don't have permission to modify it"})
+		}
 		return
 	}
-
-	err = tx.Commit(context.Background())
 	if err != nil {
+		tx.Rollback(context.Background())
 		c.JSON(500, gin.H{"error": err.Error()})
 		return
 	}
-	c.JSON(200, gin.H{"note": note})
-}
-
-func DeleteNote(c *gin.Context) {
-	userID := c.GetString("user_id")
-	noteID := c.Param("id")
-
-	db := c.MustGet("db").(*pgxpool.Pool)
 
-	//In a transaction delete all descendant notes, their revisions, and then the note itself
-	tx, err := db.Begin(context.Background())
+	_, err = tx.Exec(context.Background(), "INSERT INTO revisions (note_id, title, body, user_id, size) VALUES ($1, $2, $3, $4, $5)", note.ID, note.Title, note.Body, note.UserId, len(note.Body))
 	if err != nil {
+		tx.Rollback(context.Background())
 		c.JSON(500, gin.H{"error": err.Error()})
 		return
 	}
 
-	// First, get all descendant note IDs using a recursive CTE
-	// This includes the note itself and all its children, grandchildren, etc.
-	rows, err := tx.Query(context.Background(), `
-		WITH RECURSIVE note_hierarchy AS (
-			-- Start with the note being deleted
-			SELECT id FROM notes WHERE id = $1 AND user_id = $2
-			UNION ALL
-			-- Recursively find all children
-			SELECT n.id FROM notes n
-			INNER JOIN note_hierarchy nh ON n.parent = nh.id
-			WHERE n.user_id = $2
-		)
-		SELECT id FROM note_hierarchy
-	`, noteID, userID)
-
-	if err != nil {
+	if err := saveLinks(tx, note.ID, note.Body); err != nil {
 		tx.Rollback(context.Background())
 		c.JSON(500, gin.H{"error": err.Error()})
 		return
 	}
 
-	var noteIDs []string
-	for rows.Next() {
-		var id string
-		err := rows.Scan(&id)
-		if err != nil {
-			tx.Rollback(context.Background())
-			c.JSON(500, gin.H{"error": err.Error()})
-			return
-		}
-		noteIDs = append(noteIDs, id)
-	}
-	rows.Close()
-
-	// Check if the original note exists and belongs to the user
-	if len(noteIDs) == 0 {
-		tx.Rollback(context.Background())
-		c.JSON(404, gin.H{"error": "Note not found or you don't have permission to delete it"})
+	err = tx.Commit(context.Background())
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
 		return
 	}
+	c.Header("ETag", noteETag(note.Version))
+	c.JSON(200, gin.H{"note": note})
+}
 
-	// Delete all revisions for all descendant notes
-	for _, id := range noteIDs {
-		_, err = tx.Exec(context.Background(), "DELETE FROM revisions WHERE note_id = $1", id)
-		if err != nil {
-			tx.Rollback(context.Background())
-			c.JSON(500, gin.H{"error": err.Error()})
-			return
-		}
-	}
+// DeleteNote moves a note and its subtree to the trash
+func DeleteNote(c *gin.Context) {
+	userID := c.GetString("user_id")
+	noteID := c.Param("id")
 
-	// Delete all descendant notes (this will cascade delete in order due to foreign key constraints)
-	// We need to delete children first, then parents
-	for i := len(noteIDs) - 1; i >= 0; i-- {
-		_, err = tx.Exec(context.Background(), "DELETE FROM notes WHERE id = $1 AND user_id = $2", noteIDs[i], userID)
-		if err != nil {
-			tx.Rollback(context.Background())
-			c.JSON(500, gin.H{"error": err.Error()})
-			return
-		}
-	}
+	db := c.MustGet("db").(*pgxpool.Pool)
 
-	err = tx.Commit(context.Background())
+	deletedCount, err := trashNote(db, userID, noteID)
 	if err != nil {
-		c.JSON(500, gin.H{"error": err.Error()})
+		c.JSON(operationStatus(err), gin.H{"error": err.Error()})
 		return
 	}
 
-	deletedCount := len(noteIDs)
 	if deletedCount == 1 {
-		c.JSON(200, gin.H{"message": "Note deleted"})
+		c.JSON(200, gin.H{"message": "Note moved to trash"})
 	} else {
 		c.JSON(200, gin.H{
-			"message":       "Note and child notes deleted",
+			"message":       "Note and child notes moved to trash",
 			"deleted_count": deletedCount,
 		})
 	}
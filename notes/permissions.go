@@ -0,0 +1,292 @@
+package notes
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	uuid "github.com/satori/go.uuid"
+	"github.com/stevecastle/modelpad/auth"
+)
+
+// Roles on a note, from least to most access. A role granted on a note also
+// applies to its subtree. Commenters can read like viewers.
+const (
+	RoleViewer    = "viewer"
+	RoleCommenter = "commenter"
+	RoleEditor    = "editor"
+	RoleOwner     = "owner"
+)
+
+var errForbidden = errors.New("Your role on this note does not allow this")
+
+// roleRank orders roles by access, unknown roles rank lowest
+func roleRank(role string) int {
+	switch role {
+	case RoleViewer:
+		return 1
+	case RoleCommenter:
+		return 2
+	case RoleEditor:
+		return 3
+	case RoleOwner:
+		return 4
+	}
+	return 0
+}
+
+// Access is a user's role on a note. Queries for the note are scoped to
+// OwnerID, which differs from the user for shared notes.
+type Access struct {
+	Role    string
+	OwnerID string
+}
+
+// Authorize checks the user has at least the needed role on a note that is
+// not in the trash. It fails with errNoteNotFound when the user has no
+// access at all and errForbidden when their role is too low.
+func Authorize(db dbtx, noteID string, userID string, need string) (Access, error) {
+	var access Access
+	if _, err := uuid.FromString(noteID); err != nil {
+		return access, errNoteNotFound
+	}
+
+	var role *string
+	err := db.QueryRow(context.Background(),
+		"SELECT n.user_id::text, note_role(n.id, $2) FROM notes n WHERE n.id = $1 AND "+notTrashed("n", "n.user_id"),
+		noteID, userID).Scan(&access.OwnerID, &role)
+	if errors.Is(err, pgx.ErrNoRows) || (err == nil && role == nil) {
+		return access, errNoteNotFound
+	}
+	if err != nil {
+		return access, err
+	}
+	access.Role = *role
+	if roleRank(access.Role) < roleRank(need) {
+		return access, errForbidden
+	}
+	return access, nil
+}
+
+// AuthorizeNote authorizes the request's user for a note, responding with
+// the error when they are not. It reports whether the request may go on.
+func AuthorizeNote(c *gin.Context, db dbtx, noteID string, need string) (Access, bool) {
+	access, err := Authorize(db, noteID, c.GetString("user_id"), need)
+	if err != nil {
+		if status := operationStatus(err); status != 500 {
+			c.JSON(status, gin.H{"error": err.Error()})
+		} else {
+			c.JSON(500, gin.H{"error": "Failed to verify note"})
+		}
+		return access, false
+	}
+	return access, true
+}
+
+// readableBy limits a query over the owner's notes to those the user can
+// read, for users who reached them through a shared note
+func readableBy(q *Query, alias string, access Access, userID string) {
+	if access.Role != RoleOwner {
+		q.Where("note_role(" + alias + ".id, " + q.Arg(userID) + ") IS NOT NULL")
+	}
+}
+
+// Permission is a role granted to a user on a note
+type Permission struct {
+	ID        uuid.UUID `json:"id"`
+	NoteID    uuid.UUID `json:"note_id"`
+	UserID    uuid.UUID `json:"user_id"`
+	Email     string    `json:"email"`
+	Role      string    `json:"role"`
+	Inherited bool      `json:"inherited"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ListPermissions returns the grants on a note, including those inherited
+// from its ancestors
+func ListPermissions(c *gin.Context) {
+	noteID := c.Param("id")
+	db := c.MustGet("db").(*pgxpool.Pool)
+
+	if _, ok := AuthorizeNote(c, db, noteID, RoleOwner); !ok {
+		return
+	}
+
+	rows, err := db.Query(context.Background(), `
+		WITH RECURSIVE ancestors AS (
+			SELECT id, parent, 1 AS depth FROM notes WHERE id = $1
+			UNION ALL
+			SELECT n.id, n.parent, a.depth + 1 FROM notes n
+			INNER JOIN ancestors a ON n.id = a.parent
+			WHERE a.depth < 1000
+		)
+		SELECT p.id, p.note_id, p.user_id, u.email, p.role, a.depth > 1, p.created_at
+		FROM note_permissions p
+		INNER JOIN ancestors a ON a.id = p.note_id
+		INNER JOIN users u ON u.id = p.user_id
+		ORDER BY a.depth, p.created_at, p.id`, noteID)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	permissions := []Permission{}
+	for rows.Next() {
+		var permission Permission
+		if err := rows.Scan(&permission.ID, &permission.NoteID, &permission.UserID, &permission.Email,
+			&permission.Role, &permission.Inherited, &permission.CreatedAt); err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		permissions = append(permissions, permission)
+	}
+
+	c.JSON(200, gin.H{"permissions": permissions})
+}
+
+// GrantPermission gives an existing user, found by user_id or email, a role
+// on a note and its subtree, replacing any role they were granted on it
+// before. Emails are not verified, so they never hold a grant themselves.
+func GrantPermission(c *gin.Context) {
+	userID := c.GetString("user_id")
+	noteID := c.Param("id")
+
+	var requestBody struct {
+		UserID string `json:"user_id"`
+		Email  string `json:"email"`
+		Role   string `json:"role"`
+	}
+	if err := c.ShouldBindJSON(&requestBody); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if requestBody.Role != RoleViewer && requestBody.Role != RoleCommenter && requestBody.Role != RoleEditor {
+		c.JSON(400, gin.H{"error": "Invalid role, expected viewer, commenter or editor"})
+		return
+	}
+	email := strings.ToLower(strings.TrimSpace(requestBody.Email))
+	if (requestBody.UserID == "") == (email == "") {
+		c.JSON(400, gin.H{"error": "Either user_id or email is required"})
+		return
+	}
+	if email != "" && !auth.ValidateEmail(email) {
+		c.JSON(400, gin.H{"error": "Invalid email format"})
+		return
+	}
+
+	db := c.MustGet("db").(*pgxpool.Pool)
+	if _, ok := AuthorizeNote(c, db, noteID, RoleOwner); !ok {
+		return
+	}
+
+	permission := Permission{Role: requestBody.Role}
+	var err error
+	if requestBody.UserID != "" {
+		id, parseErr := uuid.FromString(requestBody.UserID)
+		if parseErr != nil {
+			c.JSON(400, gin.H{"error": "Invalid user ID"})
+			return
+		}
+		err = db.QueryRow(context.Background(), "SELECT id, email FROM users WHERE id = $1", id).
+			Scan(&permission.UserID, &permission.Email)
+	} else {
+		err = db.QueryRow(context.Background(), "SELECT id, email FROM users WHERE lower(email) = $1", email).
+			Scan(&permission.UserID, &permission.Email)
+	}
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.JSON(404, gin.H{"error": "User not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	if permission.UserID.String() == userID {
+		c.JSON(400, gin.H{"error": "You already own this note"})
+		return
+	}
+
+	err = db.QueryRow(context.Background(), `
+		INSERT INTO note_permissions (note_id, user_id, role, granted_by) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (note_id, user_id) DO UPDATE SET role = EXCLUDED.role
+		RETURNING id, note_id, created_at`,
+		noteID, permission.UserID, requestBody.Role, userID).Scan(&permission.ID, &permission.NoteID, &permission.CreatedAt)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(200, gin.H{"permission": permission})
+}
+
+// RevokePermission removes a grant made directly on a note
+func RevokePermission(c *gin.Context) {
+	noteID := c.Param("id")
+	db := c.MustGet("db").(*pgxpool.Pool)
+
+	if _, ok := AuthorizeNote(c, db, noteID, RoleOwner); !ok {
+		return
+	}
+
+	permissionID, err := uuid.FromString(c.Param("permission"))
+	if err != nil {
+		c.JSON(404, gin.H{"error": "Permission not found"})
+		return
+	}
+	result, err := db.Exec(context.Background(),
+		"DELETE FROM note_permissions WHERE id = $1 AND note_id = $2", permissionID, noteID)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	if result.RowsAffected() == 0 {
+		c.JSON(404, gin.H{"error": "Permission not found"})
+		return
+	}
+
+	c.JSON(200, gin.H{"message": "Permission revoked"})
+}
+
+// ListSharedNotes returns the notes other users shared with the user, each
+// with the user's role on it. Their subtrees are read with the children
+// endpoint.
+func ListSharedNotes(c *gin.Context) {
+	userID := c.GetString("user_id")
+
+	params := pageParams(c)
+	params.Fields = []string{"id", "title", "user_id", "parent", "created_at", "updated_at", "version", "tags", "has_children"}
+
+	q := NewQuery("notes").SelectNote("notes", params.Fields)
+	user := q.Arg(userID)
+	q.Where("notes.user_id <> "+user,
+		"notes.id IN (SELECT p.note_id FROM note_permissions p WHERE p.user_id = "+user+")",
+		notTrashed("notes", "notes.user_id")).
+		Select("note_role(notes.id, "+user+") AS role").
+		OrderBy("notes.updated_at DESC", "notes.id")
+
+	notes, totalCount, err := runSearch(q, params, c, func(note *Note) []interface{} {
+		return []interface{}{&note.Role}
+	})
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	if notes == nil {
+		notes = []Note{}
+	}
+
+	c.JSON(200, gin.H{
+		"notes": notes,
+		"pagination": PaginationInfo{
+			Page:    params.Page,
+			Limit:   params.Limit,
+			Total:   totalCount,
+			HasMore: params.Page*params.Limit < totalCount,
+		},
+	})
+}
@@ -0,0 +1,278 @@
+package notes
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Query composes a SELECT statement from CTEs, columns, joins, WHERE
+// conditions and ordering. Arguments are numbered in the order Arg is called,
+// so conditions can be added in any combination without hand-numbering
+// placeholders.
+type Query struct {
+	recursive  bool
+	with       []string
+	columns    []string
+	from       string
+	joins      []string
+	conditions []string
+	orderBy    []string
+	limit      int
+	offset     int
+	args       *[]interface{}
+}
+
+// NewQuery starts a query selecting from the given table expression
+func NewQuery(from string) *Query {
+	return &Query{from: from, args: &[]interface{}{}}
+}
+
+// Subquery starts a query that shares its arguments with q, for use in a CTE
+// or condition of q
+func (q *Query) Subquery(from string) *Query {
+	return &Query{from: from, args: q.args}
+}
+
+// Arg records value as the next query argument and returns its placeholder
+func (q *Query) Arg(value interface{}) string {
+	*q.args = append(*q.args, value)
+	return fmt.Sprintf("$%d", len(*q.args))
+}
+
+// With adds a common table expression such as "name AS (SELECT ...)"
+func (q *Query) With(cte string) *Query {
+	q.with = append(q.with, cte)
+	return q
+}
+
+// WithRecursive adds a common table expression that may refer to itself
+func (q *Query) WithRecursive(cte string) *Query {
+	q.recursive = true
+	return q.With(cte)
+}
+
+// Select adds columns to the projection
+func (q *Query) Select(columns ...string) *Query {
+	q.columns = append(q.columns, columns...)
+	return q
+}
+
+// Join adds a join clause such as "INNER JOIN notes n ON n.id = f.id"
+func (q *Query) Join(join string) *Query {
+	q.joins = append(q.joins, join)
+	return q
+}
+
+// Where adds conditions that must all hold
+func (q *Query) Where(conditions ...string) *Query {
+	q.conditions = append(q.conditions, conditions...)
+	return q
+}
+
+// OrderBy adds ordering expressions
+func (q *Query) OrderBy(exprs ...string) *Query {
+	q.orderBy = append(q.orderBy, exprs...)
+	return q
+}
+
+// Page limits the result to limit rows starting after offset rows. A zero
+// limit leaves the result unbounded.
+func (q *Query) Page(limit int, offset int) *Query {
+	q.limit = limit
+	q.offset = offset
+	return q
+}
+
+// SQL returns the statement and its arguments
+func (q *Query) SQL() (string, []interface{}) {
+	var sb strings.Builder
+	q.writeWith(&sb)
+	q.writeSelect(&sb)
+	if len(q.orderBy) > 0 {
+		sb.WriteString(" ORDER BY ")
+		sb.WriteString(strings.Join(q.orderBy, ", "))
+	}
+	if q.limit > 0 {
+		fmt.Fprintf(&sb, " LIMIT %d", q.limit)
+	}
+	if q.offset > 0 {
+		fmt.Fprintf(&sb, " OFFSET %d", q.offset)
+	}
+	return sb.String(), *q.args
+}
+
+// CountSQL returns a statement counting the rows the query matches, ignoring
+// ordering and paging
+func (q *Query) CountSQL() (string, []interface{}) {
+	var sb strings.Builder
+	q.writeWith(&sb)
+	sb.WriteString("SELECT COUNT(*) FROM (")
+	q.writeSelect(&sb)
+	sb.WriteString(") counted")
+	return sb.String(), *q.args
+}
+
+func (q *Query) writeWith(sb *strings.Builder) {
+	if len(q.with) == 0 {
+		return
+	}
+	sb.WriteString("WITH ")
+	if q.recursive {
+		sb.WriteString("RECURSIVE ")
+	}
+	sb.WriteString(strings.Join(q.with, ", "))
+	sb.WriteString(" ")
+}
+
+func (q *Query) writeSelect(sb *strings.Builder) {
+	sb.WriteString("SELECT ")
+	if len(q.columns) == 0 {
+		sb.WriteString("1")
+	} else {
+		sb.WriteString(strings.Join(q.columns, ", "))
+	}
+	sb.WriteString(" FROM ")
+	sb.WriteString(q.from)
+	for _, join := range q.joins {
+		sb.WriteString(" ")
+		sb.WriteString(join)
+	}
+	if len(q.conditions) > 0 {
+		sb.WriteString(" WHERE ")
+		sb.WriteString(strings.Join(q.conditions, " AND "))
+	}
+}
+
+// noteColumns maps each projectable Note field to the SQL producing it, in
+// select order. %[1]s stands for the alias of the notes table.
+var noteColumns = []struct {
+	field string
+	expr  string
+}{
+	{"id", "%[1]s.id"},
+	{"title", "%[1]s.title"},
+	{"body", "%[1]s.body"},
+	{"user_id", "%[1]s.user_id"},
+	{"parent", "%[1]s.parent"},
+	{"created_at", "%[1]s.created_at"},
+	{"updated_at", "%[1]s.updated_at"},
+	{"version", "%[1]s.version"},
+	{"position", "COALESCE(%[1]s.position, '')"},
+	{"is_shared", "COALESCE(%[1]s.is_shared, false)"},
+	{"is_template", "%[1]s.is_template"},
+	{"tags", "COALESCE(%[1]s.tags, '[]'::jsonb)"},
+	{"has_children", "EXISTS(SELECT 1 FROM notes c WHERE c.parent = %[1]s.id AND c.deleted_at IS NULL)"},
+	{"has_embedding", "%[1]s.embedding IS NOT NULL"},
+}
+
+// DefaultNoteFields are the fields returned by note listings
+var DefaultNoteFields = []string{"id", "title", "body", "parent", "created_at", "updated_at", "version", "position", "is_shared", "is_template", "tags", "has_children", "has_embedding"}
+
+// AllNoteFields are the fields returned for a single note
+var AllNoteFields = []string{"id", "title", "body", "user_id", "parent", "created_at", "updated_at", "version", "position", "is_shared", "is_template", "tags", "has_children", "has_embedding"}
+
+// ParseNoteFields validates a comma separated field list. The id is always
+// included. An empty list selects DefaultNoteFields.
+func ParseNoteFields(list string) ([]string, error) {
+	if list == "" {
+		return DefaultNoteFields, nil
+	}
+	requested := map[string]bool{"id": true}
+	for _, field := range strings.Split(list, ",") {
+		field = strings.TrimSpace(field)
+		if noteColumn(field) == "" {
+			return nil, fmt.Errorf("unknown field %q", field)
+		}
+		requested[field] = true
+	}
+	// Keep select order stable regardless of the order fields were requested
+	var fields []string
+	for _, column := range noteColumns {
+		if requested[column.field] {
+			fields = append(fields, column.field)
+		}
+	}
+	return fields, nil
+}
+
+func noteColumn(field string) string {
+	for _, column := range noteColumns {
+		if column.field == field {
+			return column.expr
+		}
+	}
+	return ""
+}
+
+// SelectNote projects the given Note fields from the notes table aliased as
+// alias. Rows are read back with scanNotes using the same field list.
+func (q *Query) SelectNote(alias string, fields []string) *Query {
+	for _, field := range fields {
+		q.Select(fmt.Sprintf(noteColumn(field)+" AS %[2]s", alias, field))
+	}
+	return q
+}
+
+// scanNotes reads Notes projected by SelectNote. Columns selected after the
+// note fields are scanned into the destinations returned by extra.
+func scanNotes(rows pgx.Rows, fields []string, extra func(note *Note) []interface{}) ([]Note, error) {
+	defer rows.Close()
+
+	var notes []Note
+	for rows.Next() {
+		var note Note
+		var tagsJSON []byte
+		dest := make([]interface{}, 0, len(fields)+2)
+		for _, field := range fields {
+			switch field {
+			case "id":
+				dest = append(dest, &note.ID)
+			case "title":
+				dest = append(dest, &note.Title)
+			case "body":
+				dest = append(dest, &note.Body)
+			case "user_id":
+				dest = append(dest, &note.UserId)
+			case "parent":
+				dest = append(dest, &note.Parent)
+			case "created_at":
+				dest = append(dest, &note.CreatedAt)
+			case "updated_at":
+				dest = append(dest, &note.UpdatedAt)
+			case "version":
+				dest = append(dest, &note.Version)
+			case "position":
+				dest = append(dest, &note.Position)
+			case "is_shared":
+				dest = append(dest, &note.IsShared)
+			case "is_template":
+				dest = append(dest, &note.IsTemplate)
+			case "tags":
+				dest = append(dest, &tagsJSON)
+			case "has_children":
+				dest = append(dest, &note.HasChildren)
+			case "has_embedding":
+				dest = append(dest, &note.HasEmbedding)
+			}
+		}
+		if extra != nil {
+			dest = append(dest, extra(&note)...)
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+
+		// Unmarshal tags from JSON
+		if tagsJSON != nil {
+			if err := json.Unmarshal(tagsJSON, &note.Tags); err != nil {
+				return nil, err
+			}
+		}
+
+		notes = append(notes, note)
+	}
+	return notes, rows.Err()
+}
@@ -0,0 +1,230 @@
+package notes
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// ParseSearchQuery applies the compact search syntax in input to params and
+// sets params.Text to whatever free text remains. Recognized terms are:
+//
+//	tag:project/backend     notes tagged with the path or anything below it
+//	created:>2025-01-01     created after a day (also >=, <, <=, a..b, or a day)
+//	updated:<2025-02-01     updated before a day, same forms as created
+//	shared:true             shared or private notes
+//	template:true           templates or regular notes
+//	under:<note id>         anywhere in the subtree below a note
+//	parent:<note id|root>   direct children of a note, or root notes
+//	sort:title              updated, created, title, position or relevance, with an
+//	                        optional -asc or -desc suffix
+//	"exact phrase"          notes containing the phrase verbatim
+//
+// Terms with an unknown key are treated as free text.
+func ParseSearchQuery(input string, params *SearchParams) error {
+	var text []string
+	for _, token := range tokenizeQuery(input) {
+		if token.quoted {
+			params.Phrases = append(params.Phrases, token.value)
+			text = append(text, `"`+token.value+`"`)
+			continue
+		}
+
+		key, value, ok := strings.Cut(token.value, ":")
+		if !ok || value == "" {
+			text = append(text, token.value)
+			continue
+		}
+		value = strings.Trim(value, `"`)
+
+		switch strings.ToLower(key) {
+		case "tag":
+			path := ParseTagPath(value)
+			if len(path) == 0 {
+				return fmt.Errorf("invalid tag filter %q", token.value)
+			}
+			params.TagPrefixes = append(params.TagPrefixes, path)
+		case "created":
+			after, before, err := ParseDateFilter(value)
+			if err != nil {
+				return err
+			}
+			params.CreatedAfter, params.CreatedBefore = mergeRange(params.CreatedAfter, params.CreatedBefore, after, before)
+		case "updated":
+			after, before, err := ParseDateFilter(value)
+			if err != nil {
+				return err
+			}
+			params.UpdatedAfter, params.UpdatedBefore = mergeRange(params.UpdatedAfter, params.UpdatedBefore, after, before)
+		case "shared", "is_shared":
+			shared, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("invalid shared filter %q", token.value)
+			}
+			params.Shared = &shared
+		case "template", "is_template":
+			template, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("invalid template filter %q", token.value)
+			}
+			params.Template = &template
+		case "under":
+			if _, err := uuid.FromString(value); err != nil {
+				return fmt.Errorf("invalid under filter %q", token.value)
+			}
+			params.Under = value
+		case "parent":
+			if value == "root" {
+				value = ""
+			} else if _, err := uuid.FromString(value); err != nil {
+				return fmt.Errorf("invalid parent filter %q", token.value)
+			}
+			params.Parent = &value
+		case "sort":
+			sort, order, _ := strings.Cut(value, "-")
+			params.Sort = sort
+			if order != "" {
+				params.Order = order
+			}
+		default:
+			text = append(text, token.value)
+		}
+	}
+	params.Text = strings.Join(text, " ")
+	return nil
+}
+
+// ParseTagPath splits a tag such as @project/backend into its path segments
+func ParseTagPath(tag string) []string {
+	var path []string
+	for _, segment := range strings.Split(strings.TrimPrefix(tag, "@"), "/") {
+		if segment = strings.TrimSpace(segment); segment != "" {
+			path = append(path, segment)
+		}
+	}
+	return path
+}
+
+// ParseDateFilter turns a date expression into a half-open range. Either bound
+// may be nil. Dates are YYYY-MM-DD or RFC 3339 timestamps, optionally prefixed
+// by >, >=, < or <=, or written as a range a..b. A bare day matches that day.
+func ParseDateFilter(expr string) (after *time.Time, before *time.Time, err error) {
+	if from, to, ok := strings.Cut(expr, ".."); ok {
+		if from != "" {
+			start, _, err := parseDay(from)
+			if err != nil {
+				return nil, nil, err
+			}
+			after = &start
+		}
+		if to != "" {
+			_, end, err := parseDay(to)
+			if err != nil {
+				return nil, nil, err
+			}
+			before = &end
+		}
+		return after, before, nil
+	}
+
+	for _, op := range []string{">=", "<=", ">", "<", "="} {
+		if !strings.HasPrefix(expr, op) {
+			continue
+		}
+		start, end, err := parseDay(strings.TrimPrefix(expr, op))
+		if err != nil {
+			return nil, nil, err
+		}
+		switch op {
+		case ">=":
+			return &start, nil, nil
+		case ">":
+			return &end, nil, nil
+		case "<=":
+			return nil, &end, nil
+		case "<":
+			return nil, &start, nil
+		}
+		return &start, &end, nil
+	}
+
+	start, end, err := parseDay(expr)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &start, &end, nil
+}
+
+// parseDay parses a day or timestamp and returns the range it covers. A
+// timestamp covers the microsecond it falls in, the precision Postgres stores.
+func parseDay(value string) (time.Time, time.Time, error) {
+	if day, err := time.Parse("2006-01-02", value); err == nil {
+		return day, day.AddDate(0, 0, 1), nil
+	}
+	if instant, err := time.Parse(time.RFC3339, value); err == nil {
+		instant = instant.UTC().Truncate(time.Microsecond)
+		return instant, instant.Add(time.Microsecond), nil
+	}
+	return time.Time{}, time.Time{}, fmt.Errorf("invalid date %q, expected YYYY-MM-DD or RFC 3339", value)
+}
+
+// mergeRange narrows an existing range by another one
+func mergeRange(after, before, newAfter, newBefore *time.Time) (*time.Time, *time.Time) {
+	if newAfter != nil && (after == nil || newAfter.After(*after)) {
+		after = newAfter
+	}
+	if newBefore != nil && (before == nil || newBefore.Before(*before)) {
+		before = newBefore
+	}
+	return after, before
+}
+
+type queryToken struct {
+	value  string
+	quoted bool
+}
+
+// tokenizeQuery splits a query on whitespace, keeping quoted phrases and
+// quoted filter values such as tag:"my tag" together
+func tokenizeQuery(input string) []queryToken {
+	var tokens []queryToken
+	var current strings.Builder
+	inQuotes := false
+	quotedToken := false
+
+	flush := func() {
+		if current.Len() > 0 {
+			tokens = append(tokens, queryToken{value: current.String(), quoted: quotedToken})
+		}
+		current.Reset()
+		quotedToken = false
+	}
+
+	for _, r := range input {
+		switch {
+		case r == '"' && inQuotes:
+			inQuotes = false
+			if quotedToken {
+				flush()
+			} else {
+				current.WriteRune(r)
+			}
+		case r == '"':
+			inQuotes = true
+			if current.Len() == 0 {
+				quotedToken = true
+			} else {
+				current.WriteRune(r)
+			}
+		case !inQuotes && (r == ' ' || r == '\t' || r == '\n'):
+			flush()
+		default:
+			current.WriteRune(r)
+		}
+	}
+	flush()
+	return tokens
+}
@@ -0,0 +1,209 @@
+package notes
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTokenizeQuery(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  []queryToken
+	}{
+		{
+			name:  "empty",
+			input: "  ",
+			want:  nil,
+		},
+		{
+			name:  "whitespace separated",
+			input: "alpha\tbeta\n gamma",
+			want:  []queryToken{{value: "alpha"}, {value: "beta"}, {value: "gamma"}},
+		},
+		{
+			name:  "quoted phrase",
+			input: `find "exact words" here`,
+			want:  []queryToken{{value: "find"}, {value: "exact words", quoted: true}, {value: "here"}},
+		},
+		{
+			name:  "quoted filter value stays with its key",
+			input: `tag:"my tag" rest`,
+			want:  []queryToken{{value: `tag:"my tag"`}, {value: "rest"}},
+		},
+		{
+			name:  "unterminated quote runs to the end",
+			input: `"open phrase`,
+			want:  []queryToken{{value: "open phrase", quoted: true}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tokenizeQuery(tt.input); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("tokenizeQuery(%q) = %#v, want %#v", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseDateFilter(t *testing.T) {
+	day := func(s string) *time.Time {
+		d, err := time.Parse("2006-01-02", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &d
+	}
+	instant := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	micro := instant.Add(time.Microsecond)
+
+	tests := []struct {
+		expr       string
+		wantAfter  *time.Time
+		wantBefore *time.Time
+		wantErr    bool
+	}{
+		{expr: "2025-01-02", wantAfter: day("2025-01-02"), wantBefore: day("2025-01-03")},
+		{expr: "=2025-01-02", wantAfter: day("2025-01-02"), wantBefore: day("2025-01-03")},
+		{expr: ">2025-01-02", wantAfter: day("2025-01-03")},
+		{expr: ">=2025-01-02", wantAfter: day("2025-01-02")},
+		{expr: "<2025-01-02", wantBefore: day("2025-01-02")},
+		{expr: "<=2025-01-02", wantBefore: day("2025-01-03")},
+		{expr: "2025-01-01..2025-01-31", wantAfter: day("2025-01-01"), wantBefore: day("2025-02-01")},
+		{expr: "2025-01-01..", wantAfter: day("2025-01-01")},
+		{expr: "..2025-01-31", wantBefore: day("2025-02-01")},
+		// Timestamps cover the microsecond Postgres stores them with
+		{expr: ">2025-01-02T03:04:05Z", wantAfter: &micro},
+		{expr: ">=2025-01-02T05:04:05+02:00", wantAfter: &instant},
+		{expr: "<=2025-01-02T03:04:05Z", wantBefore: &micro},
+		{expr: "2025-01-02T03:04:05Z", wantAfter: &instant, wantBefore: &micro},
+		{expr: "yesterday", wantErr: true},
+		{expr: ">", wantErr: true},
+		{expr: "2025-13-01", wantErr: true},
+		{expr: "2025-01-01..soon", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			after, before, err := ParseDateFilter(tt.expr)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ParseDateFilter(%q) succeeded, want an error", tt.expr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseDateFilter(%q): %v", tt.expr, err)
+			}
+			if !equalTime(after, tt.wantAfter) {
+				t.Errorf("after = %v, want %v", after, tt.wantAfter)
+			}
+			if !equalTime(before, tt.wantBefore) {
+				t.Errorf("before = %v, want %v", before, tt.wantBefore)
+			}
+		})
+	}
+}
+
+func equalTime(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
+
+func TestParseSearchQuery(t *testing.T) {
+	noteID := "6ba7b810-9dad-11d1-80b4-00c04fd430c8"
+	root := ""
+	parent := noteID
+	yes := true
+	no := false
+	jan := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	feb := time.Date(2025, 2, 1, 0, 0, 0, 0, time.UTC)
+	mar := time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		input   string
+		want    SearchParams
+		wantErr bool
+	}{
+		{
+			name:  "free text only",
+			input: "meeting notes",
+			want:  SearchParams{Text: "meeting notes"},
+		},
+		{
+			name:  "phrase is kept in the text",
+			input: `plan "next quarter"`,
+			want:  SearchParams{Text: `plan "next quarter"`, Phrases: []string{"next quarter"}},
+		},
+		{
+			name:  "tags",
+			input: `tag:@work/q1 tag:"home life"`,
+			want:  SearchParams{TagPrefixes: [][]string{{"work", "q1"}, {"home life"}}},
+		},
+		{
+			name:  "date ranges narrow each other",
+			input: "created:>=2025-01-01 created:<2025-03-01 updated:2025-01-01..2025-01-31 created:<2025-02-01",
+			want:  SearchParams{CreatedAfter: &jan, CreatedBefore: &feb, UpdatedAfter: &jan, UpdatedBefore: &feb},
+		},
+		{
+			name:  "later after bound wins",
+			input: "created:>=2025-01-01 created:>=2025-03-01",
+			want:  SearchParams{CreatedAfter: &mar},
+		},
+		{
+			name:  "flags",
+			input: "shared:true is_template:false",
+			want:  SearchParams{Shared: &yes, Template: &no},
+		},
+		{
+			name:  "under and parent",
+			input: "under:" + noteID + " parent:" + noteID,
+			want:  SearchParams{Under: noteID, Parent: &parent},
+		},
+		{
+			name:  "root parent",
+			input: "parent:root",
+			want:  SearchParams{Parent: &root},
+		},
+		{
+			name:  "sort with order",
+			input: "sort:title-desc",
+			want:  SearchParams{Sort: "title", Order: "desc"},
+		},
+		{
+			name:  "unknown keys and empty values are text",
+			input: "http://example.com note:",
+			want:  SearchParams{Text: "http://example.com note:"},
+		},
+		{name: "empty tag", input: "tag:@/", wantErr: true},
+		{name: "bad date", input: "created:yesterday", wantErr: true},
+		{name: "bad shared", input: "shared:maybe", wantErr: true},
+		{name: "bad template", input: "template:maybe", wantErr: true},
+		{name: "bad under", input: "under:nope", wantErr: true},
+		{name: "bad parent", input: "parent:nope", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var params SearchParams
+			err := ParseSearchQuery(tt.input, &params)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ParseSearchQuery(%q) succeeded, want an error", tt.input)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseSearchQuery(%q): %v", tt.input, err)
+			}
+			if !reflect.DeepEqual(params, tt.want) {
+				t.Errorf("params = %+v, want %+v", params, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,221 @@
+package notes
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQuerySQL(t *testing.T) {
+	tests := []struct {
+		name      string
+		build     func() *Query
+		wantSQL   string
+		wantCount string
+		wantArgs  []interface{}
+	}{
+		{
+			name: "bare",
+			build: func() *Query {
+				return NewQuery("notes")
+			},
+			wantSQL:   "SELECT 1 FROM notes",
+			wantCount: "SELECT COUNT(*) FROM (SELECT 1 FROM notes) counted",
+			wantArgs:  []interface{}{},
+		},
+		{
+			name: "where numbers placeholders in call order",
+			build: func() *Query {
+				q := NewQuery("notes").Select("id", "title")
+				q.Where("user_id = "+q.Arg("u"), "parent = "+q.Arg("p"))
+				q.Where("title = " + q.Arg("t"))
+				return q
+			},
+			wantSQL:   "SELECT id, title FROM notes WHERE user_id = $1 AND parent = $2 AND title = $3",
+			wantCount: "SELECT COUNT(*) FROM (SELECT id, title FROM notes WHERE user_id = $1 AND parent = $2 AND title = $3) counted",
+			wantArgs:  []interface{}{"u", "p", "t"},
+		},
+		{
+			name: "count drops ordering and paging",
+			build: func() *Query {
+				q := NewQuery("notes").Select("id")
+				q.Where("user_id = "+q.Arg("u")).OrderBy("updated_at DESC", "id").Page(50, 100)
+				return q
+			},
+			wantSQL:   "SELECT id FROM notes WHERE user_id = $1 ORDER BY updated_at DESC, id LIMIT 50 OFFSET 100",
+			wantCount: "SELECT COUNT(*) FROM (SELECT id FROM notes WHERE user_id = $1) counted",
+			wantArgs:  []interface{}{"u"},
+		},
+		{
+			name: "first page has no offset",
+			build: func() *Query {
+				return NewQuery("notes").Select("id").Page(20, 0)
+			},
+			wantSQL:   "SELECT id FROM notes LIMIT 20",
+			wantCount: "SELECT COUNT(*) FROM (SELECT id FROM notes) counted",
+			wantArgs:  []interface{}{},
+		},
+		{
+			name: "subqueries share argument numbering with their parent",
+			build: func() *Query {
+				q := NewQuery("fused f")
+				q.With("q AS (SELECT " + q.Arg("text") + " AS query)")
+				inner := q.Subquery("notes").Select("id").Where("user_id = " + q.Arg("u"))
+				inner.Where("title = " + inner.Arg("t"))
+				innerSQL, _ := inner.SQL()
+				q.With("fused AS (" + innerSQL + ")")
+				q.Select("f.id").Where("f.id <> " + q.Arg("x"))
+				return q
+			},
+			wantSQL:   "WITH q AS (SELECT $1 AS query), fused AS (SELECT id FROM notes WHERE user_id = $2 AND title = $3) SELECT f.id FROM fused f WHERE f.id <> $4",
+			wantCount: "WITH q AS (SELECT $1 AS query), fused AS (SELECT id FROM notes WHERE user_id = $2 AND title = $3) SELECT COUNT(*) FROM (SELECT f.id FROM fused f WHERE f.id <> $4) counted",
+			wantArgs:  []interface{}{"text", "u", "t", "x"},
+		},
+		{
+			name: "recursive with and joins",
+			build: func() *Query {
+				q := NewQuery("tree t")
+				q.WithRecursive("tree AS (SELECT id FROM notes WHERE id = " + q.Arg("root") + ")")
+				q.Join("INNER JOIN notes n ON n.id = t.id").Select("n.id")
+				return q
+			},
+			wantSQL:   "WITH RECURSIVE tree AS (SELECT id FROM notes WHERE id = $1) SELECT n.id FROM tree t INNER JOIN notes n ON n.id = t.id",
+			wantCount: "WITH RECURSIVE tree AS (SELECT id FROM notes WHERE id = $1) SELECT COUNT(*) FROM (SELECT n.id FROM tree t INNER JOIN notes n ON n.id = t.id) counted",
+			wantArgs:  []interface{}{"root"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := tt.build()
+			sql, args := q.SQL()
+			if sql != tt.wantSQL {
+				t.Errorf("SQL() = %q, want %q", sql, tt.wantSQL)
+			}
+			if !reflect.DeepEqual(args, tt.wantArgs) {
+				t.Errorf("SQL() args = %v, want %v", args, tt.wantArgs)
+			}
+			countSQL, countArgs := q.CountSQL()
+			if countSQL != tt.wantCount {
+				t.Errorf("CountSQL() = %q, want %q", countSQL, tt.wantCount)
+			}
+			if !reflect.DeepEqual(countArgs, tt.wantArgs) {
+				t.Errorf("CountSQL() args = %v, want %v", countArgs, tt.wantArgs)
+			}
+		})
+	}
+}
+
+func TestSelectNote(t *testing.T) {
+	sql, _ := NewQuery("notes n").SelectNote("n", []string{"id", "title", "tags"}).SQL()
+	want := "SELECT n.id AS id, n.title AS title, COALESCE(n.tags, '[]'::jsonb) AS tags FROM notes n"
+	if sql != want {
+		t.Errorf("SQL() = %q, want %q", sql, want)
+	}
+}
+
+func TestFilterNotes(t *testing.T) {
+	parent := "p1"
+	root := ""
+	after := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	before := time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)
+	shared := true
+
+	tests := []struct {
+		name     string
+		params   SearchParams
+		contains []string
+		excludes []string
+		wantArgs []interface{}
+	}{
+		{
+			name:     "owner only",
+			params:   SearchParams{},
+			contains: []string{"WHERE notes.user_id = $1 AND notes.id NOT IN (SELECT trashed_note_ids($1))"},
+			excludes: []string{"parent", "tags"},
+			wantArgs: []interface{}{"u"},
+		},
+		{
+			name:     "parent",
+			params:   SearchParams{Parent: &parent},
+			contains: []string{"notes.parent = $2"},
+			wantArgs: []interface{}{"u", "p1"},
+		},
+		{
+			name:     "root notes",
+			params:   SearchParams{Parent: &root},
+			contains: []string{"notes.parent IS NULL"},
+			wantArgs: []interface{}{"u"},
+		},
+		{
+			name:     "parent and subtree",
+			params:   SearchParams{Parent: &parent, Under: "r1"},
+			contains: []string{"notes.parent = $2", "WHERE parent = $3 AND user_id = $4"},
+			wantArgs: []interface{}{"u", "p1", "r1", "u"},
+		},
+		{
+			name:     "tag prefix",
+			params:   SearchParams{TagPrefixes: [][]string{{"work", "q1"}}},
+			contains: []string{"notes.tags @> $2::jsonb", "[1:2] = $3::text[]"},
+			wantArgs: []interface{}{"u", `[{"path":["work","q1"]}]`, []string{"work", "q1"}},
+		},
+		{
+			name:     "dates",
+			params:   SearchParams{CreatedAfter: &after, CreatedBefore: &before, UpdatedAfter: &after, UpdatedBefore: &before},
+			contains: []string{"notes.created_at >= $2", "notes.created_at < $3", "notes.updated_at >= $4", "notes.updated_at < $5"},
+			wantArgs: []interface{}{"u", after, before, after, before},
+		},
+		{
+			name:     "phrase and shared",
+			params:   SearchParams{Phrases: []string{"exact words"}, Shared: &shared},
+			contains: []string{"lower($2)) > 0", "COALESCE(notes.is_shared, false) = $3"},
+			wantArgs: []interface{}{"u", "exact words", true},
+		},
+		{
+			name:     "search text and mode add no conditions",
+			params:   SearchParams{Text: "query", Mode: SearchModeKeyword},
+			excludes: []string{"query", "search_vector"},
+			wantArgs: []interface{}{"u"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := NewQuery("notes").Select("notes.id")
+			filterNotes(q, "u", tt.params, "notes")
+			sql, args := q.SQL()
+			for _, s := range tt.contains {
+				if !strings.Contains(sql, s) {
+					t.Errorf("SQL %q does not contain %q", sql, s)
+				}
+			}
+			for _, s := range tt.excludes {
+				if strings.Contains(sql, s) {
+					t.Errorf("SQL %q contains %q", sql, s)
+				}
+			}
+			if !reflect.DeepEqual(args, tt.wantArgs) {
+				t.Errorf("args = %#v, want %#v", args, tt.wantArgs)
+			}
+		})
+	}
+}
+
+func TestSearchOrder(t *testing.T) {
+	tests := []struct {
+		params SearchParams
+		want   string
+	}{
+		{SearchParams{}, "n.updated_at DESC, n.id"},
+		{SearchParams{Text: "query", Mode: SearchModeHybrid}, "f.score DESC, n.updated_at DESC"},
+		{SearchParams{Text: "query", Sort: "created"}, "n.created_at DESC, n.id"},
+		{SearchParams{Sort: "title"}, "n.title ASC, n.id"},
+		{SearchParams{Sort: "position", Order: "desc"}, "n.position DESC, n.id"},
+	}
+	for _, tt := range tests {
+		if got := searchOrder(tt.params, "n", "f.score DESC"); got != tt.want {
+			t.Errorf("searchOrder(%+v) = %q, want %q", tt.params, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package notes
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/pgvector/pgvector-go"
+)
+
+// snippetLength is the number of characters of markdown returned as a snippet
+const snippetLength = 200
+
+// ancestorsOf returns a subquery selecting the ids of every ancestor of the
+// note whose id placeholder is noteArg
+func ancestorsOf(noteArg string) string {
+	return `(
+		WITH RECURSIVE ancestors AS (
+			SELECT parent AS id FROM notes WHERE id = ` + noteArg + `
+			UNION ALL
+			SELECT n.parent FROM notes n
+			INNER JOIN ancestors a ON n.id = a.id
+		)
+		SELECT id FROM ancestors WHERE id IS NOT NULL
+	)`
+}
+
+// descendantsOf returns a subquery selecting the ids of every descendant of
+// the note whose id placeholder is noteArg that has the note's owner
+func descendantsOf(noteArg string) string {
+	return `(
+		WITH RECURSIVE descendants AS (
+			SELECT c.id, c.user_id FROM notes c
+			INNER JOIN notes p ON p.id = c.parent AND p.user_id = c.user_id
+			WHERE p.id = ` + noteArg + `
+			UNION ALL
+			SELECT n.id, n.user_id FROM notes n
+			INNER JOIN descendants d ON n.parent = d.id
+			WHERE n.user_id = d.user_id
+		)
+		SELECT id FROM descendants
+	)`
+}
+
+// snippet shortens markdown to a single line of at most n characters
+func snippet(markdown string, n int) string {
+	text := strings.Join(strings.Fields(markdown), " ")
+	if utf8.RuneCountInString(text) <= n {
+		return text
+	}
+	runes := []rune(text)[:n]
+	if i := strings.LastIndexByte(string(runes), ' '); i > n/2 {
+		return string(runes)[:i] + "…"
+	}
+	return string(runes) + "…"
+}
+
+// GetRelatedNotes returns the nearest neighbours of a note by embedding
+func GetRelatedNotes(c *gin.Context) {
+	userID := c.GetString("user_id")
+	noteID := c.Param("id")
+
+	limit := 10
+	if limitStr := c.Query("limit"); limitStr != "" {
+		l, err := strconv.Atoi(limitStr)
+		if err != nil || l <= 0 || l > 50 {
+			c.JSON(400, gin.H{"error": "Invalid limit, expected 1 to 50"})
+			return
+		}
+		limit = l
+	}
+
+	var distance float64
+	if distanceStr := c.Query("distance"); distanceStr != "" {
+		d, err := strconv.ParseFloat(distanceStr, 64)
+		if err != nil || d <= 0 {
+			c.JSON(400, gin.H{"error": "Invalid distance threshold"})
+			return
+		}
+		distance = d
+	}
+
+	excludeFamily, _ := strconv.ParseBool(c.Query("exclude_family"))
+
+	db := c.MustGet("db").(*pgxpool.Pool)
+	access, ok := AuthorizeNote(c, db, noteID, RoleViewer)
+	if !ok {
+		return
+	}
+
+	var embedding *pgvector.Vector
+	err := db.QueryRow(context.Background(), "SELECT embedding FROM notes WHERE id = $1", noteID).Scan(&embedding)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	// Notes saved while embeddings were unavailable have nothing to compare
+	if embedding == nil {
+		c.JSON(200, gin.H{"notes": []Note{}})
+		return
+	}
+
+	fields := []string{"id", "title", "parent", "created_at", "updated_at", "is_shared", "tags", "has_children", "has_embedding"}
+	q := NewQuery("notes").SelectNote("notes", fields)
+	filterNotes(q, access.OwnerID, SearchParams{}, "notes")
+	readableBy(q, "notes", access, userID)
+	note := q.Arg(noteID)
+	metric := CurrentDistanceMetric()
+	distanceExpr := metric.Distance("notes.embedding", q.Arg(*embedding))
+	q.Where("notes.id <> "+note, "notes.embedding IS NOT NULL")
+	if distance > 0 {
+		q.Where(distanceExpr + " < " + q.Arg(metric.Threshold(distance)))
+	}
+	if excludeFamily {
+		q.Where("notes.id NOT IN "+ancestorsOf(note), "notes.id NOT IN "+descendantsOf(note))
+	}
+	q.Select(metric.Normalize(distanceExpr)+" AS distance", "left(COALESCE(notes.markdown, ''), 1000) AS snippet").
+		OrderBy(distanceExpr).
+		Page(limit, 0)
+
+	sql, args := q.SQL()
+	rows, err := db.Query(context.Background(), sql, args...)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	related, err := scanNotes(rows, fields, func(note *Note) []interface{} {
+		return []interface{}{&note.Distance, &note.Snippet}
+	})
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	for i := range related {
+		related[i].Snippet = snippet(related[i].Snippet, snippetLength)
+	}
+
+	c.JSON(200, gin.H{"notes": related})
+}
@@ -0,0 +1,325 @@
+package notes
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	uuid "github.com/satori/go.uuid"
+	"github.com/stevecastle/modelpad/markdown"
+	"github.com/stevecastle/modelpad/textdiff"
+)
+
+// diffContext is the number of unchanged lines shown around each change
+const diffContext = 3
+
+type Revision struct {
+	ID        uuid.UUID  `json:"id"`
+	NoteID    uuid.UUID  `json:"note_id"`
+	BranchID  *uuid.UUID `json:"branch_id,omitempty"`
+	Name      *string    `json:"name,omitempty"`
+	Title     string     `json:"title"`
+	Body      string     `json:"body,omitempty"`
+	Size      int        `json:"size"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// getRevision loads a revision of a note owned by the user
+func getRevision(db *pgxpool.Pool, noteID string, revisionID string, userID string) (Revision, error) {
+	var revision Revision
+	var encoding string
+	var body *string
+	var data, keyframe []byte
+	err := db.QueryRow(context.Background(), `
+		SELECT r.id, r.note_id, r.branch_id, r.name, COALESCE(r.title, ''), r.created_at, `+revisionBodyColumns+`
+		FROM revisions r
+		INNER JOIN notes n ON n.id = r.note_id
+		WHERE r.id = $1 AND r.note_id = $2 AND n.user_id = $3`,
+		revisionID, noteID, userID).Scan(&revision.ID, &revision.NoteID, &revision.BranchID, &revision.Name, &revision.Title, &revision.CreatedAt,
+		&encoding, &body, &data, &keyframe)
+	if err != nil {
+		return revision, err
+	}
+	revision.Body, err = decodeRevision(encoding, body, data, keyframe)
+	revision.Size = len(revision.Body)
+	return revision, err
+}
+
+// ListRevisions returns a page of a note's revisions, newest first, without
+// bodies. The branch query parameter lists a branch's revisions instead of
+// the main body's.
+func ListRevisions(c *gin.Context) {
+	noteID := c.Param("id")
+
+	page := 1
+	if pageStr := c.Query("page"); pageStr != "" {
+		if p, err := json.Number(pageStr).Int64(); err == nil && p > 0 {
+			page = int(p)
+		}
+	}
+
+	limit := 50
+	if limitStr := c.Query("limit"); limitStr != "" {
+		if l, err := json.Number(limitStr).Int64(); err == nil && l > 0 && l <= 200 {
+			limit = int(l)
+		}
+	}
+
+	db := c.MustGet("db").(*pgxpool.Pool)
+	access, ok := AuthorizeNote(c, db, noteID, RoleViewer)
+	if !ok {
+		return
+	}
+	owner := access.OwnerID
+
+	var branchID *uuid.UUID
+	if name := c.Query("branch"); name != "" {
+		branch, err := getBranch(db, noteID, name, owner)
+		if errors.Is(err, pgx.ErrNoRows) {
+			c.JSON(404, gin.H{"error": "Branch not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		branchID = &branch.ID
+	}
+
+	var totalCount int
+	err := db.QueryRow(context.Background(),
+		"SELECT COUNT(*) FROM revisions WHERE note_id = $1 AND branch_id IS NOT DISTINCT FROM $2",
+		noteID, branchID).Scan(&totalCount)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	rows, err := db.Query(context.Background(), `
+		SELECT id, note_id, branch_id, name, COALESCE(title, ''), COALESCE(size, octet_length(body), 0), created_at
+		FROM revisions
+		WHERE note_id = $1 AND branch_id IS NOT DISTINCT FROM $2
+		ORDER BY created_at DESC, id
+		LIMIT $3 OFFSET $4`, noteID, branchID, limit, (page-1)*limit)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	revisions := []Revision{}
+	for rows.Next() {
+		var revision Revision
+		if err := rows.Scan(&revision.ID, &revision.NoteID, &revision.BranchID, &revision.Name, &revision.Title, &revision.Size, &revision.CreatedAt); err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		revisions = append(revisions, revision)
+	}
+
+	c.JSON(200, gin.H{
+		"revisions": revisions,
+		"pagination": PaginationInfo{
+			Page:    page,
+			Limit:   limit,
+			Total:   totalCount,
+			HasMore: page*limit < totalCount,
+		},
+	})
+}
+
+// GetRevision returns a single revision including its body
+func GetRevision(c *gin.Context) {
+	db := c.MustGet("db").(*pgxpool.Pool)
+
+	access, ok := AuthorizeNote(c, db, c.Param("id"), RoleViewer)
+	if !ok {
+		return
+	}
+	owner := access.OwnerID
+
+	revision, err := getRevision(db, c.Param("id"), c.Param("rev"), owner)
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.JSON(404, gin.H{"error": "Revision not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(200, gin.H{"revision": revision})
+}
+
+// DiffRevision compares a revision with another one as a markdown text diff.
+// The against query parameter names the revision to compare from, or
+// "current" for the note as it is now. It defaults to the previous revision
+// of the same branch.
+func DiffRevision(c *gin.Context) {
+	noteID := c.Param("id")
+	db := c.MustGet("db").(*pgxpool.Pool)
+
+	access, ok := AuthorizeNote(c, db, noteID, RoleViewer)
+	if !ok {
+		return
+	}
+	owner := access.OwnerID
+
+	to, err := getRevision(db, noteID, c.Param("rev"), owner)
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.JSON(404, gin.H{"error": "Revision not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	var from Revision
+	fromName := "empty"
+	switch against := c.Query("against"); against {
+	case "":
+		var previousID uuid.UUID
+		err = db.QueryRow(context.Background(), `
+			SELECT id FROM revisions
+			WHERE note_id = $1 AND branch_id IS NOT DISTINCT FROM $2 AND created_at < $3
+			ORDER BY created_at DESC
+			LIMIT 1`, noteID, to.BranchID, to.CreatedAt).Scan(&previousID)
+		if err == nil {
+			from, err = getRevision(db, noteID, previousID.String(), owner)
+			fromName = previousID.String()
+		} else if errors.Is(err, pgx.ErrNoRows) {
+			// The first revision is compared with an empty note
+			err = nil
+		}
+	case "current":
+		err = db.QueryRow(context.Background(),
+			"SELECT id, COALESCE(title, ''), COALESCE(body, ''), updated_at FROM notes WHERE id = $1 AND user_id = $2",
+			noteID, owner).Scan(&from.NoteID, &from.Title, &from.Body, &from.CreatedAt)
+		from.Size = len(from.Body)
+		fromName = "current"
+	default:
+		from, err = getRevision(db, noteID, against, owner)
+		fromName = against
+	}
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.JSON(404, gin.H{"error": "Revision to compare against not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	fromText, err := revisionMarkdown(from)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Error converting revision: " + err.Error()})
+		return
+	}
+	toText, err := revisionMarkdown(to)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Error converting revision: " + err.Error()})
+		return
+	}
+
+	edits := textdiff.Lines(textdiff.SplitLines(fromText), textdiff.SplitLines(toText))
+	added, removed := textdiff.Stats(edits)
+	from.Body, to.Body = "", ""
+
+	c.JSON(200, gin.H{
+		"from":    from,
+		"to":      to,
+		"diff":    textdiff.Unified(fromName, to.ID.String(), edits, diffContext),
+		"added":   added,
+		"removed": removed,
+	})
+}
+
+// revisionMarkdown renders a revision as markdown headed by its title
+func revisionMarkdown(revision Revision) (string, error) {
+	if revision.Body == "" {
+		return "", nil
+	}
+	text, err := markdown.ConvertJSONToMarkdown(revision.Body)
+	if err != nil {
+		return "", err
+	}
+	return "# " + revision.Title + "\n\n" + text, nil
+}
+
+// RestoreRevision makes a revision the current body of its note. The restore
+// is itself saved as a new revision so it can be undone.
+func RestoreRevision(c *gin.Context) {
+	noteID := c.Param("id")
+	db := c.MustGet("db").(*pgxpool.Pool)
+
+	access, ok := AuthorizeNote(c, db, noteID, RoleEditor)
+	if !ok {
+		return
+	}
+	owner := access.OwnerID
+
+	revision, err := getRevision(db, noteID, c.Param("rev"), owner)
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.JSON(404, gin.H{"error": "Revision not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	bodyMarkdown, newVector, err := renderNote(revision.Title, revision.Body)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	_, err = tx.Exec(context.Background(),
+		"UPDATE notes SET title = $1, body = $2, markdown = $3, embedding = $4, updated_at = now(), version = version + 1 WHERE id = $5 AND user_id = $6",
+		revision.Title, revision.Body, bodyMarkdown, newVector, noteID, owner)
+	if err != nil {
+		tx.Rollback(context.Background())
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	var restored Revision
+	err = tx.QueryRow(context.Background(),
+		"INSERT INTO revisions (note_id, title, body, user_id, size) VALUES ($1, $2, $3, $4, $5) RETURNING id, note_id, title, created_at",
+		noteID, revision.Title, revision.Body, owner, len(revision.Body)).Scan(&restored.ID, &restored.NoteID, &restored.Title, &restored.CreatedAt)
+	if err != nil {
+		tx.Rollback(context.Background())
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	restored.Size = len(revision.Body)
+
+	if err := saveLinks(tx, revision.NoteID, revision.Body); err != nil {
+		tx.Rollback(context.Background())
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	err = tx.Commit(context.Background())
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"message":       "Revision restored",
+		"restored_from": revision.ID,
+		"revision":      restored,
+	})
+}
@@ -0,0 +1,272 @@
+package notes
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/pgvector/pgvector-go"
+	"github.com/stevecastle/modelpad/embeddings"
+)
+
+// Search modes accepted by ListNotes
+const (
+	SearchModeKeyword  = "keyword"
+	SearchModeSemantic = "semantic"
+	SearchModeHybrid   = "hybrid"
+)
+
+// rrfK is the rank constant for reciprocal rank fusion. Larger values flatten
+// the difference between the top results of each ranking.
+const rrfK = 60
+
+// hybridCandidates is how many results each ranking contributes before fusion
+const hybridCandidates = 200
+
+// semanticCandidates is how many of the nearest notes a semantic search
+// filters and pages through
+const semanticCandidates = 200
+
+// Matches are delimited by control characters in ts_headline output, which
+// become <mark> tags once the note text around them is HTML escaped
+const (
+	highlightStart = "\x02"
+	highlightStop  = "\x03"
+)
+
+// headlineOptions controls the match highlights returned by ts_headline
+const headlineOptions = "StartSel=\"" + highlightStart + "\", StopSel=\"" + highlightStop + "\", MaxFragments=3, MaxWords=20, MinWords=5, FragmentDelimiter=\" … \""
+
+// highlightMarker turns the delimited matches of a headline into <mark> tags
+var highlightMarker = strings.NewReplacer(highlightStart, "<mark>", highlightStop, "</mark>")
+
+// highlightHTML escapes a headline and marks its matches
+func highlightHTML(headline string) string {
+	return highlightMarker.Replace(html.EscapeString(headline))
+}
+
+// ValidSearchMode reports whether mode is one of the supported search modes
+func ValidSearchMode(mode string) bool {
+	switch mode {
+	case SearchModeKeyword, SearchModeSemantic, SearchModeHybrid:
+		return true
+	}
+	return false
+}
+
+// Sort keys accepted by ListNotes
+var sortColumns = map[string]string{
+	"updated": "updated_at",
+	"created": "created_at",
+	"title":   "title",
+	// Manual order among siblings
+	"position": "position",
+}
+
+// validSort reports whether sort and order name a supported ordering
+func validSort(sort string, order string) bool {
+	if _, ok := sortColumns[sort]; !ok && sort != "" && sort != "relevance" {
+		return false
+	}
+	return order == "" || order == "asc" || order == "desc"
+}
+
+// searchOrder returns the ORDER BY expression for params. Relevance ordering,
+// the default when searching, uses relevance as given by the caller.
+func searchOrder(params SearchParams, table string, relevance string) string {
+	sort := params.Sort
+	if sort == "" {
+		sort = "updated"
+		if params.Text != "" {
+			sort = "relevance"
+		}
+	}
+	column, ok := sortColumns[sort]
+	if !ok {
+		return relevance + ", " + table + ".updated_at DESC"
+	}
+	order := "DESC"
+	if params.Order == "asc" || (params.Order == "" && (sort == "title" || sort == "position")) {
+		order = "ASC"
+	}
+	return fmt.Sprintf("%s.%s %s, %s.id", table, column, order, table)
+}
+
+// filterNotes restricts q to the user's notes matching the filters in params.
+// alias names the notes table in q.
+func filterNotes(q *Query, userID string, params SearchParams, alias string) *Query {
+	user := q.Arg(userID)
+	q.Where(alias+".user_id = "+user, notTrashed(alias, user))
+
+	if params.Parent != nil {
+		if *params.Parent == "" {
+			q.Where(alias + ".parent IS NULL")
+		} else {
+			q.Where(alias + ".parent = " + q.Arg(*params.Parent))
+		}
+	}
+
+	// Anywhere below a note, not just its direct children
+	if params.Under != "" {
+		q.Where(fmt.Sprintf(`%[1]s.id IN (
+			WITH RECURSIVE subtree AS (
+				SELECT id FROM notes WHERE parent = %[2]s AND user_id = %[3]s
+				UNION ALL
+				SELECT n.id FROM notes n
+				INNER JOIN subtree s ON n.parent = s.id
+				WHERE n.user_id = %[3]s
+			)
+			SELECT id FROM subtree
+		)`, alias, q.Arg(params.Under), q.Arg(userID)))
+	}
+
+	// Containment narrows candidates through the GIN index on tags, the
+	// path comparison then keeps only tags that start with the prefix
+	for _, prefix := range params.TagPrefixes {
+		contains, _ := json.Marshal([]map[string][]string{{"path": prefix}})
+		q.Where(fmt.Sprintf(`%[1]s.tags @> %[2]s::jsonb AND EXISTS (
+			SELECT 1 FROM jsonb_array_elements(%[1]s.tags) t
+			WHERE (ARRAY(SELECT jsonb_array_elements_text(t->'path')))[1:%[3]d] = %[4]s::text[]
+		)`, alias, q.Arg(string(contains)), len(prefix), q.Arg(prefix)))
+	}
+
+	for _, phrase := range params.Phrases {
+		q.Where(fmt.Sprintf("strpos(lower(COALESCE(%[1]s.title, '') || ' ' || COALESCE(%[1]s.markdown, '')), lower(%[2]s)) > 0", alias, q.Arg(phrase)))
+	}
+
+	if params.CreatedAfter != nil {
+		q.Where(alias + ".created_at >= " + q.Arg(*params.CreatedAfter))
+	}
+	if params.CreatedBefore != nil {
+		q.Where(alias + ".created_at < " + q.Arg(*params.CreatedBefore))
+	}
+	if params.UpdatedAfter != nil {
+		q.Where(alias + ".updated_at >= " + q.Arg(*params.UpdatedAfter))
+	}
+	if params.UpdatedBefore != nil {
+		q.Where(alias + ".updated_at < " + q.Arg(*params.UpdatedBefore))
+	}
+	if params.Shared != nil {
+		q.Where("COALESCE(" + alias + ".is_shared, false) = " + q.Arg(*params.Shared))
+	}
+
+	if params.Template != nil {
+		q.Where(alias + ".is_template = " + q.Arg(*params.Template))
+	}
+
+	return q
+}
+
+// textSearch runs a keyword or hybrid search. Hybrid search combines the
+// full-text ranking with the vector ranking using reciprocal rank fusion and
+// falls back to keyword search when an embedding cannot be created.
+func textSearch(params SearchParams, userID string, c *gin.Context) ([]Note, int, error) {
+	var vector *pgvector.Vector
+	if params.Mode == SearchModeHybrid {
+		embedding, err := embeddings.CreateEmbedding(params.Text)
+		if err == nil {
+			v := pgvector.NewVector(embedding.Embedding)
+			vector = &v
+		}
+	}
+
+	q := NewQuery("fused f")
+	q.With("q AS (SELECT websearch_to_tsquery('english', " + q.Arg(params.Text) + ") AS query)")
+	distance := "0"
+	if vector == nil {
+		keyword := q.Subquery("notes, q").
+			Select("notes.id", "ts_rank_cd(notes.search_vector, q.query)::float8 AS score").
+			Where("notes.search_vector @@ q.query")
+		filterNotes(keyword, userID, params, "notes")
+		keywordSQL, _ := keyword.SQL()
+		q.With("fused AS (" + keywordSQL + ")")
+	} else {
+		metric := CurrentDistanceMetric()
+		embedding := q.Arg(*vector)
+		distance = "COALESCE(" + metric.Normalize(metric.Distance("n.embedding", embedding)) + ", 0)"
+
+		keyword := q.Subquery("notes, q").
+			Select("notes.id", "ROW_NUMBER() OVER (ORDER BY ts_rank_cd(notes.search_vector, q.query) DESC) AS rank").
+			Where("notes.search_vector @@ q.query").
+			OrderBy("rank").
+			Page(hybridCandidates, 0)
+		filterNotes(keyword, userID, params, "notes")
+		keywordSQL, _ := keyword.SQL()
+
+		semantic := q.Subquery("notes").
+			Select("notes.id", "ROW_NUMBER() OVER (ORDER BY "+metric.Distance("notes.embedding", embedding)+") AS rank").
+			Where(metric.Distance("notes.embedding", embedding)+" < "+q.Arg(metric.Threshold(params.Distance))).
+			OrderBy("rank").
+			Page(hybridCandidates, 0)
+		filterNotes(semantic, userID, params, "notes")
+		semanticSQL, _ := semantic.SQL()
+
+		q.With("keyword AS (" + keywordSQL + ")")
+		q.With("semantic AS (" + semanticSQL + ")")
+		q.With(fmt.Sprintf(`fused AS (
+			SELECT COALESCE(k.id, s.id) AS id,
+			       (COALESCE(1.0 / (%[1]d + k.rank), 0) + COALESCE(1.0 / (%[1]d + s.rank), 0))::float8 AS score
+			FROM keyword k
+			FULL OUTER JOIN semantic s ON k.id = s.id
+		)`, rrfK))
+	}
+
+	q.Join("INNER JOIN notes n ON n.id = f.id").
+		Join("CROSS JOIN q").
+		SelectNote("n", params.Fields).
+		Select(distance+" AS distance", "f.score",
+			// Delimiters in the note itself are dropped so they cannot mark text
+			"ts_headline('english', translate(COALESCE(n.markdown, n.title, ''), chr(2) || chr(3), ''), q.query, '"+headlineOptions+"') AS highlight").
+		OrderBy(searchOrder(params, "n", "f.score DESC"))
+
+	notes, totalCount, err := runSearch(q, params, c, func(note *Note) []interface{} {
+		return []interface{}{&note.Distance, &note.Score, &note.Highlight}
+	})
+	for i := range notes {
+		notes[i].Highlight = highlightHTML(notes[i].Highlight)
+	}
+	return notes, totalCount, err
+}
+
+// pageParams reads the page and limit query parameters
+func pageParams(c *gin.Context) SearchParams {
+	params := SearchParams{Page: 1, Limit: 50}
+	if pageStr := c.Query("page"); pageStr != "" {
+		if p, err := json.Number(pageStr).Int64(); err == nil && p > 0 {
+			params.Page = int(p)
+		}
+	}
+	if limitStr := c.Query("limit"); limitStr != "" {
+		if l, err := json.Number(limitStr).Int64(); err == nil && l > 0 && l <= 200 {
+			params.Limit = int(l)
+		}
+	}
+	return params
+}
+
+// runSearch counts the notes matched by q and returns the requested page
+func runSearch(q *Query, params SearchParams, c *gin.Context, extra func(note *Note) []interface{}) ([]Note, int, error) {
+	db := c.MustGet("db").(*pgxpool.Pool)
+
+	var totalCount int
+	countSQL, args := q.CountSQL()
+	err := db.QueryRow(context.Background(), countSQL, args...).Scan(&totalCount)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	sql, args := q.Page(params.Limit, (params.Page-1)*params.Limit).SQL()
+	rows, err := db.Query(context.Background(), sql, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	notes, err := scanNotes(rows, params.Fields, extra)
+	if err != nil {
+		return nil, 0, err
+	}
+	return notes, totalCount, nil
+}
@@ -0,0 +1,387 @@
+package notes
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	uuid "github.com/satori/go.uuid"
+	"github.com/stevecastle/modelpad/auth"
+	"github.com/stevecastle/modelpad/markdown"
+)
+
+// Errors of opening a share link, worded for readers
+var (
+	ErrShareLinkNotFound = errors.New("Document not found")
+	ErrShareLinkExpired  = errors.New("This link has expired")
+	ErrSharePassword     = errors.New("Incorrect password, try again")
+	ErrShareLinkLocked   = errors.New("Too many incorrect passwords, try again later")
+)
+
+// ShareLink lets anyone with its token read a note, and its subtree when
+// IncludeDescendants is set, at URL
+type ShareLink struct {
+	ID                 uuid.UUID  `json:"id"`
+	NoteID             uuid.UUID  `json:"note_id"`
+	Token              string     `json:"token"`
+	URL                string     `json:"url"`
+	HasPassword        bool       `json:"has_password"`
+	ExpiresAt          *time.Time `json:"expires_at"`
+	MaxViews           *int       `json:"max_views"`
+	Views              int        `json:"views"`
+	IncludeDescendants bool       `json:"include_descendants"`
+	Active             bool       `json:"active"`
+	CreatedAt          time.Time  `json:"created_at"`
+
+	userID       string
+	passwordHash string
+	expired      bool
+}
+
+// maxSharePassword is the longest password bcrypt can hash
+const maxSharePassword = 72
+
+// After maxPasswordAttempts wrong passwords a link is locked for
+// passwordLockout, and then again after each wrong password until the
+// right one is given
+const (
+	maxPasswordAttempts = 5
+	passwordLockout     = 15 * time.Minute
+)
+
+// shareLinkColumns are the share_links columns read by scanShareLink
+const shareLinkColumns = `id, note_id, token, password_hash IS NOT NULL, expires_at, max_views, views, include_descendants,
+	(expires_at IS NULL OR expires_at > now()) AND (max_views IS NULL OR views < max_views),
+	created_at, user_id::text, COALESCE(password_hash, ''), expires_at IS NOT NULL AND expires_at <= now()`
+
+func scanShareLink(row pgx.Row) (ShareLink, error) {
+	var link ShareLink
+	err := row.Scan(&link.ID, &link.NoteID, &link.Token, &link.HasPassword, &link.ExpiresAt, &link.MaxViews, &link.Views,
+		&link.IncludeDescendants, &link.Active, &link.CreatedAt, &link.userID, &link.passwordHash, &link.expired)
+	link.URL = "/s/" + link.Token
+	return link, err
+}
+
+// ListShareLinks returns the share links of a note, newest first. Expired
+// and used up links are listed as inactive until revoked.
+func ListShareLinks(c *gin.Context) {
+	noteID := c.Param("id")
+	db := c.MustGet("db").(*pgxpool.Pool)
+
+	if _, ok := AuthorizeNote(c, db, noteID, RoleOwner); !ok {
+		return
+	}
+
+	rows, err := db.Query(context.Background(),
+		"SELECT "+shareLinkColumns+" FROM share_links WHERE note_id = $1 ORDER BY created_at DESC, id", noteID)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	links := []ShareLink{}
+	for rows.Next() {
+		link, err := scanShareLink(rows)
+		if err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		links = append(links, link)
+	}
+
+	c.JSON(200, gin.H{"links": links})
+}
+
+// CreateShareLink creates a share link for a note with a new random token.
+// The link may ask for a password, stop working at expires_at or after
+// max_views views, and include the note's descendants.
+func CreateShareLink(c *gin.Context) {
+	userID := c.GetString("user_id")
+	noteID := c.Param("id")
+
+	var requestBody struct {
+		Password           string     `json:"password"`
+		ExpiresAt          *time.Time `json:"expires_at"`
+		MaxViews           *int       `json:"max_views"`
+		IncludeDescendants bool       `json:"include_descendants"`
+	}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&requestBody); err != nil {
+			c.JSON(400, gin.H{"error": "Invalid request body"})
+			return
+		}
+	}
+	if len(requestBody.Password) > maxSharePassword {
+		c.JSON(400, gin.H{"error": "Password must be at most 72 bytes"})
+		return
+	}
+	if requestBody.ExpiresAt != nil && !requestBody.ExpiresAt.After(time.Now()) {
+		c.JSON(400, gin.H{"error": "expires_at must be in the future"})
+		return
+	}
+	if requestBody.MaxViews != nil && *requestBody.MaxViews < 1 {
+		c.JSON(400, gin.H{"error": "max_views must be at least 1"})
+		return
+	}
+
+	db := c.MustGet("db").(*pgxpool.Pool)
+	if _, ok := AuthorizeNote(c, db, noteID, RoleOwner); !ok {
+		return
+	}
+
+	token, err := auth.GenerateRandomToken()
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to generate token"})
+		return
+	}
+	var passwordHash *string
+	if requestBody.Password != "" {
+		hash, err := auth.HashPassword(requestBody.Password)
+		if err != nil {
+			c.JSON(500, gin.H{"error": "Failed to hash password"})
+			return
+		}
+		passwordHash = &hash
+	}
+	link, err := scanShareLink(db.QueryRow(context.Background(), `
+		INSERT INTO share_links (token, note_id, user_id, password_hash, expires_at, max_views, include_descendants)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING `+shareLinkColumns,
+		token, noteID, userID, passwordHash, requestBody.ExpiresAt, requestBody.MaxViews, requestBody.IncludeDescendants))
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(201, gin.H{"link": link})
+}
+
+// RevokeShareLink deletes a share link, which stops working at once
+func RevokeShareLink(c *gin.Context) {
+	noteID := c.Param("id")
+	db := c.MustGet("db").(*pgxpool.Pool)
+
+	if _, ok := AuthorizeNote(c, db, noteID, RoleOwner); !ok {
+		return
+	}
+
+	linkID, err := uuid.FromString(c.Param("link"))
+	if err != nil {
+		c.JSON(404, gin.H{"error": "Share link not found"})
+		return
+	}
+	result, err := db.Exec(context.Background(),
+		"DELETE FROM share_links WHERE id = $1 AND note_id = $2", linkID, noteID)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	if result.RowsAffected() == 0 {
+		c.JSON(404, gin.H{"error": "Share link not found"})
+		return
+	}
+
+	c.JSON(200, gin.H{"message": "Share link revoked"})
+}
+
+// OpenShareLink loads an unexpired share link and the note it shows: its own
+// note, or the descendant noteID when the link includes descendants. Links
+// whose views ran out still open, for the readers already counted.
+func OpenShareLink(db *pgxpool.Pool, token string, noteID string) (ShareLink, Note, error) {
+	link, err := scanShareLink(db.QueryRow(context.Background(),
+		"SELECT "+shareLinkColumns+" FROM share_links WHERE token = $1", token))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return link, Note{}, ErrShareLinkNotFound
+	}
+	if err != nil {
+		return link, Note{}, err
+	}
+	if link.expired {
+		return link, Note{}, ErrShareLinkExpired
+	}
+
+	if noteID == "" || noteID == link.NoteID.String() {
+		noteID = link.NoteID.String()
+	} else {
+		if _, err := uuid.FromString(noteID); err != nil || !link.IncludeDescendants {
+			return link, Note{}, ErrShareLinkNotFound
+		}
+		var below bool
+		err := db.QueryRow(context.Background(),
+			"SELECT $1::uuid IN "+descendantsOf("$2"), noteID, link.NoteID).Scan(&below)
+		if err != nil {
+			return link, Note{}, err
+		}
+		if !below {
+			return link, Note{}, ErrShareLinkNotFound
+		}
+	}
+
+	note, err := getNote(db, noteID, link.userID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return link, note, ErrShareLinkNotFound
+	}
+	return link, note, err
+}
+
+// UnlockShareLink checks a password for a link. It fails with
+// ErrSharePassword for a wrong password and ErrShareLinkLocked, without
+// checking the password, while the link is locked. Each attempt is counted
+// before the password is checked, so parallel guesses are limited too.
+func UnlockShareLink(db *pgxpool.Pool, link ShareLink, password string) error {
+	result, err := db.Exec(context.Background(), `
+		UPDATE share_links SET password_attempts = password_attempts + 1,
+			locked_until = CASE WHEN password_attempts + 1 >= $2 THEN now() + $3 * interval '1 second' END
+		WHERE id = $1 AND (locked_until IS NULL OR locked_until <= now())`,
+		link.ID, maxPasswordAttempts, passwordLockout.Seconds())
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		return ErrShareLinkLocked
+	}
+	if !auth.CheckPassword(password, link.passwordHash) {
+		return ErrSharePassword
+	}
+
+	_, err = db.Exec(context.Background(),
+		"UPDATE share_links SET password_attempts = 0, locked_until = NULL WHERE id = $1", link.ID)
+	return err
+}
+
+// shareReaderTTL is how long a counted reader keeps reading a link without
+// giving its password or being counted again
+const shareReaderTTL = 24 * time.Hour
+
+// AddShareReader counts a new reader of a link and returns the token the
+// reader keeps to be recognized later. It fails with ErrShareLinkExpired
+// when the views ran out.
+func AddShareReader(db *pgxpool.Pool, link ShareLink) (string, error) {
+	token, err := auth.GenerateRandomToken()
+	if err != nil {
+		return "", err
+	}
+
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback(ctx)
+
+	result, err := tx.Exec(ctx,
+		"UPDATE share_links SET views = views + 1 WHERE id = $1 AND (max_views IS NULL OR views < max_views)", link.ID)
+	if err != nil {
+		return "", err
+	}
+	if result.RowsAffected() == 0 {
+		return "", ErrShareLinkExpired
+	}
+
+	_, err = tx.Exec(ctx,
+		"DELETE FROM share_link_readers WHERE link_id = $1 AND expires_at <= now()", link.ID)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = tx.Exec(ctx,
+		`INSERT INTO share_link_readers (token_hash, link_id, expires_at)
+		VALUES ($1, $2, now() + $3 * interval '1 second')`,
+		auth.HashRefreshToken(token), link.ID, shareReaderTTL.Seconds())
+	if err != nil {
+		return "", err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// IsShareReader reports whether a token was given to a reader of the link by
+// AddShareReader and has not expired.
+func IsShareReader(db *pgxpool.Pool, link ShareLink, token string) (bool, error) {
+	if token == "" {
+		return false, nil
+	}
+	var found bool
+	err := db.QueryRow(context.Background(),
+		`SELECT EXISTS(SELECT 1 FROM share_link_readers
+			WHERE token_hash = $1 AND link_id = $2 AND expires_at > now())`,
+		auth.HashRefreshToken(token), link.ID).Scan(&found)
+	return found, err
+}
+
+// ShareLinkURLs returns the URLs of the notes linked from a body that a
+// reader of the link can view, keyed by the ids the links use. Notes the
+// link covers are viewed through it, other shared notes at /doc.
+func ShareLinkURLs(db *pgxpool.Pool, link ShareLink, body string) (map[string]string, error) {
+	urls, err := SharedNoteURLs(db, body)
+	if err != nil {
+		return nil, err
+	}
+	links, err := markdown.NoteLinks(body)
+	if err != nil || len(links) == 0 {
+		return urls, nil
+	}
+
+	targets := []uuid.UUID{}
+	for _, l := range links {
+		if target, err := uuid.FromString(l); err == nil {
+			targets = append(targets, target)
+		}
+	}
+	rows, err := db.Query(context.Background(), `
+		SELECT n.id FROM notes n
+		WHERE n.id = ANY($1::uuid[]) AND (n.id = $2 OR ($3 AND n.id IN `+descendantsOf("$2")+`))
+		AND `+notTrashed("n", "n.user_id"),
+		targets, link.NoteID, link.IncludeDescendants)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	covered := make(map[uuid.UUID]bool)
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		covered[id] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, l := range links {
+		id, err := uuid.FromString(l)
+		if err != nil || !covered[id] {
+			continue
+		}
+		urls[l] = link.URL
+		if id != link.NoteID {
+			urls[l] += "/" + id.String()
+		}
+	}
+	return urls, nil
+}
+
+// ShareLinkChildren returns the children of a note shown through a link
+// that includes descendants, in their manual order, with only id and title
+func ShareLinkChildren(db *pgxpool.Pool, link ShareLink, noteID uuid.UUID) ([]Note, error) {
+	parent := noteID.String()
+	params := SearchParams{Parent: &parent, Sort: "position"}
+	fields := []string{"id", "title"}
+	q := NewQuery("notes").SelectNote("notes", fields).OrderBy(searchOrder(params, "notes", ""))
+	filterNotes(q, link.userID, params, "notes")
+	sql, args := q.SQL()
+	rows, err := db.Query(context.Background(), sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	return scanNotes(rows, fields, nil)
+}
@@ -0,0 +1,149 @@
+package notes
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// maxNameLength is the longest snapshot or branch name accepted
+const maxNameLength = 200
+
+// validName trims a snapshot or branch name and reports whether it is usable
+func validName(name string) (string, bool) {
+	name = strings.TrimSpace(name)
+	return name, name != "" && utf8.RuneCountInString(name) <= maxNameLength
+}
+
+// ListSnapshots returns the named revisions of a note, newest first, without bodies
+func ListSnapshots(c *gin.Context) {
+	noteID := c.Param("id")
+	db := c.MustGet("db").(*pgxpool.Pool)
+
+	if _, ok := AuthorizeNote(c, db, noteID, RoleViewer); !ok {
+		return
+	}
+
+	rows, err := db.Query(context.Background(), `
+		SELECT id, note_id, branch_id, name, COALESCE(title, ''), COALESCE(size, octet_length(body), 0), created_at
+		FROM revisions
+		WHERE note_id = $1 AND name IS NOT NULL
+		ORDER BY created_at DESC, id`, noteID)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	snapshots := []Revision{}
+	for rows.Next() {
+		var revision Revision
+		if err := rows.Scan(&revision.ID, &revision.NoteID, &revision.BranchID, &revision.Name, &revision.Title, &revision.Size, &revision.CreatedAt); err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		snapshots = append(snapshots, revision)
+	}
+
+	c.JSON(200, gin.H{"snapshots": snapshots})
+}
+
+// CreateSnapshot names a revision so it is never compacted away. Without a
+// revision_id the note's current title and body are saved as a new named
+// revision.
+func CreateSnapshot(c *gin.Context) {
+	noteID := c.Param("id")
+
+	var requestBody struct {
+		Name       string `json:"name"`
+		RevisionID string `json:"revision_id"`
+	}
+	if err := c.ShouldBindJSON(&requestBody); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request body"})
+		return
+	}
+	name, ok := validName(requestBody.Name)
+	if !ok {
+		c.JSON(400, gin.H{"error": "Snapshot name must be 1 to 200 characters"})
+		return
+	}
+
+	db := c.MustGet("db").(*pgxpool.Pool)
+
+	access, ok := AuthorizeNote(c, db, noteID, RoleEditor)
+	if !ok {
+		return
+	}
+	owner := access.OwnerID
+
+	if requestBody.RevisionID != "" {
+		revision, err := getRevision(db, noteID, requestBody.RevisionID, owner)
+		if errors.Is(err, pgx.ErrNoRows) {
+			c.JSON(404, gin.H{"error": "Revision not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		_, err = db.Exec(context.Background(), "UPDATE revisions SET name = $1 WHERE id = $2", name, revision.ID)
+		if err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		revision.Name, revision.Body = &name, ""
+		c.JSON(200, gin.H{"snapshot": revision})
+		return
+	}
+
+	var snapshot Revision
+	err := db.QueryRow(context.Background(), `
+		INSERT INTO revisions (note_id, title, body, user_id, size, name)
+		SELECT id, title, body, user_id, COALESCE(octet_length(body), 0), $3
+		FROM notes WHERE id = $1 AND user_id = $2
+		RETURNING id, note_id, name, COALESCE(title, ''), size, created_at`,
+		noteID, owner, name).Scan(&snapshot.ID, &snapshot.NoteID, &snapshot.Name, &snapshot.Title, &snapshot.Size, &snapshot.CreatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.JSON(404, gin.H{"error": "Note not found or you don't have permission to access it"})
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(201, gin.H{"snapshot": snapshot})
+}
+
+// DeleteSnapshot removes the name of a revision. The revision itself is kept
+// until the retention policy removes it.
+func DeleteSnapshot(c *gin.Context) {
+	db := c.MustGet("db").(*pgxpool.Pool)
+
+	access, ok := AuthorizeNote(c, db, c.Param("id"), RoleEditor)
+	if !ok {
+		return
+	}
+	owner := access.OwnerID
+
+	result, err := db.Exec(context.Background(), `
+		UPDATE revisions r SET name = NULL
+		FROM notes n
+		WHERE n.id = r.note_id AND r.id = $1 AND r.note_id = $2 AND n.user_id = $3 AND r.name IS NOT NULL`,
+		c.Param("rev"), c.Param("id"), owner)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	if result.RowsAffected() == 0 {
+		c.JSON(404, gin.H{"error": "Snapshot not found"})
+		return
+	}
+
+	c.JSON(200, gin.H{"message": "Snapshot deleted"})
+}
@@ -0,0 +1,768 @@
+package notes
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/pgvector/pgvector-go"
+	uuid "github.com/satori/go.uuid"
+)
+
+// Device is a client that syncs the user's notes
+type Device struct {
+	ID         uuid.UUID `json:"id"`
+	Name       string    `json:"name"`
+	Platform   string    `json:"platform"`
+	Cursor     string    `json:"cursor"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+}
+
+// SyncFields are the note fields a mutation sets. Nil fields are left as
+// they are and a Parent of "" is the root.
+type SyncFields struct {
+	Title  *string    `json:"title,omitempty"`
+	Body   *string    `json:"body,omitempty"`
+	Tags   *[]NoteTag `json:"tags,omitempty"`
+	Parent *string    `json:"parent,omitempty"`
+}
+
+// SyncMutation is a change made on a device, possibly while offline. ID is
+// chosen by the device and makes retries safe. Op is upsert or delete.
+// BaseVersion is the note version the change was made to, nil for notes
+// created on the device, and Base the fields as they were at that version,
+// which lets concurrent changes be merged.
+type SyncMutation struct {
+	ID          string      `json:"id"`
+	Op          string      `json:"op"`
+	NoteID      string      `json:"note_id"`
+	BaseVersion *int64      `json:"base_version"`
+	ClientTime  time.Time   `json:"client_time"`
+	Base        *SyncFields `json:"base,omitempty"`
+	Fields      SyncFields  `json:"fields"`
+}
+
+// Sync mutation result statuses. A merged upsert kept the server's value of
+// the fields in Conflicts. When the title or body changed on both sides and
+// could not be merged the original is left alone and the device's version
+// is saved as a conflict copy. Stale deletes are rejected.
+const (
+	syncApplied      = "applied"
+	syncMerged       = "merged"
+	syncConflictCopy = "conflict_copy"
+	syncRejected     = "rejected"
+	syncFailed       = "failed"
+)
+
+// SyncResult reports the outcome of one mutation
+type SyncResult struct {
+	ID        string     `json:"id"`
+	NoteID    string     `json:"note_id"`
+	Status    string     `json:"status"`
+	Version   int64      `json:"version,omitempty"`
+	Conflicts []string   `json:"conflicts,omitempty"`
+	CopyID    *uuid.UUID `json:"copy_id,omitempty"`
+	Error     string     `json:"error,omitempty"`
+}
+
+// syncedNote is the synced state of a note
+type syncedNote struct {
+	title  string
+	body   string
+	tags   []NoteTag
+	parent *uuid.UUID
+}
+
+// getDevice loads a device of the user, returning pgx.ErrNoRows for ids that
+// are not valid
+func getDevice(db dbtx, deviceID string, userID string) (Device, error) {
+	var device Device
+	if _, err := uuid.FromString(deviceID); err != nil {
+		return device, pgx.ErrNoRows
+	}
+	err := db.QueryRow(context.Background(),
+		"SELECT id, name, platform, cursor, created_at, last_seen_at FROM sync_devices WHERE id = $1 AND user_id = $2",
+		deviceID, userID).Scan(&device.ID, &device.Name, &device.Platform, &device.Cursor, &device.CreatedAt, &device.LastSeenAt)
+	return device, err
+}
+
+// RegisterDevice adds a device that will sync the user's notes
+func RegisterDevice(c *gin.Context) {
+	userID := c.GetString("user_id")
+
+	var requestBody struct {
+		Name     string `json:"name"`
+		Platform string `json:"platform"`
+	}
+	if err := c.ShouldBindJSON(&requestBody); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request body"})
+		return
+	}
+	name, ok := validName(requestBody.Name)
+	if !ok {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("Device name must be 1 to %d characters", maxNameLength)})
+		return
+	}
+
+	db := c.MustGet("db").(*pgxpool.Pool)
+
+	var device Device
+	err := db.QueryRow(context.Background(),
+		"INSERT INTO sync_devices (user_id, name, platform) VALUES ($1, $2, $3) RETURNING id, name, platform, cursor, created_at, last_seen_at",
+		userID, name, requestBody.Platform).
+		Scan(&device.ID, &device.Name, &device.Platform, &device.Cursor, &device.CreatedAt, &device.LastSeenAt)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(201, gin.H{"device": device})
+}
+
+// ListDevices returns the user's devices, most recently seen first
+func ListDevices(c *gin.Context) {
+	userID := c.GetString("user_id")
+	db := c.MustGet("db").(*pgxpool.Pool)
+
+	rows, err := db.Query(context.Background(),
+		"SELECT id, name, platform, cursor, created_at, last_seen_at FROM sync_devices WHERE user_id = $1 ORDER BY last_seen_at DESC",
+		userID)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	devices := []Device{}
+	for rows.Next() {
+		var device Device
+		if err := rows.Scan(&device.ID, &device.Name, &device.Platform, &device.Cursor, &device.CreatedAt, &device.LastSeenAt); err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		devices = append(devices, device)
+	}
+	if err := rows.Err(); err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(200, gin.H{"devices": devices})
+}
+
+// DeleteDevice removes a device and its mutation receipts
+func DeleteDevice(c *gin.Context) {
+	userID := c.GetString("user_id")
+	db := c.MustGet("db").(*pgxpool.Pool)
+
+	deviceID, err := uuid.FromString(c.Param("id"))
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Invalid device ID"})
+		return
+	}
+
+	result, err := db.Exec(context.Background(),
+		"DELETE FROM sync_devices WHERE id = $1 AND user_id = $2", deviceID, userID)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	if result.RowsAffected() == 0 {
+		c.JSON(404, gin.H{"error": "Device not found"})
+		return
+	}
+
+	c.JSON(200, gin.H{"message": "Device deleted"})
+}
+
+// PullChanges returns the changes after the since cursor, like GetChanges.
+// Sending since acknowledges every change before it, so it is saved as the
+// device's cursor and used when since is left out.
+func PullChanges(c *gin.Context) {
+	userID := c.GetString("user_id")
+	db := c.MustGet("db").(*pgxpool.Pool)
+
+	device, err := getDevice(db, c.Query("device_id"), userID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.JSON(404, gin.H{"error": "Device not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	sinceStr, ok := c.GetQuery("since")
+	if !ok {
+		sinceStr = device.Cursor
+	}
+	since, err := parseChangeCursor(sinceStr)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Invalid since cursor"})
+		return
+	}
+
+	_, err = db.Exec(context.Background(),
+		"UPDATE sync_devices SET cursor = $1, last_seen_at = now() WHERE id = $2", since.String(), device.ID)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	writeChanges(c, db, userID, since)
+}
+
+// PushMutations applies a device's mutations in order, each in its own
+// transaction, and reports the outcome of each. Mutations already applied
+// return their earlier result.
+func PushMutations(c *gin.Context) {
+	userID := c.GetString("user_id")
+
+	var requestBody struct {
+		DeviceID  string         `json:"device_id"`
+		Mutations []SyncMutation `json:"mutations"`
+	}
+	if err := c.ShouldBindJSON(&requestBody); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if len(requestBody.Mutations) == 0 || len(requestBody.Mutations) > maxBatchOperations {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("Expected 1 to %d mutations", maxBatchOperations)})
+		return
+	}
+
+	db := c.MustGet("db").(*pgxpool.Pool)
+
+	device, err := getDevice(db, requestBody.DeviceID, userID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.JSON(404, gin.H{"error": "Device not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	results := make([]SyncResult, len(requestBody.Mutations))
+	for i, mutation := range requestBody.Mutations {
+		results[i], err = pushMutation(db, device, userID, mutation)
+		if err != nil {
+			results[i] = SyncResult{ID: mutation.ID, NoteID: mutation.NoteID, Status: syncFailed, Error: err.Error()}
+		}
+	}
+
+	_, err = db.Exec(context.Background(), "UPDATE sync_devices SET last_seen_at = now() WHERE id = $1", device.ID)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(200, gin.H{"results": results})
+}
+
+// maxSyncAttempts is how often an upsert is planned again when its note
+// changed while the upsert's text was being rendered
+const maxSyncAttempts = 3
+
+var errNoteChanged = errors.New("The note kept changing, try again")
+
+// pushMutation applies one mutation and records its result. Upserts are
+// planned and rendered before the transaction, as creating an embedding is
+// slow, and planned again when the note changed in between.
+func pushMutation(db *pgxpool.Pool, device Device, userID string, mutation SyncMutation) (SyncResult, error) {
+	if mutation.ID == "" {
+		return SyncResult{}, fmt.Errorf("%w: mutation id is required", errInvalidOperation)
+	}
+	noteID, err := uuid.FromString(mutation.NoteID)
+	if err != nil {
+		return SyncResult{}, fmt.Errorf("%w: invalid note ID", errInvalidOperation)
+	}
+
+	for attempt := 0; attempt < maxSyncAttempts; attempt++ {
+		var plan *upsertPlan
+		if mutation.Op == "upsert" {
+			result, recorded, err := recordedResult(db, device, mutation)
+			if err != nil || recorded {
+				return result, err
+			}
+			plan, err = planUpsert(db, device, userID, noteID, mutation)
+			if err != nil {
+				return SyncResult{}, err
+			}
+		}
+
+		result, err := applyMutation(db, device, userID, noteID, mutation, plan)
+		if !errors.Is(err, errNoteChanged) {
+			return result, err
+		}
+	}
+	return SyncResult{}, errNoteChanged
+}
+
+// recordedResult returns the result of a mutation the device pushed before
+func recordedResult(db dbtx, device Device, mutation SyncMutation) (SyncResult, bool, error) {
+	var result SyncResult
+	var resultJSON []byte
+	err := db.QueryRow(context.Background(),
+		"SELECT result FROM sync_mutations WHERE device_id = $1 AND mutation_id = $2",
+		device.ID, mutation.ID).Scan(&resultJSON)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return result, false, nil
+	}
+	if err != nil {
+		return result, false, err
+	}
+	return result, true, json.Unmarshal(resultJSON, &result)
+}
+
+// applyMutation applies a mutation in a transaction and records its result
+func applyMutation(db *pgxpool.Pool, device Device, userID string, noteID uuid.UUID, mutation SyncMutation, plan *upsertPlan) (SyncResult, error) {
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		return SyncResult{}, err
+	}
+	defer tx.Rollback(context.Background())
+
+	result, recorded, err := recordedResult(tx, device, mutation)
+	if err != nil || recorded {
+		return result, err
+	}
+
+	result = SyncResult{ID: mutation.ID, NoteID: mutation.NoteID}
+	switch mutation.Op {
+	case "upsert":
+		err = syncUpsert(tx, userID, noteID, plan, &result)
+	case "delete":
+		err = syncDelete(tx, userID, noteID, mutation, &result)
+	default:
+		err = fmt.Errorf("%w: unknown op %q", errInvalidOperation, mutation.Op)
+	}
+	if err != nil {
+		return SyncResult{}, err
+	}
+
+	resultJSON, err := json.Marshal(result)
+	if err != nil {
+		return SyncResult{}, err
+	}
+	_, err = tx.Exec(context.Background(),
+		"INSERT INTO sync_mutations (device_id, mutation_id, result) VALUES ($1, $2, $3)",
+		device.ID, mutation.ID, resultJSON)
+	if err != nil {
+		return SyncResult{}, err
+	}
+	return result, tx.Commit(context.Background())
+}
+
+// syncDelete moves a note to the trash unless it changed after the version
+// the device deleted. Notes already gone count as deleted.
+func syncDelete(tx pgx.Tx, userID string, noteID uuid.UUID, mutation SyncMutation, result *SyncResult) error {
+	var version int64
+	err := tx.QueryRow(context.Background(),
+		"SELECT n.version FROM notes n WHERE n.id = $1 AND n.user_id = $2 AND "+notTrashed("n", "$2")+" FOR UPDATE",
+		noteID, userID).Scan(&version)
+	if errors.Is(err, pgx.ErrNoRows) {
+		result.Status = syncApplied
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if mutation.BaseVersion != nil && *mutation.BaseVersion != version {
+		result.Status = syncRejected
+		result.Version = version
+		result.Error = "The note changed after base_version, pull and try again"
+		return nil
+	}
+
+	if _, err := trashNote(tx, userID, noteID.String()); err != nil {
+		return err
+	}
+	result.Status = syncApplied
+	return nil
+}
+
+// syncState is a note as an upsert found it
+type syncState struct {
+	exists  bool
+	version int64
+	owner   string
+	trashed bool
+	note    syncedNote
+}
+
+// readSyncState reads the state of a note, locking its row when lock is set
+func readSyncState(db dbtx, noteID uuid.UUID, lock bool) (syncState, error) {
+	var state syncState
+	var tagsJSON []byte
+	query := `
+		SELECT n.version, COALESCE(n.title, ''), COALESCE(n.body, ''), COALESCE(n.tags, '[]'::jsonb), n.parent, n.user_id::text,
+			n.id IN (SELECT trashed_note_ids(n.user_id))
+		FROM notes n WHERE n.id = $1`
+	if lock {
+		query += " FOR UPDATE"
+	}
+	err := db.QueryRow(context.Background(), query, noteID).
+		Scan(&state.version, &state.note.title, &state.note.body, &tagsJSON, &state.note.parent, &state.owner, &state.trashed)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+	state.exists = true
+	return state, json.Unmarshal(tagsJSON, &state.note.tags)
+}
+
+// upsertPlan is how an upsert changes a note in the state it was planned
+// for. Conflict copies are new notes placed after original, or at the root.
+// rendered holds the markdown and embedding of wanted when its text changed.
+type upsertPlan struct {
+	state       syncState
+	status      string
+	conflicts   []string
+	wanted      syncedNote
+	copy        bool
+	original    *uuid.UUID
+	textChanged bool
+	rendered    renderedText
+}
+
+// planUpsert plans an upsert against the note's current state, merging with
+// changes made since the mutation's base version, and renders its text
+func planUpsert(db dbtx, device Device, userID string, noteID uuid.UUID, mutation SyncMutation) (*upsertPlan, error) {
+	state, err := readSyncState(db, noteID, false)
+	if err != nil {
+		return nil, err
+	}
+	if state.exists && state.owner != userID {
+		return nil, errNoteNotFound
+	}
+
+	plan := &upsertPlan{state: state, status: syncApplied}
+	switch {
+	case !state.exists && mutation.BaseVersion != nil || state.exists && state.trashed:
+		// Edits to a note deleted elsewhere are kept as a copy at the root
+		plan.wanted, err = mutation.Fields.apply(syncedNote{})
+		plan.wanted.parent = nil
+		plan.copy = true
+	case !state.exists:
+		plan.wanted, err = mutation.Fields.apply(syncedNote{})
+	case mutation.BaseVersion == nil || *mutation.BaseVersion == state.version:
+		plan.wanted, err = mutation.Fields.apply(state.note)
+	default:
+		var ok bool
+		plan.wanted, plan.conflicts, ok, err = mergeSynced(state.note, mutation)
+		plan.status = syncMerged
+		if err == nil && !ok {
+			plan.wanted, err = mutation.Fields.apply(state.note)
+			plan.wanted.parent = state.note.parent
+			plan.copy, plan.original = true, &noteID
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if plan.copy {
+		clientTime := mutation.ClientTime
+		if clientTime.IsZero() {
+			clientTime = time.Now()
+		}
+		plan.status = syncConflictCopy
+		plan.wanted.title = fmt.Sprintf("%s (conflict from %s, %s)", plan.wanted.title, device.Name, clientTime.UTC().Format("2006-01-02 15:04"))
+	}
+
+	plan.textChanged = plan.copy || !state.exists ||
+		plan.wanted.title != state.note.title || plan.wanted.body != state.note.body
+	if plan.textChanged {
+		plan.rendered, err = renderSynced(plan.wanted)
+	}
+	return plan, err
+}
+
+// syncUpsert applies a planned upsert. It fails with errNoteChanged when the
+// note changed after the upsert was planned.
+func syncUpsert(tx pgx.Tx, userID string, noteID uuid.UUID, plan *upsertPlan, result *SyncResult) error {
+	state, err := readSyncState(tx, noteID, true)
+	if err != nil {
+		return err
+	}
+	if state.exists != plan.state.exists || state.version != plan.state.version || state.trashed != plan.state.trashed {
+		return errNoteChanged
+	}
+
+	result.Status = plan.status
+	result.Conflicts = plan.conflicts
+	if plan.copy {
+		return saveConflictCopy(tx, userID, plan, result)
+	}
+
+	var current *syncedNote
+	if state.exists {
+		current = &state.note
+	}
+	result.Version, err = saveSyncedNote(tx, userID, noteID, current, plan.wanted, plan.rendered)
+	return err
+}
+
+// apply returns note with the fields set
+func (fields SyncFields) apply(note syncedNote) (syncedNote, error) {
+	if fields.Title != nil {
+		note.title = *fields.Title
+	}
+	if fields.Body != nil {
+		note.body = *fields.Body
+	}
+	if fields.Tags != nil {
+		note.tags = *fields.Tags
+	}
+	if fields.Parent != nil {
+		parent, err := parseOptionalUUID(fields.Parent)
+		if err != nil {
+			return note, fmt.Errorf("%w: invalid parent ID", errInvalidOperation)
+		}
+		note.parent = parent
+	}
+	return note, nil
+}
+
+// mergeSynced merges a mutation made to an older version into the current
+// note. Fields changed only on the device take its value, and tags changed
+// on both sides are merged by path. Parents changed on both sides keep the
+// server's and are returned as conflicts. It reports false when the title
+// or body cannot be merged, which is always the case without a base.
+func mergeSynced(current syncedNote, mutation SyncMutation) (syncedNote, []string, bool, error) {
+	fields, base := mutation.Fields, mutation.Base
+	if base == nil {
+		base = &SyncFields{}
+	}
+	merged := current
+	var conflicts []string
+
+	titleChanged := fields.Title != nil && *fields.Title != current.title
+	bodyChanged := fields.Body != nil && *fields.Body != current.body
+	if titleChanged && base.Title == nil || bodyChanged && base.Body == nil {
+		return merged, nil, false, nil
+	}
+	if titleChanged && *fields.Title != *base.Title {
+		if current.title != *base.Title {
+			return merged, nil, false, nil
+		}
+		merged.title = *fields.Title
+	}
+	if bodyChanged && *fields.Body != *base.Body {
+		if current.body == *base.Body {
+			merged.body = *fields.Body
+		} else {
+			branch := Branch{Title: current.title, Body: *fields.Body, baseTitle: current.title, baseBody: *base.Body}
+			_, body, textConflicts, err := mergeNote(branch, current.title, current.body, preferMain)
+			if err != nil || len(textConflicts) > 0 {
+				// Bodies that are not Lexical JSON cannot be merged either
+				return merged, nil, false, nil
+			}
+			merged.body = body
+		}
+	}
+
+	if fields.Tags != nil {
+		if base.Tags != nil {
+			merged.tags = mergeTags(*base.Tags, current.tags, *fields.Tags)
+		} else {
+			merged.tags = mergeTags(nil, current.tags, *fields.Tags)
+		}
+	}
+
+	if fields.Parent != nil {
+		parent, err := parseOptionalUUID(fields.Parent)
+		if err != nil {
+			return merged, nil, false, fmt.Errorf("%w: invalid parent ID", errInvalidOperation)
+		}
+		if !equalParent(parent, current.parent) {
+			baseParent, err := parseOptionalUUID(base.Parent)
+			if base.Parent != nil && err == nil && equalParent(baseParent, current.parent) {
+				merged.parent = parent
+			} else {
+				conflicts = append(conflicts, "parent")
+			}
+		}
+	}
+
+	return merged, conflicts, true, nil
+}
+
+// mergeTags three-way merges tag lists by path. Tags added on either side
+// are kept and tags removed on either side are dropped. Without a base
+// nothing counts as removed.
+func mergeTags(base []NoteTag, current []NoteTag, device []NoteTag) []NoteTag {
+	inBase := make(map[string]bool)
+	for _, tag := range base {
+		inBase[strings.Join(tag.Path, "/")] = true
+	}
+	inDevice := make(map[string]bool)
+	for _, tag := range device {
+		inDevice[strings.Join(tag.Path, "/")] = true
+	}
+
+	merged := []NoteTag{}
+	seen := make(map[string]bool)
+	for _, tag := range current {
+		key := strings.Join(tag.Path, "/")
+		if seen[key] || inBase[key] && !inDevice[key] {
+			continue
+		}
+		seen[key] = true
+		merged = append(merged, tag)
+	}
+	inCurrent := make(map[string]bool)
+	for _, tag := range current {
+		inCurrent[strings.Join(tag.Path, "/")] = true
+	}
+	for _, tag := range device {
+		key := strings.Join(tag.Path, "/")
+		if seen[key] || inBase[key] && !inCurrent[key] {
+			continue
+		}
+		seen[key] = true
+		merged = append(merged, tag)
+	}
+	return merged
+}
+
+func equalParent(a *uuid.UUID, b *uuid.UUID) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return *a == *b
+}
+
+// saveConflictCopy saves the device's version of a note as a new note, after
+// the original when there is one and at the root otherwise
+func saveConflictCopy(tx pgx.Tx, userID string, plan *upsertPlan, result *SyncResult) error {
+	copyID := uuid.NewV4()
+	if _, err := saveSyncedNote(tx, userID, copyID, nil, plan.wanted, plan.rendered); err != nil {
+		return err
+	}
+	if plan.original != nil {
+		if _, err := moveNote(tx, userID, copyID, plan.wanted.parent, plan.original, nil); err != nil {
+			return err
+		}
+	}
+
+	result.CopyID = &copyID
+	return nil
+}
+
+// renderedText is the markdown and embedding stored for a note's text
+type renderedText struct {
+	markdown  *string
+	embedding *pgvector.Vector
+}
+
+// renderSynced renders the text of a note like renderNote
+func renderSynced(note syncedNote) (renderedText, error) {
+	// Notes created on a device may have no body yet
+	if strings.TrimSpace(note.body) == "" {
+		return renderedText{embedding: embedNote(note.title, "")}, nil
+	}
+	markdown, embedding, err := renderNote(note.title, note.body)
+	if err != nil {
+		return renderedText{}, err
+	}
+	return renderedText{markdown: &markdown, embedding: embedding}, nil
+}
+
+// sameTags reports whether two tag lists hold the same tags in order
+func sameTags(a []NoteTag, b []NoteTag) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].ID != b[i].ID || strings.Join(a[i].Path, "/") != strings.Join(b[i].Path, "/") {
+			return false
+		}
+	}
+	return true
+}
+
+// saveSyncedNote creates a note, or updates it from its current state, and
+// returns its new version. Like UpsertNote it records a revision and the
+// note's links. Fields that did not change are not written, so a note that
+// did not change keeps its version.
+func saveSyncedNote(tx pgx.Tx, userID string, noteID uuid.UUID, current *syncedNote, wanted syncedNote, rendered renderedText) (int64, error) {
+	if wanted.tags == nil {
+		wanted.tags = []NoteTag{}
+	}
+	tagsJSON, err := json.Marshal(wanted.tags)
+	if err != nil {
+		return 0, err
+	}
+
+	textChanged := current == nil || wanted.title != current.title || wanted.body != current.body
+
+	if current == nil {
+		if wanted.parent != nil {
+			var parentExists bool
+			err := tx.QueryRow(context.Background(),
+				"SELECT EXISTS(SELECT 1 FROM notes n WHERE n.id = $1 AND n.user_id = $2 AND "+notTrashed("n", "$2")+")",
+				wanted.parent, userID).Scan(&parentExists)
+			if err != nil {
+				return 0, err
+			}
+			if !parentExists {
+				return 0, errParentNotFound
+			}
+		}
+		position, err := siblingPosition(tx, userID, &noteID, wanted.parent, nil, nil)
+		if err != nil {
+			return 0, err
+		}
+		_, err = tx.Exec(context.Background(), `
+			INSERT INTO notes (id, title, body, user_id, parent, embedding, tags, markdown, position)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+			noteID, wanted.title, wanted.body, userID, wanted.parent, rendered.embedding, tagsJSON, rendered.markdown, position)
+		if err != nil {
+			return 0, err
+		}
+	} else {
+		switch {
+		case textChanged:
+			err = updateNote(tx, userID, noteID, "title = $3, body = $4, markdown = $5, embedding = $6, tags = $7",
+				wanted.title, wanted.body, rendered.markdown, rendered.embedding, tagsJSON)
+		case !sameTags(wanted.tags, current.tags):
+			err = updateNote(tx, userID, noteID, "tags = $3", tagsJSON)
+		}
+		if err != nil {
+			return 0, err
+		}
+		if !equalParent(wanted.parent, current.parent) {
+			if _, err := moveNote(tx, userID, noteID, wanted.parent, nil, nil); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	if current == nil || textChanged {
+		_, err = tx.Exec(context.Background(),
+			"INSERT INTO revisions (note_id, title, body, user_id, size) VALUES ($1, $2, $3, $4, $5)",
+			noteID, wanted.title, wanted.body, userID, len(wanted.body))
+		if err != nil {
+			return 0, err
+		}
+		if err := saveLinks(tx, noteID, wanted.body); err != nil {
+			return 0, err
+		}
+	}
+
+	var version int64
+	err = tx.QueryRow(context.Background(), "SELECT version FROM notes WHERE id = $1", noteID).Scan(&version)
+	return version, err
+}
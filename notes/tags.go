@@ -0,0 +1,404 @@
+package notes
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	uuid "github.com/satori/go.uuid"
+	"github.com/stevecastle/modelpad/markdown"
+)
+
+// TagNode is a tag path segment in the tag tree. Count is the number of
+// notes tagged with exactly this path and Total the number tagged with it or
+// any path below it.
+type TagNode struct {
+	Name     string     `json:"name"`
+	Path     []string   `json:"path"`
+	Count    int        `json:"count"`
+	Total    int        `json:"total"`
+	Children []*TagNode `json:"children"`
+}
+
+// errTagExists marks a rename onto a tag that is already in use
+var errTagExists = errors.New("A tag with that path already exists, merge the tags instead")
+
+// GetTagTree returns every tag path used by the user's notes as a tree with
+// usage counts. Notes in the trash are not counted.
+func GetTagTree(c *gin.Context) {
+	userID := c.GetString("user_id")
+	db := c.MustGet("db").(*pgxpool.Pool)
+
+	rows, err := db.Query(context.Background(), `
+		SELECT n.id, t.tag->'path'
+		FROM notes n, jsonb_array_elements(COALESCE(n.tags, '[]'::jsonb)) AS t(tag)
+		WHERE n.user_id = $1 AND jsonb_typeof(t.tag->'path') = 'array' AND `+notTrashed("n", "$1"),
+		userID)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	root := &TagNode{Children: []*TagNode{}}
+	nodes := make(map[string]*TagNode)
+	counted := make(map[string]map[uuid.UUID]bool)
+	for rows.Next() {
+		var noteID uuid.UUID
+		var path []string
+		if err := rows.Scan(&noteID, &path); err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		if len(path) == 0 {
+			continue
+		}
+
+		parent := root
+		for i := range path {
+			key := strings.Join(path[:i+1], "/")
+			node := nodes[key]
+			if node == nil {
+				node = &TagNode{Name: path[i], Path: path[:i+1], Children: []*TagNode{}}
+				nodes[key] = node
+				counted[key] = make(map[uuid.UUID]bool)
+				parent.Children = append(parent.Children, node)
+			}
+			// A note counts once per node, however many of its tags are below it
+			if !counted[key][noteID] {
+				counted[key][noteID] = true
+				node.Total++
+				if i == len(path)-1 {
+					node.Count++
+				}
+			}
+			parent = node
+		}
+	}
+	if err := rows.Err(); err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	sortTagNodes(root.Children)
+	c.JSON(200, gin.H{"tags": root.Children, "count": len(nodes)})
+}
+
+func sortTagNodes(nodes []*TagNode) {
+	sort.Slice(nodes, func(i, j int) bool {
+		return strings.ToLower(nodes[i].Name) < strings.ToLower(nodes[j].Name)
+	})
+	for _, node := range nodes {
+		sortTagNodes(node.Children)
+	}
+}
+
+// RenameTag moves a tag, and every tag below it, to a new path. It fails
+// when the new path is already in use.
+func RenameTag(c *gin.Context) {
+	changeTag(c, false)
+}
+
+// MergeTag moves a tag, and every tag below it, into another tag. Notes that
+// end up with the same tag twice keep one.
+func MergeTag(c *gin.Context) {
+	changeTag(c, true)
+}
+
+// changeTag rewrites the tags of every affected note, including the tag
+// nodes in their bodies, in one transaction. Notes in the trash are changed
+// too so restoring them does not bring the old tag back.
+func changeTag(c *gin.Context, merge bool) {
+	userID := c.GetString("user_id")
+
+	var requestBody struct {
+		From string `json:"from"`
+		To   string `json:"to"`
+	}
+	if err := c.ShouldBindJSON(&requestBody); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request body"})
+		return
+	}
+	from, to := ParseTagPath(requestBody.From), ParseTagPath(requestBody.To)
+	if len(from) == 0 || len(to) == 0 {
+		c.JSON(400, gin.H{"error": "Both from and to tag paths are required"})
+		return
+	}
+	if equalPath(from, to) {
+		c.JSON(400, gin.H{"error": "The tag paths are the same"})
+		return
+	}
+	if merge && hasPrefix(to, from) {
+		c.JSON(400, gin.H{"error": "Cannot merge a tag into a tag below it"})
+		return
+	}
+
+	db := c.MustGet("db").(*pgxpool.Pool)
+
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback(context.Background())
+
+	count, err := retagNotes(tx, userID, from, to, merge)
+	if errors.Is(err, errTagExists) {
+		c.JSON(409, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	if count == 0 {
+		c.JSON(404, gin.H{"error": "Tag not found"})
+		return
+	}
+
+	err = tx.Commit(context.Background())
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"from":          from,
+		"to":            to,
+		"updated_count": count,
+	})
+}
+
+// retagNotes replaces the from prefix of tag paths with to in the user's
+// notes and returns how many notes changed. Without merge it returns
+// errTagExists when a note already uses a path at or below to that is not
+// being moved. Notes whose body changed get a revision. Embeddings are left
+// as they are; tag names are a small part of a note.
+func retagNotes(tx pgx.Tx, userID string, from []string, to []string, merge bool) (int, error) {
+	type tagged struct {
+		id   uuid.UUID
+		tags []NoteTag
+		body string
+	}
+
+	// Tag nodes in bodies normally match the tags column, but bodies are
+	// checked too in case they have drifted apart
+	rows, err := tx.Query(context.Background(), `
+		SELECT id, COALESCE(tags, '[]'::jsonb), COALESCE(body, '')
+		FROM notes
+		WHERE user_id = $1 AND (jsonb_array_length(COALESCE(tags, '[]'::jsonb)) > 0 OR strpos(body, '"tagPath"') > 0)
+		FOR UPDATE`, userID)
+	if err != nil {
+		return 0, err
+	}
+	var notes []tagged
+	for rows.Next() {
+		var note tagged
+		var tagsJSON []byte
+		if err := rows.Scan(&note.id, &tagsJSON, &note.body); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if err := json.Unmarshal(tagsJSON, &note.tags); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		notes = append(notes, note)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	if !merge {
+		for _, note := range notes {
+			for _, tag := range note.tags {
+				if hasPrefix(tag.Path, to) && !hasPrefix(tag.Path, from) {
+					return 0, errTagExists
+				}
+			}
+		}
+	}
+
+	count := 0
+	var rewritten []uuid.UUID
+	for _, note := range notes {
+		tags, ids, tagsChanged := retag(note.tags, from, to)
+		body, bodyChanged, err := retagBody(note.body, from, to, ids)
+		if err != nil {
+			return 0, err
+		}
+		if !tagsChanged && !bodyChanged {
+			continue
+		}
+
+		tagsJSON, err := json.Marshal(tags)
+		if err != nil {
+			return 0, err
+		}
+		var newBody, text *string
+		if bodyChanged {
+			rendered, err := markdown.ConvertJSONToMarkdown(body)
+			if err != nil {
+				return 0, err
+			}
+			newBody, text = &body, &rendered
+			rewritten = append(rewritten, note.id)
+		}
+		_, err = tx.Exec(context.Background(),
+			"UPDATE notes SET tags = $1, body = COALESCE($2, body), markdown = COALESCE($3, markdown), updated_at = now(), version = version + 1 WHERE id = $4",
+			tagsJSON, newBody, text, note.id)
+		if err != nil {
+			return 0, err
+		}
+		count++
+	}
+
+	// Rewritten bodies are kept in the history like any other edit
+	if len(rewritten) > 0 {
+		if err := recordRevisions(tx, rewritten); err != nil {
+			return 0, err
+		}
+	}
+	return count, nil
+}
+
+// retag moves the tags under from to to. When a moved tag lands on a path
+// the note already has it is dropped, and ids maps its id to the one kept.
+func retag(tags []NoteTag, from []string, to []string) ([]NoteTag, map[string]string, bool) {
+	ids := make(map[string]string)
+
+	// Tags that stay where they are take precedence over moved ones
+	seen := make(map[string]string)
+	for _, tag := range tags {
+		if !hasPrefix(tag.Path, from) {
+			seen[strings.Join(tag.Path, "/")] = tag.ID
+		}
+	}
+
+	kept := []NoteTag{}
+	changed := false
+	for _, tag := range tags {
+		if !hasPrefix(tag.Path, from) {
+			kept = append(kept, tag)
+			continue
+		}
+		changed = true
+		tag.Path = replacePrefix(tag.Path, from, to)
+		key := strings.Join(tag.Path, "/")
+		if id, ok := seen[key]; ok {
+			ids[tag.ID] = id
+			continue
+		}
+		seen[key] = tag.ID
+		kept = append(kept, tag)
+	}
+	return kept, ids, changed
+}
+
+// retagBody rewrites the tag nodes of a Lexical body that are under from,
+// pointing dropped tag ids at the kept ones. Bodies that are not JSON are
+// left unchanged.
+func retagBody(body string, from []string, to []string, ids map[string]string) (string, bool, error) {
+	if !strings.Contains(body, `"tagPath"`) {
+		return body, false, nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader([]byte(body)))
+	decoder.UseNumber()
+	var root interface{}
+	if err := decoder.Decode(&root); err != nil {
+		return body, false, nil
+	}
+
+	if !retagNode(root, from, to, ids) {
+		return body, false, nil
+	}
+	retagged, err := json.Marshal(root)
+	if err != nil {
+		return "", false, err
+	}
+	return string(retagged), true, nil
+}
+
+// retagNode walks a decoded Lexical tree and rewrites its tag nodes,
+// reporting whether anything changed
+func retagNode(node interface{}, from []string, to []string, ids map[string]string) bool {
+	changed := false
+	switch value := node.(type) {
+	case map[string]interface{}:
+		if value["type"] == "tag" {
+			if retagTagNode(value, from, to, ids) {
+				changed = true
+			}
+		}
+		for _, child := range value {
+			if retagNode(child, from, to, ids) {
+				changed = true
+			}
+		}
+	case []interface{}:
+		for _, child := range value {
+			if retagNode(child, from, to, ids) {
+				changed = true
+			}
+		}
+	}
+	return changed
+}
+
+// retagTagNode updates the path, name, text and id of one tag node
+func retagTagNode(node map[string]interface{}, from []string, to []string, ids map[string]string) bool {
+	rawPath, ok := node["tagPath"].([]interface{})
+	if !ok {
+		return false
+	}
+	path := make([]string, 0, len(rawPath))
+	for _, segment := range rawPath {
+		s, ok := segment.(string)
+		if !ok {
+			return false
+		}
+		path = append(path, s)
+	}
+	if !hasPrefix(path, from) {
+		return false
+	}
+
+	oldName := strings.Join(path, "/")
+	newPath := replacePrefix(path, from, to)
+	newName := strings.Join(newPath, "/")
+
+	segments := make([]interface{}, len(newPath))
+	for i, segment := range newPath {
+		segments[i] = segment
+	}
+	node["tagPath"] = segments
+	if name, _ := node["tagName"].(string); name == oldName || name == "" {
+		node["tagName"] = newName
+	}
+	if text, _ := node["text"].(string); text == "@"+oldName {
+		node["text"] = "@" + newName
+	}
+	if id, _ := node["tagId"].(string); ids[id] != "" {
+		node["tagId"] = ids[id]
+	}
+	return true
+}
+
+// hasPrefix reports whether path starts with prefix
+func hasPrefix(path []string, prefix []string) bool {
+	return len(path) >= len(prefix) && equalPath(path[:len(prefix)], prefix)
+}
+
+// replacePrefix returns path with its prefix replaced by replacement
+func replacePrefix(path []string, prefix []string, replacement []string) []string {
+	replaced := append([]string{}, replacement...)
+	return append(replaced, path[len(prefix):]...)
+}
@@ -0,0 +1,367 @@
+package notes
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/pgvector/pgvector-go"
+	uuid "github.com/satori/go.uuid"
+	"github.com/stevecastle/modelpad/markdown"
+)
+
+// placeholderPattern matches {{name}} placeholders, allowing spaces inside
+// the braces
+var placeholderPattern = regexp.MustCompile(`\{\{\s*([A-Za-z0-9_.-]+)\s*\}\}`)
+
+// substitute replaces the placeholders in s that have a value in variables.
+// Unknown placeholders are left as they are.
+func substitute(s string, variables map[string]string) string {
+	return placeholderPattern.ReplaceAllStringFunc(s, func(match string) string {
+		name := placeholderPattern.FindStringSubmatch(match)[1]
+		if value, ok := variables[name]; ok {
+			return value
+		}
+		return match
+	})
+}
+
+// substituteBody replaces placeholders in the text nodes of a Lexical body.
+// It reports whether anything changed; bodies that are not JSON are left
+// unchanged.
+func substituteBody(body string, variables map[string]string) (string, bool, error) {
+	if !placeholderPattern.MatchString(body) {
+		return body, false, nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader([]byte(body)))
+	decoder.UseNumber()
+	var root interface{}
+	if err := decoder.Decode(&root); err != nil {
+		return body, false, nil
+	}
+
+	if !substituteNode(root, variables) {
+		return body, false, nil
+	}
+	substituted, err := json.Marshal(root)
+	if err != nil {
+		return "", false, err
+	}
+	return string(substituted), true, nil
+}
+
+// substituteNode walks a decoded Lexical tree and replaces placeholders in
+// the text of every node, reporting whether anything changed
+func substituteNode(node interface{}, variables map[string]string) bool {
+	changed := false
+	switch value := node.(type) {
+	case map[string]interface{}:
+		for key, child := range value {
+			if text, ok := child.(string); ok && key == "text" {
+				if substituted := substitute(text, variables); substituted != text {
+					value[key] = substituted
+					changed = true
+				}
+				continue
+			}
+			if substituteNode(child, variables) {
+				changed = true
+			}
+		}
+	case []interface{}:
+		for _, child := range value {
+			if substituteNode(child, variables) {
+				changed = true
+			}
+		}
+	}
+	return changed
+}
+
+// SetTemplate marks a note as a template, or back as a regular note
+func SetTemplate(c *gin.Context) {
+	noteID, err := uuid.FromString(c.Param("id"))
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Invalid note ID"})
+		return
+	}
+
+	var requestBody struct {
+		IsTemplate bool `json:"is_template"`
+	}
+	if err := c.ShouldBindJSON(&requestBody); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	db := c.MustGet("db").(*pgxpool.Pool)
+	access, ok := AuthorizeNote(c, db, noteID.String(), RoleOwner)
+	if !ok {
+		return
+	}
+
+	result, err := db.Exec(context.Background(),
+		"UPDATE notes n SET is_template = $1, updated_at = now(), version = version + 1 WHERE n.id = $2 AND n.user_id = $3 AND "+notTrashed("n", "$3"),
+		requestBody.IsTemplate, noteID, access.OwnerID)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to update note template status"})
+		return
+	}
+	if result.RowsAffected() == 0 {
+		c.JSON(404, gin.H{"error": errNoteNotFound.Error()})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"message":     "Note template status updated successfully",
+		"is_template": requestBody.IsTemplate,
+	})
+}
+
+// InstantiateTemplate creates a note from a template, copying the template's
+// subtree with it, and places it last under the chosen parent. Placeholders
+// in titles and text are replaced: {{date}}, {{time}} and {{datetime}} with
+// the current time in the given timezone (UTC by default), {{title}} with
+// the new note's title everywhere but in that title, and any other name with
+// its entry in variables.
+func InstantiateTemplate(c *gin.Context) {
+	userID := c.GetString("user_id")
+
+	templateID, err := uuid.FromString(c.Param("id"))
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Invalid template ID"})
+		return
+	}
+
+	var requestBody struct {
+		Parent    *string           `json:"parent"`
+		Title     *string           `json:"title"`
+		Timezone  string            `json:"timezone"`
+		Variables map[string]string `json:"variables"`
+	}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&requestBody); err != nil {
+			c.JSON(400, gin.H{"error": "Invalid request body"})
+			return
+		}
+	}
+
+	parent, err := parseOptionalUUID(requestBody.Parent)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Invalid parent ID"})
+		return
+	}
+
+	location := time.UTC
+	if requestBody.Timezone != "" {
+		location, err = time.LoadLocation(requestBody.Timezone)
+		if err != nil {
+			c.JSON(400, gin.H{"error": "Invalid timezone"})
+			return
+		}
+	}
+
+	db := c.MustGet("db").(*pgxpool.Pool)
+
+	template, err := getNote(db, templateID.String(), userID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.JSON(404, gin.H{"error": "Template not found or you don't have permission to access it"})
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	if !template.IsTemplate {
+		c.JSON(400, gin.H{"error": "Note is not a template"})
+		return
+	}
+
+	// Built-in variables can be overridden by the request's own. The new
+	// note's title is made before {{title}} has a value, so it only fills
+	// the placeholder in the template's own title when given in variables.
+	now := time.Now().In(location)
+	variables := map[string]string{
+		"date":     now.Format("2006-01-02"),
+		"time":     now.Format("15:04"),
+		"datetime": now.Format("2006-01-02 15:04"),
+	}
+	for name, value := range requestBody.Variables {
+		variables[name] = value
+	}
+	title := substitute(template.Title, variables)
+	if requestBody.Title != nil {
+		title = *requestBody.Title
+	}
+	if _, ok := requestBody.Variables["title"]; !ok {
+		variables["title"] = title
+	}
+
+	// Notes are substituted and embedded before the transaction, which
+	// then only copies them
+	oldIDs, err := subtreeIDs(db, template.ID)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	substituted, err := substituteNotes(db, oldIDs, variables, map[uuid.UUID]string{template.ID: title})
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback(context.Background())
+
+	newIDs, newParents, err := copyStructure(tx, oldIDs)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	if err := copyNotes(tx, userID, oldIDs, newIDs, newParents, map[uuid.UUID]string{template.ID: title}); err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	if err := saveSubstitutions(tx, oldIDs, newIDs, substituted); err != nil {
+		status := 500
+		if errors.Is(err, errNoteChanged) {
+			status = 409
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	if err := recordRevisions(tx, newIDs); err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	if _, err := moveNote(tx, userID, newIDs[0], parent, nil, nil); err != nil {
+		c.JSON(operationStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	note, err := getNote(tx, newIDs[0].String(), userID)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	err = tx.Commit(context.Background())
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(201, gin.H{
+		"note":  note,
+		"count": len(newIDs),
+	})
+}
+
+// substitution is a template note with its placeholders replaced, made
+// from the given version of the note
+type substitution struct {
+	version   int64
+	title     string
+	body      string
+	markdown  string
+	embedding *pgvector.Vector
+}
+
+// substituteNotes replaces placeholders in the titles and bodies of notes and
+// renders the ones that changed, keyed by id. Notes in titles get the given
+// title instead.
+func substituteNotes(db dbtx, ids []uuid.UUID, variables map[string]string, titles map[uuid.UUID]string) (map[uuid.UUID]substitution, error) {
+	type original struct {
+		id       uuid.UUID
+		version  int64
+		title    string
+		body     string
+		markdown string
+	}
+
+	rows, err := db.Query(context.Background(),
+		"SELECT id, version, COALESCE(title, ''), COALESCE(body, ''), COALESCE(markdown, '') FROM notes WHERE id = ANY($1::uuid[])", ids)
+	if err != nil {
+		return nil, err
+	}
+	var notes []original
+	for rows.Next() {
+		var note original
+		if err := rows.Scan(&note.id, &note.version, &note.title, &note.body, &note.markdown); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		notes = append(notes, note)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	substituted := make(map[uuid.UUID]substitution)
+	for _, note := range notes {
+		title, ok := titles[note.id]
+		if !ok {
+			title = substitute(note.title, variables)
+		}
+		body, bodyChanged, err := substituteBody(note.body, variables)
+		if err != nil {
+			return nil, err
+		}
+		if title == note.title && !bodyChanged {
+			continue
+		}
+
+		text := note.markdown
+		if bodyChanged {
+			text, err = markdown.ConvertJSONToMarkdown(body)
+			if err != nil {
+				return nil, err
+			}
+		}
+		substituted[note.id] = substitution{
+			version:   note.version,
+			title:     title,
+			body:      body,
+			markdown:  text,
+			embedding: embedNote(title, text),
+		}
+	}
+	return substituted, nil
+}
+
+// saveSubstitutions writes substituted notes over their copies, newIDs[i]
+// being the copy of oldIDs[i]. It fails with errNoteChanged when a template
+// note changed after it was substituted.
+func saveSubstitutions(tx pgx.Tx, oldIDs []uuid.UUID, newIDs []uuid.UUID, substituted map[uuid.UUID]substitution) error {
+	for i, id := range oldIDs {
+		note, ok := substituted[id]
+		if !ok {
+			continue
+		}
+		result, err := tx.Exec(context.Background(), `
+			UPDATE notes n SET title = $1, body = $2, markdown = $3, embedding = $4
+			FROM notes template
+			WHERE n.id = $5 AND template.id = $6 AND template.version = $7`,
+			note.title, note.body, note.markdown, note.embedding, newIDs[i], id, note.version)
+		if err != nil {
+			return err
+		}
+		if result.RowsAffected() == 0 {
+			return errNoteChanged
+		}
+	}
+	return nil
+}
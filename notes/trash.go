@@ -0,0 +1,339 @@
+package notes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	uuid "github.com/satori/go.uuid"
+)
+
+// defaultTrashRetention is how long deleted notes stay in the trash when
+// TRASH_RETENTION is not set
+const defaultTrashRetention = 30 * 24 * time.Hour
+
+// notTrashed returns a condition excluding notes in the user's trash, the
+// deleted notes and everything below them. userArg is the user id placeholder.
+func notTrashed(alias string, userArg string) string {
+	return alias + ".id NOT IN (SELECT trashed_note_ids(" + userArg + "))"
+}
+
+// trashNote moves a note the user can edit and its subtree to the owner's
+// trash. It returns the number of notes moved, including the note itself.
+func trashNote(tx dbtx, userID string, noteID string) (int, error) {
+	access, err := Authorize(tx, noteID, userID, RoleEditor)
+	if err != nil {
+		return 0, err
+	}
+
+	// Only the root of the subtree is marked, its descendants follow it
+	result, err := tx.Exec(context.Background(),
+		"UPDATE notes n SET deleted_at = now(), version = version + 1 WHERE n.id = $1 AND n.user_id = $2 AND "+notTrashed("n", "$2"),
+		noteID, access.OwnerID)
+	if err != nil {
+		return 0, err
+	}
+	if result.RowsAffected() == 0 {
+		return 0, errNoteNotFound
+	}
+
+	var descendantCount int
+	err = tx.QueryRow(context.Background(),
+		"SELECT COUNT(*) FROM "+descendantsOf("$1")+" d", noteID).Scan(&descendantCount)
+	return descendantCount + 1, err
+}
+
+// ListTrash returns a page of the deleted notes of the user, most recently
+// deleted first, each with the number of notes deleted along with it
+func ListTrash(c *gin.Context) {
+	userID := c.GetString("user_id")
+
+	params := pageParams(c)
+	params.Fields = []string{"id", "title", "parent", "created_at", "updated_at", "version", "is_shared", "tags", "has_children"}
+
+	q := NewQuery("notes").SelectNote("notes", params.Fields)
+	q.Where("notes.user_id = "+q.Arg(userID), "notes.deleted_at IS NOT NULL").
+		Select("notes.deleted_at", "(SELECT COUNT(*) FROM "+descendantsOf("notes.id")+" d) AS descendant_count").
+		OrderBy("notes.deleted_at DESC", "notes.id")
+
+	notes, totalCount, err := runSearch(q, params, c, func(note *Note) []interface{} {
+		return []interface{}{&note.DeletedAt, &note.DescendantCount}
+	})
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	if notes == nil {
+		notes = []Note{}
+	}
+
+	c.JSON(200, gin.H{
+		"notes": notes,
+		"pagination": PaginationInfo{
+			Page:    params.Page,
+			Limit:   params.Limit,
+			Total:   totalCount,
+			HasMore: params.Page*params.Limit < totalCount,
+		},
+	})
+}
+
+// RestoreNote takes a deleted note and its subtree out of the trash. It goes
+// back under its original parent, or to the root when that parent is gone
+// or itself in the trash.
+func RestoreNote(c *gin.Context) {
+	userID := c.GetString("user_id")
+	noteID := c.Param("id")
+	db := c.MustGet("db").(*pgxpool.Pool)
+
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback(context.Background())
+
+	var parent *uuid.UUID
+	err = tx.QueryRow(context.Background(),
+		"SELECT parent FROM notes WHERE id = $1 AND user_id = $2 AND deleted_at IS NOT NULL FOR UPDATE",
+		noteID, userID).Scan(&parent)
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.JSON(404, gin.H{"error": "Note not found in the trash"})
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	if parent != nil {
+		var parentExists bool
+		err = tx.QueryRow(context.Background(),
+			"SELECT EXISTS(SELECT 1 FROM notes n WHERE n.id = $1 AND n.user_id = $2 AND "+notTrashed("n", "$2")+")",
+			parent, userID).Scan(&parentExists)
+		if err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		if !parentExists {
+			parent = nil
+		}
+	}
+
+	_, err = tx.Exec(context.Background(),
+		"UPDATE notes SET deleted_at = NULL, parent = $1, updated_at = now(), version = version + 1 WHERE id = $2",
+		parent, noteID)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	err = tx.Commit(context.Background())
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"message": "Note restored",
+		"parent":  parent,
+	})
+}
+
+// PurgeNote permanently deletes a note in the trash and its subtree
+func PurgeNote(c *gin.Context) {
+	userID := c.GetString("user_id")
+	db := c.MustGet("db").(*pgxpool.Pool)
+
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback(context.Background())
+
+	var noteID string
+	err = tx.QueryRow(context.Background(),
+		"SELECT id FROM notes WHERE id = $1 AND user_id = $2 AND deleted_at IS NOT NULL",
+		c.Param("id"), userID).Scan(&noteID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.JSON(404, gin.H{"error": "Note not found in the trash"})
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	purged, err := purgeSubtree(tx, noteID)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	err = tx.Commit(context.Background())
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"message":      "Note permanently deleted",
+		"purged_count": purged,
+	})
+}
+
+// EmptyTrash permanently deletes every note in the user's trash
+func EmptyTrash(c *gin.Context) {
+	userID := c.GetString("user_id")
+	db := c.MustGet("db").(*pgxpool.Pool)
+
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback(context.Background())
+
+	purged, err := purgeTrash(tx, "user_id = $1", userID)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	err = tx.Commit(context.Background())
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"message":      "Trash emptied",
+		"purged_count": purged,
+	})
+}
+
+// purgeTrash permanently deletes the deleted notes matching condition and
+// their subtrees
+func purgeTrash(tx pgx.Tx, condition string, args ...interface{}) (int, error) {
+	rows, err := tx.Query(context.Background(),
+		"SELECT id FROM notes WHERE deleted_at IS NOT NULL AND "+condition, args...)
+	if err != nil {
+		return 0, err
+	}
+	var roots []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		roots = append(roots, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	// A root inside an earlier purged subtree is already gone and counts zero
+	purged := 0
+	for _, id := range roots {
+		count, err := purgeSubtree(tx, id)
+		if err != nil {
+			return purged, err
+		}
+		purged += count
+	}
+	return purged, nil
+}
+
+// purgeSubtree permanently deletes a note, all its descendants and their
+// revisions and branches. It returns the number of notes deleted.
+func purgeSubtree(tx pgx.Tx, noteID string) (int, error) {
+	// This includes the note itself and all its children, grandchildren, etc.
+	rows, err := tx.Query(context.Background(), `
+		WITH RECURSIVE note_hierarchy AS (
+			SELECT id, user_id FROM notes WHERE id = $1
+			UNION ALL
+			SELECT n.id, n.user_id FROM notes n
+			INNER JOIN note_hierarchy nh ON n.parent = nh.id
+			WHERE n.user_id = nh.user_id
+		)
+		SELECT id FROM note_hierarchy
+	`, noteID)
+	if err != nil {
+		return 0, err
+	}
+	var noteIDs []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		noteIDs = append(noteIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if len(noteIDs) == 0 {
+		return 0, nil
+	}
+
+	_, err = tx.Exec(context.Background(), "DELETE FROM revisions WHERE note_id = ANY($1::uuid[])", noteIDs)
+	if err != nil {
+		return 0, err
+	}
+
+	// Children first, then parents. Branches are deleted with their note.
+	for i := len(noteIDs) - 1; i >= 0; i-- {
+		_, err = tx.Exec(context.Background(), "DELETE FROM notes WHERE id = $1", noteIDs[i])
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(noteIDs), nil
+}
+
+// StartTrashPurger permanently deletes notes that have been in the trash for
+// longer than TRASH_RETENTION (30 days by default), checking hourly until ctx
+// is cancelled
+func StartTrashPurger(ctx context.Context, db *pgxpool.Pool) {
+	retention, err := time.ParseDuration(os.Getenv("TRASH_RETENTION"))
+	if err != nil || retention <= 0 {
+		retention = defaultTrashRetention
+	}
+
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		if err := purgeExpiredTrash(ctx, db, time.Now().Add(-retention)); err != nil {
+			fmt.Fprintf(os.Stderr, "Trash purge failed: %v\n", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// purgeExpiredTrash permanently deletes notes deleted before cutoff
+func purgeExpiredTrash(ctx context.Context, db *pgxpool.Pool, cutoff time.Time) error {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := purgeTrash(tx, "deleted_at < $1", cutoff); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
@@ -0,0 +1,155 @@
+package notes
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5/pgxpool"
+	uuid "github.com/satori/go.uuid"
+)
+
+// TreeNode is a note in the hierarchy returned by GetNoteTree, without its
+// body. ChildCount counts every child, including ones beyond the depth limit
+// that are not in Children.
+type TreeNode struct {
+	ID         uuid.UUID   `json:"id"`
+	Title      string      `json:"title"`
+	Parent     *uuid.UUID  `json:"parent"`
+	Position   string      `json:"position,omitempty"`
+	UpdatedAt  time.Time   `json:"updated_at"`
+	ChildCount int         `json:"child_count"`
+	Children   []*TreeNode `json:"children"`
+}
+
+// Breadcrumb is a note on the path from the root to another note
+type Breadcrumb struct {
+	ID     uuid.UUID  `json:"id"`
+	Title  string     `json:"title"`
+	Parent *uuid.UUID `json:"parent"`
+}
+
+// GetNoteTree returns the user's notes as a tree. root limits it to the
+// subtree below a note, which may be shared with the user, and depth to
+// that many levels.
+func GetNoteTree(c *gin.Context) {
+	userID := c.GetString("user_id")
+	db := c.MustGet("db").(*pgxpool.Pool)
+
+	depth := 0
+	if depthStr := c.Query("depth"); depthStr != "" {
+		d, err := strconv.Atoi(depthStr)
+		if err != nil || d <= 0 {
+			c.JSON(400, gin.H{"error": "Invalid depth, expected a positive number"})
+			return
+		}
+		depth = d
+	}
+
+	// A root the user can read may be a note shared with them, whose
+	// subtree is read from its owner's notes
+	var root *string
+	owner := userID
+	if rootID := c.Query("root"); rootID != "" {
+		access, ok := AuthorizeNote(c, db, rootID, RoleViewer)
+		if !ok {
+			return
+		}
+		root = &rootID
+		owner = access.OwnerID
+	}
+
+	rows, err := db.Query(context.Background(), `
+		WITH RECURSIVE tree AS (
+			SELECT n.id, 1 AS depth FROM notes n
+			WHERE n.user_id = $1 AND n.parent IS NOT DISTINCT FROM $2 AND n.deleted_at IS NULL
+			UNION ALL
+			SELECT n.id, t.depth + 1 FROM notes n
+			INNER JOIN tree t ON n.parent = t.id
+			WHERE n.user_id = $1 AND n.deleted_at IS NULL AND ($3 = 0 OR t.depth < $3)
+		)
+		SELECT n.id, COALESCE(n.title, ''), n.parent, COALESCE(n.position, ''), n.updated_at,
+			(SELECT COUNT(*) FROM notes c WHERE c.parent = n.id AND c.deleted_at IS NULL)
+		FROM tree t
+		INNER JOIN notes n ON n.id = t.id
+		WHERE `+notTrashed("n", "$1")+`
+		ORDER BY t.depth, n.position, n.updated_at DESC`, owner, root, depth)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	// Rows come level by level, so parents are seen before their children
+	tree := []*TreeNode{}
+	nodes := make(map[uuid.UUID]*TreeNode)
+	count := 0
+	for rows.Next() {
+		node := &TreeNode{Children: []*TreeNode{}}
+		err := rows.Scan(&node.ID, &node.Title, &node.Parent, &node.Position, &node.UpdatedAt, &node.ChildCount)
+		if err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		nodes[node.ID] = node
+		count++
+		if node.Parent != nil && nodes[*node.Parent] != nil {
+			parent := nodes[*node.Parent]
+			parent.Children = append(parent.Children, node)
+		} else {
+			tree = append(tree, node)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(200, gin.H{"tree": tree, "count": count})
+}
+
+// GetNoteAncestors returns the path from the root down to a note's parent,
+// for breadcrumbs. For a shared note the path starts at the highest note
+// the user can access.
+func GetNoteAncestors(c *gin.Context) {
+	noteID := c.Param("id")
+	db := c.MustGet("db").(*pgxpool.Pool)
+
+	access, ok := AuthorizeNote(c, db, noteID, RoleViewer)
+	if !ok {
+		return
+	}
+	owner := access.OwnerID
+
+	rows, err := db.Query(context.Background(), `
+		WITH RECURSIVE ancestors AS (
+			SELECT parent AS id, 1 AS depth FROM notes WHERE id = $1
+			UNION ALL
+			SELECT n.parent, a.depth + 1 FROM notes n
+			INNER JOIN ancestors a ON n.id = a.id
+			WHERE a.depth < 1000
+		)
+		SELECT n.id, COALESCE(n.title, ''), n.parent
+		FROM ancestors a
+		INNER JOIN notes n ON n.id = a.id
+		WHERE n.user_id = $2 AND note_role(n.id, $3) IS NOT NULL
+		ORDER BY a.depth DESC`, noteID, owner, c.GetString("user_id"))
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	ancestors := []Breadcrumb{}
+	for rows.Next() {
+		var crumb Breadcrumb
+		if err := rows.Scan(&crumb.ID, &crumb.Title, &crumb.Parent); err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		ancestors = append(ancestors, crumb)
+	}
+
+	c.JSON(200, gin.H{"ancestors": ancestors})
+}
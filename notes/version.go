@@ -0,0 +1,89 @@
+package notes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+// noteETag formats a note version as an entity tag
+func noteETag(version int64) string {
+	return fmt.Sprintf(`"%d"`, version)
+}
+
+// parseETag reads the version from an entity tag. Weak tags are accepted.
+func parseETag(tag string) (int64, error) {
+	tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+	version, err := strconv.ParseInt(strings.Trim(tag, `"`), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid entity tag %q", tag)
+	}
+	return version, nil
+}
+
+// expectedVersion returns the version a save was based on, taken from the
+// If-Match header or else the base_version in the request body. It is nil
+// when the save is unconditional.
+func expectedVersion(c *gin.Context, baseVersion *int64) (*int64, error) {
+	ifMatch := c.GetHeader("If-Match")
+	if ifMatch == "" || ifMatch == "*" {
+		return baseVersion, nil
+	}
+	version, err := parseETag(ifMatch)
+	if err != nil {
+		return nil, err
+	}
+	if baseVersion != nil && *baseVersion != version {
+		return nil, errors.New("If-Match and base_version disagree")
+	}
+	return &version, nil
+}
+
+// getNote loads a note owned by the user with all its fields
+func getNote(db dbtx, noteID string, userID string) (Note, error) {
+	q := NewQuery("notes").SelectNote("notes", AllNoteFields)
+	user := q.Arg(userID)
+	q.Where("notes.id = "+q.Arg(noteID), "notes.user_id = "+user, notTrashed("notes", user))
+	sql, args := q.SQL()
+	rows, err := db.Query(context.Background(), sql, args...)
+	if err != nil {
+		return Note{}, err
+	}
+	notes, err := scanNotes(rows, AllNoteFields, nil)
+	if err != nil {
+		return Note{}, err
+	}
+	if len(notes) == 0 {
+		return Note{}, pgx.ErrNoRows
+	}
+	return notes[0], nil
+}
+
+// staleSave responds with 409 Conflict and the current note when the note
+// has moved past the expected version. It reports whether it responded.
+func staleSave(c *gin.Context, db dbtx, noteID string, userID string, expected int64) bool {
+	current, err := getNote(db, noteID, userID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		// New notes have no version to conflict with
+		return false
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return true
+	}
+	if current.Version == expected {
+		return false
+	}
+
+	c.Header("ETag", noteETag(current.Version))
+	c.JSON(409, gin.H{
+		"error": fmt.Sprintf("Note has changed since version %d", expected),
+		"note":  current,
+	})
+	return true
+}
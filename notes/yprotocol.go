@@ -0,0 +1,512 @@
+package notes
+
+import (
+	"errors"
+	"sort"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Message types of the y-websocket protocol. messageSnapshot is our own, a
+// client sends it with the document as Lexical JSON so it can be saved.
+const (
+	messageSync           = 0
+	messageAwareness      = 1
+	messageQueryAwareness = 3
+	messageSnapshot       = 100
+)
+
+// Sync message steps of the y-protocols sync protocol
+const (
+	syncStep1  = 0
+	syncStep2  = 1
+	syncUpdate = 2
+)
+
+// emptyUpdate is a Yjs update without changes and emptyStateVector a state
+// vector of a document without changes
+var (
+	emptyUpdate      = []byte{0, 0}
+	emptyStateVector = []byte{0}
+)
+
+var errMalformedMessage = errors.New("malformed message")
+
+// yDecoder reads the lib0 encoding used by Yjs
+type yDecoder struct {
+	data []byte
+	pos  int
+}
+
+// varUint reads an unsigned integer stored 7 bits per byte, low bits first
+func (d *yDecoder) varUint() (uint64, error) {
+	var value uint64
+	for shift := uint(0); shift < 64; shift += 7 {
+		if d.pos >= len(d.data) {
+			return 0, errMalformedMessage
+		}
+		b := d.data[d.pos]
+		d.pos++
+		value |= uint64(b&0x7f) << shift
+		if b < 0x80 {
+			return value, nil
+		}
+	}
+	return 0, errMalformedMessage
+}
+
+// varBytes reads a length prefixed byte slice
+func (d *yDecoder) varBytes() ([]byte, error) {
+	n, err := d.varUint()
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(len(d.data)-d.pos) {
+		return nil, errMalformedMessage
+	}
+	b := d.data[d.pos : d.pos+int(n)]
+	d.pos += int(n)
+	return b, nil
+}
+
+// varString reads a length prefixed UTF-8 string
+func (d *yDecoder) varString() (string, error) {
+	b, err := d.varBytes()
+	if err != nil {
+		return "", err
+	}
+	if !utf8.Valid(b) {
+		return "", errMalformedMessage
+	}
+	return string(b), nil
+}
+
+// yEncoder writes the lib0 encoding used by Yjs
+type yEncoder struct {
+	data []byte
+}
+
+func (e *yEncoder) varUint(value uint64) {
+	for value >= 0x80 {
+		e.data = append(e.data, byte(value)|0x80)
+		value >>= 7
+	}
+	e.data = append(e.data, byte(value))
+}
+
+func (e *yEncoder) varBytes(b []byte) {
+	e.varUint(uint64(len(b)))
+	e.data = append(e.data, b...)
+}
+
+func (e *yEncoder) varString(s string) {
+	e.varBytes([]byte(s))
+}
+
+// syncMessage encodes a sync protocol message
+func syncMessage(step uint64, payload []byte) []byte {
+	var e yEncoder
+	e.varUint(messageSync)
+	e.varUint(step)
+	e.varBytes(payload)
+	return e.data
+}
+
+// awarenessState is the presence of one Yjs client, such as its user name
+// and cursor. State is JSON and "null" once the client has left.
+type awarenessState struct {
+	ClientID uint64
+	Clock    uint64
+	State    string
+}
+
+// decodeAwareness reads an awareness update
+func decodeAwareness(update []byte) ([]awarenessState, error) {
+	d := yDecoder{data: update}
+	n, err := d.varUint()
+	if err != nil {
+		return nil, err
+	}
+	var states []awarenessState
+	for i := uint64(0); i < n; i++ {
+		var s awarenessState
+		if s.ClientID, err = d.varUint(); err != nil {
+			return nil, err
+		}
+		if s.Clock, err = d.varUint(); err != nil {
+			return nil, err
+		}
+		if s.State, err = d.varString(); err != nil {
+			return nil, err
+		}
+		states = append(states, s)
+	}
+	return states, nil
+}
+
+// awarenessMessage encodes an awareness message with the states
+func awarenessMessage(states []awarenessState) []byte {
+	var update yEncoder
+	update.varUint(uint64(len(states)))
+	for _, s := range states {
+		update.varUint(s.ClientID)
+		update.varUint(s.Clock)
+		update.varString(s.State)
+	}
+
+	var e yEncoder
+	e.varUint(messageAwareness)
+	e.varBytes(update.data)
+	return e.data
+}
+
+// yRange is the clocks [start, end) of one Yjs client
+type yRange struct {
+	start uint64
+	end   uint64
+}
+
+// yDocState is what a set of Yjs updates holds: the clock ranges of each
+// client's structs and the ranges they delete. It is enough to tell whether
+// one document has everything another has, without building either.
+type yDocState struct {
+	structs map[uint64][]yRange
+	deleted map[uint64][]yRange
+}
+
+func newYDocState() *yDocState {
+	return &yDocState{structs: make(map[uint64][]yRange), deleted: make(map[uint64][]yRange)}
+}
+
+// apply adds a Yjs update in the v1 encoding
+func (s *yDocState) apply(update []byte) error {
+	d := yDecoder{data: update}
+	clients, err := d.varUint()
+	if err != nil {
+		return err
+	}
+	for i := uint64(0); i < clients; i++ {
+		count, err := d.varUint()
+		if err != nil {
+			return err
+		}
+		client, err := d.varUint()
+		if err != nil {
+			return err
+		}
+		clock, err := d.varUint()
+		if err != nil {
+			return err
+		}
+		for j := uint64(0); j < count; j++ {
+			length, skip, err := d.yStruct()
+			if err != nil {
+				return err
+			}
+			// Skips are gaps in an update, the clocks are not in it
+			if !skip && length > 0 {
+				s.structs[client] = append(s.structs[client], yRange{clock, clock + length})
+			}
+			clock += length
+		}
+	}
+
+	clients, err = d.varUint()
+	if err != nil {
+		return err
+	}
+	for i := uint64(0); i < clients; i++ {
+		client, err := d.varUint()
+		if err != nil {
+			return err
+		}
+		count, err := d.varUint()
+		if err != nil {
+			return err
+		}
+		for j := uint64(0); j < count; j++ {
+			clock, err := d.varUint()
+			if err != nil {
+				return err
+			}
+			length, err := d.varUint()
+			if err != nil {
+				return err
+			}
+			s.deleted[client] = append(s.deleted[client], yRange{clock, clock + length})
+		}
+	}
+	return nil
+}
+
+// stateVector returns the clock up to which each client's structs are all
+// present, as Yjs counts it
+func (s *yDocState) stateVector() map[uint64]uint64 {
+	vector := make(map[uint64]uint64)
+	for client, ranges := range s.structs {
+		merged := mergeRanges(ranges)
+		if len(merged) > 0 && merged[0].start == 0 {
+			vector[client] = merged[0].end
+		}
+	}
+	return vector
+}
+
+// includes reports whether s has the same structs as other and deletes at
+// least what other deletes
+func (s *yDocState) includes(other *yDocState) bool {
+	mine, theirs := s.stateVector(), other.stateVector()
+	if len(mine) != len(theirs) {
+		return false
+	}
+	for client, clock := range theirs {
+		if mine[client] != clock {
+			return false
+		}
+	}
+
+	for client, ranges := range other.deleted {
+		covering := mergeRanges(s.deleted[client])
+		for _, r := range mergeRanges(ranges) {
+			covered := false
+			for _, c := range covering {
+				if c.start <= r.start && r.end <= c.end {
+					covered = true
+					break
+				}
+			}
+			if !covered {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// mergeRanges sorts ranges and joins those that overlap or touch
+func mergeRanges(ranges []yRange) []yRange {
+	sorted := append([]yRange(nil), ranges...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].start < sorted[j].start })
+	var merged []yRange
+	for _, r := range sorted {
+		if n := len(merged); n > 0 && r.start <= merged[n-1].end {
+			if r.end > merged[n-1].end {
+				merged[n-1].end = r.end
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// Struct and content kinds of the Yjs update encoding, the low five bits of
+// a struct's info byte
+const (
+	yStructGC       = 0
+	yContentDeleted = 1
+	yContentJSON    = 2
+	yContentBinary  = 3
+	yContentString  = 4
+	yContentEmbed   = 5
+	yContentFormat  = 6
+	yContentType    = 7
+	yContentAny     = 8
+	yContentDoc     = 9
+	yStructSkip     = 10
+)
+
+// Type refs of content that are followed by a name
+const (
+	yXmlElement = 3
+	yXmlHook    = 5
+)
+
+// yStruct reads one struct of an update, returning how many clocks it takes
+// and whether it is a skip
+func (d *yDecoder) yStruct() (uint64, bool, error) {
+	if d.pos >= len(d.data) {
+		return 0, false, errMalformedMessage
+	}
+	info := d.data[d.pos]
+	d.pos++
+
+	switch info & 0x1f {
+	case yStructGC:
+		length, err := d.varUint()
+		return length, false, err
+	case yStructSkip:
+		length, err := d.varUint()
+		return length, true, err
+	}
+
+	// An item's origins are ids, a client and a clock
+	ids := 0
+	if info&0x80 != 0 {
+		ids++
+	}
+	if info&0x40 != 0 {
+		ids++
+	}
+	for i := 0; i < 2*ids; i++ {
+		if _, err := d.varUint(); err != nil {
+			return 0, false, err
+		}
+	}
+	// Without origins the parent is given, by name or by id
+	if info&0xc0 == 0 {
+		named, err := d.varUint()
+		if err != nil {
+			return 0, false, err
+		}
+		if named == 1 {
+			_, err = d.varString()
+		} else {
+			_, err = d.varUint()
+			if err == nil {
+				_, err = d.varUint()
+			}
+		}
+		if err != nil {
+			return 0, false, err
+		}
+		if info&0x20 != 0 {
+			if _, err := d.varString(); err != nil {
+				return 0, false, err
+			}
+		}
+	}
+
+	length, err := d.yContent(info & 0x1f)
+	return length, false, err
+}
+
+// yContent reads the content of an item, returning its length
+func (d *yDecoder) yContent(kind byte) (uint64, error) {
+	switch kind {
+	case yContentDeleted:
+		return d.varUint()
+	case yContentJSON, yContentAny:
+		n, err := d.varUint()
+		if err != nil {
+			return 0, err
+		}
+		for i := uint64(0); i < n; i++ {
+			if kind == yContentJSON {
+				_, err = d.varString()
+			} else {
+				err = d.skipAny(0)
+			}
+			if err != nil {
+				return 0, err
+			}
+		}
+		return n, nil
+	case yContentBinary:
+		_, err := d.varBytes()
+		return 1, err
+	case yContentString:
+		s, err := d.varString()
+		if err != nil {
+			return 0, err
+		}
+		// Yjs counts strings in UTF-16 code units
+		return uint64(len(utf16.Encode([]rune(s)))), nil
+	case yContentEmbed:
+		_, err := d.varString()
+		return 1, err
+	case yContentFormat:
+		if _, err := d.varString(); err != nil {
+			return 0, err
+		}
+		_, err := d.varString()
+		return 1, err
+	case yContentType:
+		ref, err := d.varUint()
+		if err != nil {
+			return 0, err
+		}
+		if ref == yXmlElement || ref == yXmlHook {
+			_, err = d.varString()
+		}
+		return 1, err
+	case yContentDoc:
+		if _, err := d.varString(); err != nil {
+			return 0, err
+		}
+		return 1, d.skipAny(0)
+	}
+	return 0, errMalformedMessage
+}
+
+// maxAnyDepth is how deeply values in the any encoding may nest
+const maxAnyDepth = 100
+
+// skipAny skips a value in the lib0 any encoding, nested depth deep
+func (d *yDecoder) skipAny(depth int) error {
+	if d.pos >= len(d.data) || depth > maxAnyDepth {
+		return errMalformedMessage
+	}
+	kind := d.data[d.pos]
+	d.pos++
+
+	switch kind {
+	case 127, 126, 121, 120: // undefined, null, false, true
+		return nil
+	case 125: // integer
+		for {
+			if d.pos >= len(d.data) {
+				return errMalformedMessage
+			}
+			b := d.data[d.pos]
+			d.pos++
+			if b < 0x80 {
+				return nil
+			}
+		}
+	case 124: // float32
+		return d.skip(4)
+	case 123, 122: // float64, bigint
+		return d.skip(8)
+	case 119: // string
+		_, err := d.varString()
+		return err
+	case 118: // object
+		n, err := d.varUint()
+		if err != nil {
+			return err
+		}
+		for i := uint64(0); i < n; i++ {
+			if _, err := d.varString(); err != nil {
+				return err
+			}
+			if err := d.skipAny(depth + 1); err != nil {
+				return err
+			}
+		}
+		return nil
+	case 117: // array
+		n, err := d.varUint()
+		if err != nil {
+			return err
+		}
+		for i := uint64(0); i < n; i++ {
+			if err := d.skipAny(depth + 1); err != nil {
+				return err
+			}
+		}
+		return nil
+	case 116: // bytes
+		_, err := d.varBytes()
+		return err
+	}
+	return errMalformedMessage
+}
+
+func (d *yDecoder) skip(n int) error {
+	if n > len(d.data)-d.pos {
+		return errMalformedMessage
+	}
+	d.pos += n
+	return nil
+}
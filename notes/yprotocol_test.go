@@ -0,0 +1,167 @@
+package notes
+
+import (
+	"reflect"
+	"testing"
+)
+
+// yString encodes an update inserting text for client at clock, at the
+// root type "root" or after the item origin
+func yString(client uint64, clock uint64, origin *[2]uint64, text string, deleted ...yRange) []byte {
+	var e yEncoder
+	e.varUint(1)
+	e.varUint(1)
+	e.varUint(client)
+	e.varUint(clock)
+	if origin != nil {
+		e.data = append(e.data, 0x80|yContentString)
+		e.varUint(origin[0])
+		e.varUint(origin[1])
+	} else {
+		e.data = append(e.data, yContentString)
+		e.varUint(1)
+		e.varString("root")
+	}
+	e.varString(text)
+	yDeletes(&e, client, deleted)
+	return e.data
+}
+
+// yDelete encodes an update that only deletes
+func yDelete(client uint64, deleted ...yRange) []byte {
+	e := yEncoder{data: []byte{0}}
+	yDeletes(&e, client, deleted)
+	return e.data
+}
+
+func yDeletes(e *yEncoder, client uint64, deleted []yRange) {
+	if len(deleted) == 0 {
+		e.varUint(0)
+		return
+	}
+	e.varUint(1)
+	e.varUint(client)
+	e.varUint(uint64(len(deleted)))
+	for _, r := range deleted {
+		e.varUint(r.start)
+		e.varUint(r.end - r.start)
+	}
+}
+
+func yState(t *testing.T, updates ...[]byte) *yDocState {
+	t.Helper()
+	state := newYDocState()
+	for _, update := range updates {
+		if err := state.apply(update); err != nil {
+			t.Fatalf("apply(%v) error = %v", update, err)
+		}
+	}
+	return state
+}
+
+func TestYDocStateStateVector(t *testing.T) {
+	// "é😀" is three UTF-16 code units
+	state := yState(t,
+		yString(1, 0, nil, "hello"),
+		yString(1, 5, &[2]uint64{1, 4}, "é😀"),
+		yString(2, 0, &[2]uint64{1, 7}, "ab"),
+		yString(3, 4, &[2]uint64{1, 7}, "cd"),
+	)
+	want := map[uint64]uint64{1: 8, 2: 2}
+	if got := state.stateVector(); !reflect.DeepEqual(got, want) {
+		t.Errorf("stateVector() = %v, want %v", got, want)
+	}
+
+	// Structs received out of order count once the gap is filled
+	if err := state.apply(yString(3, 0, &[2]uint64{1, 7}, "wxyz")); err != nil {
+		t.Fatalf("apply() error = %v", err)
+	}
+	want[3] = 6
+	if got := state.stateVector(); !reflect.DeepEqual(got, want) {
+		t.Errorf("stateVector() = %v, want %v", got, want)
+	}
+}
+
+func TestYDocStateSkipsAndAny(t *testing.T) {
+	var e yEncoder
+	e.varUint(1)
+	e.varUint(3)
+	e.varUint(1)
+	e.varUint(0)
+	// Four values in the any encoding: null, an integer, a nested array
+	// and an object
+	e.data = append(e.data, yContentAny)
+	e.varUint(1)
+	e.varString("root")
+	e.varUint(4)
+	e.data = append(e.data, 126, 125, 0xc1, 0x01, 117, 2, 119)
+	e.varString("x")
+	e.data = append(e.data, 117, 0, 118, 1)
+	e.varString("key")
+	e.data = append(e.data, 123, 0, 0, 0, 0, 0, 0, 0, 0)
+	// A skip of two clocks, then a deleted item of three
+	e.data = append(e.data, yStructSkip)
+	e.varUint(2)
+	e.data = append(e.data, 0x40|yContentDeleted)
+	e.varUint(1)
+	e.varUint(0)
+	e.varUint(3)
+	e.varUint(0)
+
+	state := yState(t, e.data)
+	if got := state.structs[1]; !reflect.DeepEqual(got, []yRange{{0, 4}, {6, 9}}) {
+		t.Errorf("structs = %v, want [{0 4} {6 9}]", got)
+	}
+	if got := state.stateVector(); !reflect.DeepEqual(got, map[uint64]uint64{1: 4}) {
+		t.Errorf("stateVector() = %v, want map[1:4]", got)
+	}
+}
+
+func TestYDocStateMalformed(t *testing.T) {
+	valid := yString(1, 0, nil, "hello")
+	deep := []byte{1, 1, 1, 0, yContentAny, 1, 4, 'r', 'o', 'o', 't', 1}
+	for i := 0; i <= maxAnyDepth+1; i++ {
+		deep = append(deep, 117, 1)
+	}
+	deep = append(deep, 126, 0)
+
+	for name, update := range map[string][]byte{
+		"empty":        nil,
+		"truncated":    valid[:len(valid)-2],
+		"unknown kind": {1, 1, 1, 0, 11, 0},
+		"too deep":     deep,
+	} {
+		if err := newYDocState().apply(update); err == nil {
+			t.Errorf("%s: apply() succeeded, want an error", name)
+		}
+	}
+}
+
+func TestYDocStateIncludes(t *testing.T) {
+	first := yString(1, 0, nil, "hello")
+	second := yString(2, 0, &[2]uint64{1, 4}, "abc")
+	removed := yDelete(1, yRange{1, 3})
+	stored := yState(t, first, second, removed)
+
+	full := func(deleted ...yRange) *yDocState {
+		return yState(t, yString(1, 0, nil, "hello", deleted...), second)
+	}
+
+	tests := []struct {
+		name     string
+		snapshot *yDocState
+		want     bool
+	}{
+		{"everything", full(yRange{1, 3}), true},
+		{"deletes merged differently", full(yRange{1, 2}, yRange{2, 4}), true},
+		{"missing a delete", full(), false},
+		{"missing part of a delete", full(yRange{1, 2}), false},
+		{"missing an update", yState(t, yString(1, 0, nil, "hello", yRange{1, 3})), false},
+		{"ahead of the stored updates", yState(t, first, second, removed, yString(2, 3, &[2]uint64{2, 2}, "d")), false},
+	}
+	for _, tt := range tests {
+		if got := tt.snapshot.includes(stored); got != tt.want {
+			t.Errorf("%s: includes() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
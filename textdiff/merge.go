@@ -0,0 +1,115 @@
+package textdiff
+
+// Chunk is one region of a three-way merge. A clean chunk holds the merged
+// lines in Ours. A conflicting chunk holds both sides' lines and the base
+// lines they changed.
+type Chunk struct {
+	Base     []string
+	Ours     []string
+	Theirs   []string
+	Conflict bool
+}
+
+// Merge3 merges the changes made from base to ours and from base to theirs.
+// Regions changed on only one side take that side's lines; regions changed
+// differently on both sides become conflicts.
+func Merge3(base []string, ours []string, theirs []string) []Chunk {
+	matchOurs := matches(base, ours)
+	matchTheirs := matches(base, theirs)
+
+	var chunks []Chunk
+	clean := func(lines []string) {
+		if len(lines) == 0 {
+			return
+		}
+		if n := len(chunks); n > 0 && !chunks[n-1].Conflict {
+			chunks[n-1].Ours = append(chunks[n-1].Ours, lines...)
+			return
+		}
+		chunks = append(chunks, Chunk{Ours: append([]string(nil), lines...)})
+	}
+
+	i, o, t := 0, 0, 0
+	for i < len(base) || o < len(ours) || t < len(theirs) {
+		// Lines unchanged on both sides
+		if i < len(base) && matchOurs[i] == o && matchTheirs[i] == t {
+			clean(base[i : i+1])
+			i, o, t = i+1, o+1, t+1
+			continue
+		}
+
+		// The changed region runs to the next base line both sides kept
+		j := i
+		for j < len(base) && (matchOurs[j] < 0 || matchTheirs[j] < 0) {
+			j++
+		}
+		oe, te := len(ours), len(theirs)
+		if j < len(base) {
+			oe, te = matchOurs[j], matchTheirs[j]
+		}
+
+		b, x, y := base[i:j], ours[o:oe], theirs[t:te]
+		switch {
+		case equal(x, b):
+			clean(y)
+		case equal(y, b), equal(x, y):
+			clean(x)
+		default:
+			chunks = append(chunks, Chunk{Base: b, Ours: x, Theirs: y, Conflict: true})
+		}
+		i, o, t = j, oe, te
+	}
+	return chunks
+}
+
+// Conflicts counts the conflicting chunks
+func Conflicts(chunks []Chunk) int {
+	count := 0
+	for _, chunk := range chunks {
+		if chunk.Conflict {
+			count++
+		}
+	}
+	return count
+}
+
+// Resolve joins merged chunks into lines, taking our side of conflicts when
+// preferOurs is set and their side otherwise
+func Resolve(chunks []Chunk, preferOurs bool) []string {
+	var lines []string
+	for _, chunk := range chunks {
+		if chunk.Conflict && !preferOurs {
+			lines = append(lines, chunk.Theirs...)
+		} else {
+			lines = append(lines, chunk.Ours...)
+		}
+	}
+	return lines
+}
+
+// matches maps each line of a to the line of b it is kept as, or -1 when the
+// line is removed
+func matches(a []string, b []string) []int {
+	match := make([]int, len(a))
+	for i := range match {
+		match[i] = -1
+	}
+	for _, edit := range Lines(a, b) {
+		if edit.Kind == Equal {
+			match[edit.OldLine] = edit.NewLine
+		}
+	}
+	return match
+}
+
+func equal(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
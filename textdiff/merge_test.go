@@ -0,0 +1,82 @@
+package textdiff
+
+import (
+	"strings"
+	"testing"
+)
+
+func lines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, " ")
+}
+
+func TestMerge3(t *testing.T) {
+	tests := []struct {
+		name      string
+		base      string
+		ours      string
+		theirs    string
+		want      string
+		conflicts []Chunk
+	}{
+		{name: "unchanged", base: "a b c", ours: "a b c", theirs: "a b c", want: "a b c"},
+		{name: "only ours changed", base: "a b c", ours: "a B c", theirs: "a b c", want: "a B c"},
+		{name: "only theirs changed", base: "a b c", ours: "a b c", theirs: "a b C", want: "a b C"},
+		{name: "only theirs deleted", base: "a b c", ours: "a b c", theirs: "a c", want: "a c"},
+		{name: "both sides in different places", base: "a b c d", ours: "A b c d", theirs: "a b c D", want: "A b c D"},
+		{name: "both sides made the same edit", base: "a b c", ours: "a B c", theirs: "a B c", want: "a B c"},
+		{name: "both sides made the same insert", base: "a b", ours: "a x b", theirs: "a x b", want: "a x b"},
+		{name: "both sides deleted everything", base: "a b", ours: "", theirs: "", want: ""},
+		{
+			name: "conflicting edits", base: "a b c", ours: "a B c", theirs: "a X c", want: "a B c",
+			conflicts: []Chunk{{Base: lines("b"), Ours: lines("B"), Theirs: lines("X"), Conflict: true}},
+		},
+		{
+			name: "edit against delete", base: "a b c", ours: "a B c", theirs: "a c", want: "a B c",
+			conflicts: []Chunk{{Base: lines("b"), Ours: lines("B"), Theirs: nil, Conflict: true}},
+		},
+		{
+			name: "inserts at the same anchor", base: "a b", ours: "a x b", theirs: "a y b", want: "a x b",
+			conflicts: []Chunk{{Ours: lines("x"), Theirs: lines("y"), Conflict: true}},
+		},
+		{
+			name: "appends to an empty base", base: "", ours: "x", theirs: "y", want: "x",
+			conflicts: []Chunk{{Ours: lines("x"), Theirs: lines("y"), Conflict: true}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chunks := Merge3(lines(tt.base), lines(tt.ours), lines(tt.theirs))
+
+			if got := Resolve(chunks, true); strings.Join(got, " ") != tt.want {
+				t.Errorf("Resolve(ours) = %q, want %q", got, tt.want)
+			}
+			if n := Conflicts(chunks); n != len(tt.conflicts) {
+				t.Fatalf("Conflicts() = %d, want %d: %+v", n, len(tt.conflicts), chunks)
+			}
+
+			var conflicts []Chunk
+			for _, chunk := range chunks {
+				if chunk.Conflict {
+					conflicts = append(conflicts, chunk)
+				}
+			}
+			for i, chunk := range conflicts {
+				want := tt.conflicts[i]
+				if !equal(chunk.Base, want.Base) || !equal(chunk.Ours, want.Ours) || !equal(chunk.Theirs, want.Theirs) {
+					t.Errorf("conflict %d = %+v, want %+v", i, chunk, want)
+				}
+			}
+		})
+	}
+}
+
+func TestResolveTheirs(t *testing.T) {
+	chunks := Merge3(lines("a b c d"), lines("A b c x"), lines("a b c y"))
+	if got := strings.Join(Resolve(chunks, false), " "); got != "A b c y" {
+		t.Errorf("Resolve(theirs) = %q, want %q", got, "A b c y")
+	}
+}
@@ -0,0 +1,231 @@
+package textdiff
+
+import (
+	"fmt"
+	"strings"
+)
+
+type OpKind int
+
+const (
+	Equal OpKind = iota
+	Insert
+	Delete
+)
+
+// Edit is one line of a diff. OldLine and NewLine are zero based line numbers
+// in the old and new text; the one that does not apply to the edit is -1.
+type Edit struct {
+	Kind    OpKind
+	OldLine int
+	NewLine int
+	Text    string
+}
+
+// SplitLines splits text into lines without their line endings
+func SplitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
+
+// Lines returns the shortest edit script turning a into b, computed with
+// Myers' O(ND) algorithm
+func Lines(a []string, b []string) []Edit {
+	// Common prefix and suffix never need the search
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	var edits []Edit
+	for i := 0; i < prefix; i++ {
+		edits = append(edits, Edit{Kind: Equal, OldLine: i, NewLine: i, Text: a[i]})
+	}
+	for _, edit := range myers(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]) {
+		if edit.OldLine >= 0 {
+			edit.OldLine += prefix
+		}
+		if edit.NewLine >= 0 {
+			edit.NewLine += prefix
+		}
+		edits = append(edits, edit)
+	}
+	for i := suffix; i > 0; i-- {
+		edits = append(edits, Edit{Kind: Equal, OldLine: len(a) - i, NewLine: len(b) - i, Text: a[len(a)-i]})
+	}
+	return edits
+}
+
+func myers(a []string, b []string) []Edit {
+	n, m := len(a), len(b)
+	max := n + m
+	if max == 0 {
+		return nil
+	}
+
+	// v[offset+k] is the furthest x reached on diagonal k. trace[d] keeps the
+	// diagonals -d..d of v as they were before step d, for backtracking.
+	offset := max + 1
+	v := make([]int, 2*max+3)
+	var trace [][]int
+	for d := 0; d <= max; d++ {
+		trace = append(trace, append([]int(nil), v[offset-d:offset+d+1]...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				return backtrack(a, b, trace)
+			}
+		}
+	}
+	return nil
+}
+
+func backtrack(a []string, b []string, trace [][]int) []Edit {
+	x, y := len(a), len(b)
+	var reversed []Edit
+	for d := len(trace) - 1; d >= 0; d-- {
+		v := trace[d]
+		at := func(k int) int { return v[k+d] }
+
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && at(k-1) < at(k+1)) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := 0
+		if d > 0 {
+			prevX = at(prevK)
+		}
+		prevY := prevX - prevK
+
+		for x > prevX && y > prevY {
+			x--
+			y--
+			reversed = append(reversed, Edit{Kind: Equal, OldLine: x, NewLine: y, Text: a[x]})
+		}
+		if d == 0 {
+			break
+		}
+		if x == prevX {
+			y--
+			reversed = append(reversed, Edit{Kind: Insert, OldLine: -1, NewLine: y, Text: b[y]})
+		} else {
+			x--
+			reversed = append(reversed, Edit{Kind: Delete, OldLine: x, NewLine: -1, Text: a[x]})
+		}
+	}
+
+	edits := make([]Edit, len(reversed))
+	for i, edit := range reversed {
+		edits[len(reversed)-1-i] = edit
+	}
+	return edits
+}
+
+// Stats counts the inserted and deleted lines in edits
+func Stats(edits []Edit) (inserted int, deleted int) {
+	for _, edit := range edits {
+		switch edit.Kind {
+		case Insert:
+			inserted++
+		case Delete:
+			deleted++
+		}
+	}
+	return inserted, deleted
+}
+
+// Unified formats edits as a unified diff with context lines of context
+// around each change. It returns an empty string when nothing changed.
+func Unified(fromName string, toName string, edits []Edit, context int) string {
+	// Lines of each side consumed before every edit, for hunk headers
+	oldPos := make([]int, len(edits)+1)
+	newPos := make([]int, len(edits)+1)
+	for i, edit := range edits {
+		oldPos[i+1], newPos[i+1] = oldPos[i], newPos[i]
+		if edit.Kind != Insert {
+			oldPos[i+1]++
+		}
+		if edit.Kind != Delete {
+			newPos[i+1]++
+		}
+	}
+
+	var sb strings.Builder
+	for start := 0; start < len(edits); {
+		// Find the next change
+		for start < len(edits) && edits[start].Kind == Equal {
+			start++
+		}
+		if start == len(edits) {
+			break
+		}
+
+		// Extend the hunk while changes are close enough to share context
+		end := start
+		for i := start; i < len(edits); i++ {
+			if edits[i].Kind != Equal {
+				end = i + 1
+			} else if i-end >= 2*context {
+				break
+			}
+		}
+		first := start - context
+		if first < 0 {
+			first = 0
+		}
+		last := end + context
+		if last > len(edits) {
+			last = len(edits)
+		}
+
+		if sb.Len() == 0 {
+			fmt.Fprintf(&sb, "--- %s\n+++ %s\n", fromName, toName)
+		}
+		fmt.Fprintf(&sb, "@@ -%s +%s @@\n",
+			hunkRange(oldPos[first], oldPos[last]-oldPos[first]),
+			hunkRange(newPos[first], newPos[last]-newPos[first]))
+		for _, edit := range edits[first:last] {
+			switch edit.Kind {
+			case Equal:
+				sb.WriteString(" ")
+			case Insert:
+				sb.WriteString("+")
+			case Delete:
+				sb.WriteString("-")
+			}
+			sb.WriteString(edit.Text)
+			sb.WriteString("\n")
+		}
+		start = last
+	}
+	return sb.String()
+}
+
+// hunkRange formats one side of a hunk header. An empty side is reported at
+// the line before the hunk, as diff -u does.
+func hunkRange(before int, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", before)
+	}
+	return fmt.Sprintf("%d,%d", before+1, count)
+}
@@ -0,0 +1,162 @@
+package textdiff
+
+import (
+	"reflect"
+	"testing"
+)
+
+// apply rebuilds both sides of an edit script, checking its line numbers
+func apply(t *testing.T, edits []Edit) (old []string, new []string) {
+	t.Helper()
+	for _, edit := range edits {
+		switch edit.Kind {
+		case Equal:
+			if edit.OldLine != len(old) || edit.NewLine != len(new) {
+				t.Fatalf("equal %q at %d,%d, want %d,%d", edit.Text, edit.OldLine, edit.NewLine, len(old), len(new))
+			}
+			old = append(old, edit.Text)
+			new = append(new, edit.Text)
+		case Delete:
+			if edit.OldLine != len(old) || edit.NewLine != -1 {
+				t.Fatalf("delete %q at %d,%d, want %d,-1", edit.Text, edit.OldLine, edit.NewLine, len(old))
+			}
+			old = append(old, edit.Text)
+		case Insert:
+			if edit.OldLine != -1 || edit.NewLine != len(new) {
+				t.Fatalf("insert %q at %d,%d, want -1,%d", edit.Text, edit.OldLine, edit.NewLine, len(new))
+			}
+			new = append(new, edit.Text)
+		}
+	}
+	return old, new
+}
+
+func TestLines(t *testing.T) {
+	tests := []struct {
+		name    string
+		a       string
+		b       string
+		changes int
+	}{
+		{name: "both empty", a: "", b: "", changes: 0},
+		{name: "unchanged", a: "a b c", b: "a b c", changes: 0},
+		{name: "insert into empty", a: "", b: "a b", changes: 2},
+		{name: "delete everything", a: "a b", b: "", changes: 2},
+		{name: "insert at the start", a: "b c", b: "a b c", changes: 1},
+		{name: "insert at the end", a: "a b", b: "a b c", changes: 1},
+		{name: "delete in the middle", a: "a b c", b: "a c", changes: 1},
+		{name: "replace a line", a: "a b c", b: "a x c", changes: 2},
+		{name: "repeated lines", a: "a b a b a", b: "b a b a b", changes: 2},
+		{name: "classic example", a: "a b c a b b a", b: "c b a b a c", changes: 5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := lines(tt.a), lines(tt.b)
+			edits := Lines(a, b)
+			old, new := apply(t, edits)
+			if !equal(old, a) || !equal(new, b) {
+				t.Fatalf("edits rebuild %q and %q, want %q and %q", old, new, a, b)
+			}
+			inserted, deleted := Stats(edits)
+			if inserted+deleted != tt.changes {
+				t.Errorf("%d inserts and %d deletes, want %d changes in all", inserted, deleted, tt.changes)
+			}
+		})
+	}
+}
+
+func TestLinesPureEdits(t *testing.T) {
+	if edits := Lines(nil, nil); len(edits) != 0 {
+		t.Errorf("Lines(nil, nil) = %v, want no edits", edits)
+	}
+
+	inserts := Lines(nil, []string{"a", "b"})
+	want := []Edit{
+		{Kind: Insert, OldLine: -1, NewLine: 0, Text: "a"},
+		{Kind: Insert, OldLine: -1, NewLine: 1, Text: "b"},
+	}
+	if !reflect.DeepEqual(inserts, want) {
+		t.Errorf("inserts = %v, want %v", inserts, want)
+	}
+
+	deletes := Lines([]string{"a", "b"}, nil)
+	want = []Edit{
+		{Kind: Delete, OldLine: 0, NewLine: -1, Text: "a"},
+		{Kind: Delete, OldLine: 1, NewLine: -1, Text: "b"},
+	}
+	if !reflect.DeepEqual(deletes, want) {
+		t.Errorf("deletes = %v, want %v", deletes, want)
+	}
+}
+
+func TestUnified(t *testing.T) {
+	tests := []struct {
+		name    string
+		a       string
+		b       string
+		context int
+		want    string
+	}{
+		{name: "no changes", a: "a b c", b: "a b c", context: 3, want: ""},
+		{name: "both empty", a: "", b: "", context: 3, want: ""},
+		{
+			name: "insert into empty", a: "", b: "a b", context: 3,
+			want: "@@ -0,0 +1,2 @@\n+a\n+b\n",
+		},
+		{
+			name: "delete everything", a: "a b", b: "", context: 3,
+			want: "@@ -1,2 +0,0 @@\n-a\n-b\n",
+		},
+		{
+			name: "context is cut to the text", a: "a b c", b: "a x c", context: 3,
+			want: "@@ -1,3 +1,3 @@\n a\n-b\n+x\n c\n",
+		},
+		{
+			name: "context around a change", a: "1 2 3 4 5 6 7 8 9", b: "1 2 3 4 x 6 7 8 9", context: 2,
+			want: "@@ -3,5 +3,5 @@\n 3\n 4\n-5\n+x\n 6\n 7\n",
+		},
+		{
+			name: "insert without context", a: "1 2 3", b: "1 2 x 3", context: 0,
+			want: "@@ -2,0 +3,1 @@\n+x\n",
+		},
+		{
+			name: "close changes share a hunk", a: "1 2 3 4 5 6", b: "x 2 3 4 5 y", context: 2,
+			want: "@@ -1,6 +1,6 @@\n-1\n+x\n 2\n 3\n 4\n 5\n-6\n+y\n",
+		},
+		{
+			name: "distant changes get their own hunks", a: "1 2 3 4 5 6 7 8", b: "x 2 3 4 5 6 7 y", context: 1,
+			want: "@@ -1,2 +1,2 @@\n-1\n+x\n 2\n@@ -7,2 +7,2 @@\n 7\n-8\n+y\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Unified("old", "new", Lines(lines(tt.a), lines(tt.b)), tt.context)
+			want := tt.want
+			if want != "" {
+				want = "--- old\n+++ new\n" + want
+			}
+			if got != want {
+				t.Errorf("Unified =\n%s\nwant\n%s", got, want)
+			}
+		})
+	}
+}
+
+func TestSplitLines(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{text: "", want: nil},
+		{text: "a", want: []string{"a"}},
+		{text: "a\nb\n", want: []string{"a", "b"}},
+		{text: "a\n\nb", want: []string{"a", "", "b"}},
+	}
+	for _, tt := range tests {
+		if got := SplitLines(tt.text); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("SplitLines(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
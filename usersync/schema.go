@@ -0,0 +1,177 @@
+package usersync
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// settingsSchema is the JSON Schema of the settings document. Only the keys
+// listed are checked, clients may store other keys as any JSON value.
+var settingsSchema = map[string]interface{}{
+	"$schema": "https://json-schema.org/draft/2020-12/schema",
+	"title":   "ModelPad settings",
+	"type":    "object",
+	"properties": map[string]interface{}{
+		"modelSettings": map[string]interface{}{
+			"description": "Generation options sent with every model request",
+			"type":        "object",
+			"properties": map[string]interface{}{
+				"mirostat":       map[string]interface{}{"type": "integer", "enum": []interface{}{0, 1, 2}},
+				"mirostat_eta":   map[string]interface{}{"type": "number", "minimum": 0},
+				"mirostat_tau":   map[string]interface{}{"type": "number", "minimum": 0},
+				"num_ctx":        map[string]interface{}{"type": "integer", "minimum": 1},
+				"num_gqa":        map[string]interface{}{"type": "integer", "minimum": 1},
+				"num_gpu":        map[string]interface{}{"type": "integer", "minimum": 0},
+				"num_thread":     map[string]interface{}{"type": "integer", "minimum": 1},
+				"repeat_last_n":  map[string]interface{}{"type": "integer", "minimum": -1},
+				"repeat_penalty": map[string]interface{}{"type": "number", "minimum": 0},
+				"temperature":    map[string]interface{}{"type": "number", "minimum": 0, "maximum": 2},
+				"seed":           map[string]interface{}{"type": "integer"},
+				"stop":           map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}},
+				"tfs_z":          map[string]interface{}{"type": "number", "minimum": 0},
+				"num_predict":    map[string]interface{}{"type": "integer", "minimum": -2},
+				"top_k":          map[string]interface{}{"type": "integer", "minimum": 0},
+				"top_p":          map[string]interface{}{"type": "number", "minimum": 0, "maximum": 1},
+			},
+		},
+		"stories": map[string]interface{}{
+			"description": "The open tabs, in order",
+			"type":        "array",
+			"items": map[string]interface{}{
+				"type":     "object",
+				"required": []interface{}{"id", "title"},
+				"properties": map[string]interface{}{
+					"id":               map[string]interface{}{"type": "string"},
+					"title":            map[string]interface{}{"type": "string"},
+					"open":             map[string]interface{}{"type": "boolean"},
+					"synced":           map[string]interface{}{"type": "boolean"},
+					"includeInContext": map[string]interface{}{"type": "boolean"},
+				},
+			},
+		},
+		"activeStoryId": map[string]interface{}{
+			"description": "The id of the selected tab",
+			"type":        "string",
+		},
+		"model": map[string]interface{}{"type": "string"},
+	},
+}
+
+// validateSetting checks a setting's value against its schema, if the key
+// has one
+func validateSetting(key string, value interface{}) error {
+	properties := settingsSchema["properties"].(map[string]interface{})
+	schema, ok := properties[key].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	return validate(schema, value, key)
+}
+
+// validate checks a decoded JSON value against the subset of JSON Schema
+// used by settingsSchema: type, enum, minimum, maximum, properties, required
+// and items. Numbers must be decoded as json.Number.
+func validate(schema map[string]interface{}, value interface{}, path string) error {
+	if schemaType, ok := schema["type"].(string); ok && !hasType(value, schemaType) {
+		return fmt.Errorf("%s must be %s", path, article(schemaType))
+	}
+
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, allowed := range enum {
+			if fmt.Sprint(allowed) == fmt.Sprint(value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s must be one of %v", path, enum)
+		}
+	}
+
+	if number, ok := value.(json.Number); ok {
+		n, _ := number.Float64()
+		if minimum, ok := schema["minimum"]; ok && n < toFloat(minimum) {
+			return fmt.Errorf("%s must be at least %v", path, minimum)
+		}
+		if maximum, ok := schema["maximum"]; ok && n > toFloat(maximum) {
+			return fmt.Errorf("%s must be at most %v", path, maximum)
+		}
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if required, ok := schema["required"].([]interface{}); ok {
+			for _, name := range required {
+				if _, ok := v[name.(string)]; !ok {
+					return fmt.Errorf("%s.%s is required", path, name)
+				}
+			}
+		}
+		if properties, ok := schema["properties"].(map[string]interface{}); ok {
+			for name, child := range v {
+				if childSchema, ok := properties[name].(map[string]interface{}); ok {
+					if err := validate(childSchema, child, path+"."+name); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	case []interface{}:
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			for i, item := range v {
+				if err := validate(items, item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// hasType reports whether a decoded JSON value has a JSON Schema type
+func hasType(value interface{}, schemaType string) bool {
+	switch schemaType {
+	case "object":
+		_, ok := value.(map[string]interface{})
+		return ok
+	case "array":
+		_, ok := value.([]interface{})
+		return ok
+	case "string":
+		_, ok := value.(string)
+		return ok
+	case "boolean":
+		_, ok := value.(bool)
+		return ok
+	case "number":
+		_, ok := value.(json.Number)
+		return ok
+	case "integer":
+		number, ok := value.(json.Number)
+		if !ok {
+			return false
+		}
+		_, err := number.Int64()
+		return err == nil
+	}
+	return true
+}
+
+func article(schemaType string) string {
+	if strings.ContainsAny(schemaType[:1], "aeiou") {
+		return "an " + schemaType
+	}
+	return "a " + schemaType
+}
+
+func toFloat(value interface{}) float64 {
+	switch v := value.(type) {
+	case int:
+		return float64(v)
+	case float64:
+		return v
+	}
+	return 0
+}
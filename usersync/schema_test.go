@@ -0,0 +1,96 @@
+package usersync
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	schema := map[string]interface{}{
+		"type":     "object",
+		"required": []interface{}{"name"},
+		"properties": map[string]interface{}{
+			"name":    map[string]interface{}{"type": "string"},
+			"enabled": map[string]interface{}{"type": "boolean"},
+			"count":   map[string]interface{}{"type": "integer", "minimum": 1, "maximum": 10},
+			"ratio":   map[string]interface{}{"type": "number", "minimum": 0, "maximum": 1.5},
+			"mode":    map[string]interface{}{"type": "integer", "enum": []interface{}{0, 1, 2}},
+			"tags":    map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}},
+			"nested": map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"level": map[string]interface{}{"type": "integer"},
+				},
+			},
+		},
+	}
+
+	tests := []struct {
+		name    string
+		value   string
+		wantErr string
+	}{
+		{name: "required only", value: `{"name":"a"}`},
+		{name: "every property", value: `{"name":"a","enabled":true,"count":10,"ratio":1.5,"mode":2,"tags":["x","y"],"nested":{"level":3}}`},
+		{name: "unknown properties are allowed", value: `{"name":"a","other":[1,{"b":null}]}`},
+		{name: "not an object", value: `["a"]`, wantErr: "settings must be an object"},
+		{name: "missing required", value: `{"enabled":true}`, wantErr: "settings.name is required"},
+		{name: "string type", value: `{"name":1}`, wantErr: "settings.name must be a string"},
+		{name: "boolean type", value: `{"name":"a","enabled":"yes"}`, wantErr: "settings.enabled must be a boolean"},
+		{name: "integer type", value: `{"name":"a","count":1.5}`, wantErr: "settings.count must be an integer"},
+		{name: "number type", value: `{"name":"a","ratio":"1"}`, wantErr: "settings.ratio must be a number"},
+		{name: "array type", value: `{"name":"a","tags":"x"}`, wantErr: "settings.tags must be an array"},
+		{name: "object type", value: `{"name":"a","nested":1}`, wantErr: "settings.nested must be an object"},
+		{name: "minimum", value: `{"name":"a","count":0}`, wantErr: "settings.count must be at least 1"},
+		{name: "maximum", value: `{"name":"a","count":11}`, wantErr: "settings.count must be at most 10"},
+		{name: "fractional maximum", value: `{"name":"a","ratio":1.6}`, wantErr: "settings.ratio must be at most 1.5"},
+		{name: "enum", value: `{"name":"a","mode":3}`, wantErr: "settings.mode must be one of [0 1 2]"},
+		{name: "items", value: `{"name":"a","tags":["x",2]}`, wantErr: "settings.tags[1] must be a string"},
+		{name: "nested properties", value: `{"name":"a","nested":{"level":"high"}}`, wantErr: "settings.nested.level must be an integer"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validate(schema, mustDecode(t, tt.value), "settings")
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("validate(%s): %v", tt.value, err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("validate(%s) = %v, want %q", tt.value, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateSetting(t *testing.T) {
+	tests := []struct {
+		key     string
+		value   string
+		wantErr string
+	}{
+		{key: "modelSettings", value: `{"temperature":0.7,"stop":["\n"],"mirostat":1}`},
+		{key: "modelSettings", value: `{"temperature":3}`, wantErr: "modelSettings.temperature must be at most"},
+		{key: "stories", value: `[{"id":"1","title":"Draft","open":true}]`},
+		{key: "stories", value: `[{"id":"1"}]`, wantErr: "stories[0].title is required"},
+		{key: "activeStoryId", value: `7`, wantErr: "activeStoryId must be a string"},
+		{key: "unknownKey", value: `{"anything":[1,2]}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.key+" "+tt.value, func(t *testing.T) {
+			err := validateSetting(tt.key, mustDecode(t, tt.value))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("validateSetting(%s, %s): %v", tt.key, tt.value, err)
+				}
+				return
+			}
+			if err == nil || !strings.HasPrefix(err.Error(), tt.wantErr) {
+				t.Errorf("validateSetting(%s, %s) = %v, want %q", tt.key, tt.value, err, tt.wantErr)
+			}
+		})
+	}
+}
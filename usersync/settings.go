@@ -0,0 +1,532 @@
+package usersync
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const (
+	// maxKeyLength is the longest setting key accepted
+	maxKeyLength = 100
+
+	// maxSettingHistory is how many past values are kept per setting
+	maxSettingHistory = 100
+)
+
+// setting is the stored value and version of one setting
+type setting struct {
+	value   interface{}
+	version int64
+}
+
+// SettingChange is a value a setting had. Value is null when the setting
+// was removed.
+type SettingChange struct {
+	ID        int64           `json:"id"`
+	Key       string          `json:"key"`
+	Value     json.RawMessage `json:"value"`
+	Version   int64           `json:"version"`
+	ChangedAt time.Time       `json:"changed_at"`
+}
+
+// settingConflict reports a key whose version changed since the client read it
+type settingConflict struct {
+	Key     string      `json:"key"`
+	Version int64       `json:"version"`
+	Value   interface{} `json:"value"`
+}
+
+// errInvalidSetting marks a value rejected by the settings schema
+var errInvalidSetting = errors.New("invalid setting")
+
+// GetSettings returns the user's settings document and the version of each key
+func GetSettings(c *gin.Context) {
+	userID := c.GetString("user_id")
+	db := c.MustGet("db").(*pgxpool.Pool)
+
+	settings, err := loadSettings(db, userID, nil)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, settingsResponse(settings))
+}
+
+// GetSettingsSchema returns the JSON Schema settings are validated against
+func GetSettingsSchema(c *gin.Context) {
+	c.JSON(200, settingsSchema)
+}
+
+// PatchSettings applies a JSON merge patch (RFC 7396) to the settings
+// document. Top-level keys set to null are removed. versions optionally maps
+// keys to the versions the client last read, 0 for keys it saw missing; when
+// any has changed nothing is applied and the current values are returned
+// with a 409. Keys without a version are merged into their current value.
+func PatchSettings(c *gin.Context) {
+	userID := c.GetString("user_id")
+
+	var requestBody struct {
+		Patch    map[string]json.RawMessage `json:"patch"`
+		Versions map[string]int64           `json:"versions"`
+	}
+	if err := c.ShouldBindJSON(&requestBody); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if len(requestBody.Patch) == 0 {
+		c.JSON(400, gin.H{"error": "patch must be an object with at least one key"})
+		return
+	}
+
+	patch := make(map[string]interface{}, len(requestBody.Patch))
+	keys := make([]string, 0, len(requestBody.Patch))
+	for key, raw := range requestBody.Patch {
+		if key == "" || utf8.RuneCountInString(key) > maxKeyLength {
+			c.JSON(400, gin.H{"error": fmt.Sprintf("Setting keys must be 1 to %d characters", maxKeyLength)})
+			return
+		}
+		value, err := decodeJSON(raw)
+		if err != nil {
+			c.JSON(400, gin.H{"error": "Invalid value for " + key})
+			return
+		}
+		patch[key] = value
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	db := c.MustGet("db").(*pgxpool.Pool)
+
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback(context.Background())
+
+	if err := lockSettings(tx, userID); err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	versionKeys := make([]string, 0, len(requestBody.Versions))
+	for key := range requestBody.Versions {
+		versionKeys = append(versionKeys, key)
+	}
+	current, err := loadSettings(tx, userID, append(versionKeys, keys...))
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	conflicts := []settingConflict{}
+	sort.Strings(versionKeys)
+	for _, key := range versionKeys {
+		if current[key].version != requestBody.Versions[key] {
+			conflicts = append(conflicts, settingConflict{Key: key, Version: current[key].version, Value: current[key].value})
+		}
+	}
+	if len(conflicts) > 0 {
+		c.JSON(409, gin.H{
+			"error":     "Settings changed since they were read",
+			"conflicts": conflicts,
+		})
+		return
+	}
+
+	for _, key := range keys {
+		var value interface{}
+		if patch[key] != nil {
+			value = mergePatch(current[key].value, patch[key])
+		}
+		err := writeSetting(tx, userID, key, value, current[key])
+		if errors.Is(err, errInvalidSetting) {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	settings, err := loadSettings(tx, userID, nil)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	err = tx.Commit(context.Background())
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(200, settingsResponse(settings))
+}
+
+// GetSettingsHistory returns past values of the user's settings, newest
+// first. key limits it to one setting and before pages back from an id.
+func GetSettingsHistory(c *gin.Context) {
+	userID := c.GetString("user_id")
+	db := c.MustGet("db").(*pgxpool.Pool)
+
+	limit := 50
+	if limitStr := c.Query("limit"); limitStr != "" {
+		l, err := strconv.Atoi(limitStr)
+		if err != nil || l <= 0 || l > 500 {
+			c.JSON(400, gin.H{"error": "Invalid limit, expected 1 to 500"})
+			return
+		}
+		limit = l
+	}
+
+	query := "SELECT id, key, value, version, changed_at FROM user_settings_history WHERE user_id = $1"
+	args := []interface{}{userID}
+	if key := c.Query("key"); key != "" {
+		args = append(args, key)
+		query += " AND key = $" + strconv.Itoa(len(args))
+	}
+	if beforeStr := c.Query("before"); beforeStr != "" {
+		before, err := strconv.ParseInt(beforeStr, 10, 64)
+		if err != nil {
+			c.JSON(400, gin.H{"error": "Invalid before id"})
+			return
+		}
+		args = append(args, before)
+		query += " AND id < $" + strconv.Itoa(len(args))
+	}
+	args = append(args, limit)
+	query += " ORDER BY id DESC LIMIT $" + strconv.Itoa(len(args))
+
+	rows, err := db.Query(context.Background(), query, args...)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	history := []SettingChange{}
+	for rows.Next() {
+		var change SettingChange
+		var value []byte
+		if err := rows.Scan(&change.ID, &change.Key, &value, &change.Version, &change.ChangedAt); err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		change.Value = json.RawMessage("null")
+		if value != nil {
+			change.Value = value
+		}
+		history = append(history, change)
+	}
+	if err := rows.Err(); err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(200, gin.H{"history": history})
+}
+
+// RollbackSettings restores the settings changed after at, or only the given
+// keys, to the values they had then. Settings that did not exist yet are
+// removed. The rollback is recorded as new versions so it can be undone too.
+// Keys whose history no longer reaches back to at are skipped.
+func RollbackSettings(c *gin.Context) {
+	userID := c.GetString("user_id")
+
+	var requestBody struct {
+		At   time.Time `json:"at"`
+		Keys []string  `json:"keys"`
+	}
+	if err := c.ShouldBindJSON(&requestBody); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if requestBody.At.IsZero() {
+		c.JSON(400, gin.H{"error": "at is required"})
+		return
+	}
+	at := requestBody.At.UTC()
+
+	db := c.MustGet("db").(*pgxpool.Pool)
+
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback(context.Background())
+
+	if err := lockSettings(tx, userID); err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	// For every key changed since at, its latest value before at and the
+	// first version still in its history
+	rows, err := tx.Query(context.Background(), `
+		SELECT h.key,
+			(SELECT b.value FROM user_settings_history b WHERE b.user_id = $1 AND b.key = h.key AND b.changed_at <= $2 ORDER BY b.id DESC LIMIT 1),
+			EXISTS(SELECT 1 FROM user_settings_history b WHERE b.user_id = $1 AND b.key = h.key AND b.changed_at <= $2),
+			(SELECT min(b.version) FROM user_settings_history b WHERE b.user_id = $1 AND b.key = h.key)
+		FROM user_settings_history h
+		WHERE h.user_id = $1 AND h.changed_at > $2 AND ($3::text[] IS NULL OR h.key = ANY($3))
+		GROUP BY h.key
+		ORDER BY h.key`, userID, at, requestBody.Keys)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	type restore struct {
+		key   string
+		value []byte
+	}
+	var restores []restore
+	skipped := []string{}
+	for rows.Next() {
+		var r restore
+		var known bool
+		var firstVersion int64
+		if err := rows.Scan(&r.key, &r.value, &known, &firstVersion); err != nil {
+			rows.Close()
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		if !known && firstVersion > 1 {
+			skipped = append(skipped, r.key)
+			continue
+		}
+		restores = append(restores, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	keys := make([]string, len(restores))
+	for i, r := range restores {
+		keys[i] = r.key
+	}
+	current, err := loadSettings(tx, userID, keys)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	restored := []string{}
+	for _, r := range restores {
+		var value interface{}
+		if r.value != nil {
+			if value, err = decodeJSON(r.value); err != nil {
+				c.JSON(500, gin.H{"error": err.Error()})
+				return
+			}
+		}
+		// Restored values skip validation, they were valid when stored
+		changed, err := storeSetting(tx, userID, r.key, value, current[r.key])
+		if err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		if changed {
+			restored = append(restored, r.key)
+		}
+	}
+
+	settings, err := loadSettings(tx, userID, nil)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	err = tx.Commit(context.Background())
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	response := settingsResponse(settings)
+	response["restored"] = restored
+	response["skipped"] = skipped
+	c.JSON(200, response)
+}
+
+// dbtx is satisfied by both pools and transactions
+type dbtx interface {
+	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
+}
+
+// loadSettings returns the user's settings by key, limited to keys when it
+// is not nil
+func loadSettings(db dbtx, userID string, keys []string) (map[string]setting, error) {
+	query := "SELECT key, value, version FROM user_settings WHERE user_id = $1"
+	args := []interface{}{userID}
+	if keys != nil {
+		query += " AND key = ANY($2)"
+		args = append(args, keys)
+	}
+	rows, err := db.Query(context.Background(), query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	settings := make(map[string]setting)
+	for rows.Next() {
+		var key string
+		var raw []byte
+		var s setting
+		if err := rows.Scan(&key, &raw, &s.version); err != nil {
+			return nil, err
+		}
+		if s.value, err = decodeJSON(raw); err != nil {
+			return nil, err
+		}
+		settings[key] = s
+	}
+	return settings, rows.Err()
+}
+
+// settingsResponse is the settings document with the version of each key
+func settingsResponse(settings map[string]setting) gin.H {
+	values := make(map[string]interface{}, len(settings))
+	versions := make(map[string]int64, len(settings))
+	for key, s := range settings {
+		values[key] = s.value
+		versions[key] = s.version
+	}
+	return gin.H{"settings": values, "versions": versions}
+}
+
+// lockSettings serializes changes to the user's settings until the
+// transaction ends, including the creation of new keys
+func lockSettings(tx pgx.Tx, userID string) error {
+	_, err := tx.Exec(context.Background(), "SELECT pg_advisory_xact_lock(hashtext('user_settings:' || $1::text))", userID)
+	return err
+}
+
+// writeSetting validates and stores a setting's new value, removing it when
+// value is nil
+func writeSetting(tx pgx.Tx, userID string, key string, value interface{}, current setting) error {
+	if value != nil {
+		if err := validateSetting(key, value); err != nil {
+			return fmt.Errorf("%w: %s", errInvalidSetting, err.Error())
+		}
+	}
+	_, err := storeSetting(tx, userID, key, value, current)
+	return err
+}
+
+// storeSetting stores a setting's new value, or removes it when value is
+// nil, and records it in the history. It reports false, and stores nothing,
+// when the value is unchanged.
+func storeSetting(tx pgx.Tx, userID string, key string, value interface{}, current setting) (bool, error) {
+	var raw []byte
+	if value != nil {
+		var err error
+		if raw, err = json.Marshal(value); err != nil {
+			return false, err
+		}
+	}
+	if current.value == nil && value == nil {
+		return false, nil
+	}
+	if current.value != nil && value != nil {
+		// Marshalling sorts object keys, so equal values marshal the same
+		currentRaw, err := json.Marshal(current.value)
+		if err != nil {
+			return false, err
+		}
+		if bytes.Equal(currentRaw, raw) {
+			return false, nil
+		}
+	}
+
+	// Versions continue across removals so a stale version never matches
+	var version int64
+	err := tx.QueryRow(context.Background(),
+		"SELECT COALESCE(max(version), 0) + 1 FROM user_settings_history WHERE user_id = $1 AND key = $2",
+		userID, key).Scan(&version)
+	if err != nil {
+		return false, err
+	}
+	if current.version >= version {
+		version = current.version + 1
+	}
+
+	if value == nil {
+		_, err = tx.Exec(context.Background(), "DELETE FROM user_settings WHERE user_id = $1 AND key = $2", userID, key)
+	} else {
+		_, err = tx.Exec(context.Background(), `
+			INSERT INTO user_settings (user_id, key, value, version) VALUES ($1, $2, $3, $4)
+			ON CONFLICT (user_id, key) DO UPDATE SET value = EXCLUDED.value, version = EXCLUDED.version, updated_at = now()`,
+			userID, key, raw, version)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	_, err = tx.Exec(context.Background(),
+		"INSERT INTO user_settings_history (user_id, key, value, version) VALUES ($1, $2, $3, $4)",
+		userID, key, raw, version)
+	if err != nil {
+		return false, err
+	}
+	_, err = tx.Exec(context.Background(), `
+		DELETE FROM user_settings_history WHERE user_id = $1 AND key = $2 AND id <= (
+			SELECT id FROM user_settings_history WHERE user_id = $1 AND key = $2
+			ORDER BY id DESC OFFSET $3 LIMIT 1
+		)`, userID, key, maxSettingHistory)
+	return true, err
+}
+
+// mergePatch applies a JSON merge patch to a decoded value. Object patches
+// are merged member by member, null members removing them, and anything
+// else replaces the value.
+func mergePatch(target interface{}, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	targetObject, ok := target.(map[string]interface{})
+	if !ok {
+		targetObject = make(map[string]interface{})
+	}
+	merged := make(map[string]interface{}, len(targetObject))
+	for key, value := range targetObject {
+		merged[key] = value
+	}
+	for key, value := range patchObject {
+		if value == nil {
+			delete(merged, key)
+			continue
+		}
+		merged[key] = mergePatch(merged[key], value)
+	}
+	return merged
+}
+
+// decodeJSON decodes a JSON value keeping numbers as json.Number, so they are
+// stored exactly as sent
+func decodeJSON(raw []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
@@ -0,0 +1,64 @@
+package usersync
+
+import (
+	"reflect"
+	"testing"
+)
+
+func mustDecode(t *testing.T, raw string) interface{} {
+	t.Helper()
+	value, err := decodeJSON([]byte(raw))
+	if err != nil {
+		t.Fatalf("decodeJSON(%s): %v", raw, err)
+	}
+	return value
+}
+
+func TestMergePatch(t *testing.T) {
+	// Cases from RFC 7386, plus nested merges
+	tests := []struct {
+		name   string
+		target string
+		patch  string
+		want   string
+	}{
+		{name: "replace member", target: `{"a":"b"}`, patch: `{"a":"c"}`, want: `{"a":"c"}`},
+		{name: "add member", target: `{"a":"b"}`, patch: `{"b":"c"}`, want: `{"a":"b","b":"c"}`},
+		{name: "null removes member", target: `{"a":"b"}`, patch: `{"a":null}`, want: `{}`},
+		{name: "null removes one of several", target: `{"a":"b","b":"c"}`, patch: `{"a":null}`, want: `{"b":"c"}`},
+		{name: "null for a missing member", target: `{"a":"b"}`, patch: `{"c":null}`, want: `{"a":"b"}`},
+		{name: "array replaces array", target: `{"a":["b"]}`, patch: `{"a":"c"}`, want: `{"a":"c"}`},
+		{name: "value replaces array", target: `{"a":"c"}`, patch: `{"a":["b"]}`, want: `{"a":["b"]}`},
+		{name: "arrays are not merged", target: `{"a":[1,2]}`, patch: `{"a":[3]}`, want: `{"a":[3]}`},
+		{
+			name:   "nested merge",
+			target: `{"modelSettings":{"temperature":0.7,"top_k":40},"model":"m"}`,
+			patch:  `{"modelSettings":{"top_k":null,"seed":1}}`,
+			want:   `{"modelSettings":{"temperature":0.7,"seed":1},"model":"m"}`,
+		},
+		{name: "nested null", target: `{"a":{"b":"c"}}`, patch: `{"a":{"b":"d","c":null}}`, want: `{"a":{"b":"d"}}`},
+		{name: "object replaces scalar", target: `{"a":"b"}`, patch: `{"a":{"c":"d"}}`, want: `{"a":{"c":"d"}}`},
+		{name: "null inside a new object is dropped", target: `{}`, patch: `{"a":{"bb":{"ccc":null}}}`, want: `{"a":{"bb":{}}}`},
+		{name: "object patch on a non-object", target: `["a"]`, patch: `{"a":"b"}`, want: `{"a":"b"}`},
+		{name: "non-object patch replaces the target", target: `{"a":"b"}`, patch: `["c"]`, want: `["c"]`},
+		{name: "null patch replaces the target", target: `{"a":"b"}`, patch: `null`, want: `null`},
+		{name: "scalar patch", target: `{"e":null}`, patch: `"bar"`, want: `"bar"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := mergePatch(mustDecode(t, tt.target), mustDecode(t, tt.patch))
+			if want := mustDecode(t, tt.want); !reflect.DeepEqual(got, want) {
+				t.Errorf("mergePatch(%s, %s) = %v, want %v", tt.target, tt.patch, got, want)
+			}
+		})
+	}
+}
+
+func TestMergePatchLeavesTargetUnchanged(t *testing.T) {
+	target := mustDecode(t, `{"a":"b","c":{"d":"e"}}`)
+	mergePatch(target, mustDecode(t, `{"a":null,"c":{"d":"f"}}`))
+	if want := mustDecode(t, `{"a":"b","c":{"d":"e"}}`); !reflect.DeepEqual(target, want) {
+		t.Errorf("target = %v after merging, want %v", target, want)
+	}
+}
@@ -2,9 +2,11 @@ package usersync
 
 import (
 	"context"
+	"errors"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 	uuid "github.com/satori/go.uuid"
 )
@@ -33,6 +35,10 @@ func GetSync(c *gin.Context) {
 
 	db := c.MustGet("db").(*pgxpool.Pool)
 	err := db.QueryRow(context.Background(), "SELECT * FROM sync WHERE user_id = $1", userID).Scan(&sync.ID, &sync.State, &sync.UserId, &sync.CreatedAt, &sync.UpdatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.JSON(404, gin.H{"error": "No sync state saved"})
+		return
+	}
 	if err != nil {
 		c.JSON(500, gin.H{"error": err.Error()})
 		return